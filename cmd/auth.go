@@ -0,0 +1,558 @@
+package cmd
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	urlPkg "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// authFlags are names of the flags (and config keys) configuring
+// authentication against FHIR servers
+var authFlags = []string{"bearer-token", "basic-auth", "client-id", "jwks", "kid", "token-url", "scope"}
+
+// addAuthFlags registers authentication flags on a command which talks
+// to FHIR servers
+func addAuthFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("bearer-token", "", "Static bearer token to send in Authorization header")
+	cmd.PersistentFlags().String("basic-auth", "", "Credentials for HTTP Basic authentication in user:password form")
+	cmd.PersistentFlags().String("client-id", "", "Client ID registered for SMART Backend Services authentication")
+	cmd.PersistentFlags().String("jwks", "", "JWKS file with the private key (RS384 or ES384) to sign SMART Backend Services assertions")
+	cmd.PersistentFlags().String("kid", "", "ID of the key from JWKS file to use, the first suitable key is used if not set")
+	cmd.PersistentFlags().String("token-url", "", "SMART token endpoint, discovered from .well-known/smart-configuration if not set")
+	cmd.PersistentFlags().String("scope", "system/*.read", "Scopes to request with SMART Backend Services authentication")
+}
+
+// bindCommandFlags binds flags of the command being executed to viper
+// keys. It has to be done right before the command runs, because
+// several commands share flag names and bindings made in init() would
+// override each other.
+func bindCommandFlags(cmd *cobra.Command, names ...string) {
+	for _, name := range names {
+		if f := cmd.Flags().Lookup(name); f != nil {
+			viper.BindPFlag(name, f)
+		}
+	}
+}
+
+// authenticator adds credentials to outgoing requests
+type authenticator interface {
+	// Authorize sets Authorization header; refresh forces obtaining new
+	// credentials if they can expire
+	Authorize(req *http.Request, refresh bool) error
+}
+
+type bearerAuth struct {
+	token string
+}
+
+func (a *bearerAuth) Authorize(req *http.Request, refresh bool) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a *basicAuth) Authorize(req *http.Request, refresh bool) error {
+	req.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+// smartBackendAuth implements SMART Backend Services authorization:
+// client_credentials grant with a client assertion JWT signed with
+// the private key from JWKS. Access token is cached until it's about
+// to expire.
+type smartBackendAuth struct {
+	clientID  string
+	tokenURL  string
+	scope     string
+	kid       string
+	alg       string
+	key       crypto.Signer
+	client    *http.Client
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	D   string `json:"d"`
+	P   string `json:"p"`
+	Q   string `json:"q"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jsonWebKey) privateKey() (crypto.Signer, string, error) {
+	if k.D == "" {
+		return nil, "", fmt.Errorf("key %s is not a private key", k.Kid)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		var n, e, d, p, q *big.Int
+		var err error
+
+		for _, f := range []struct {
+			dst **big.Int
+			src string
+		}{{&n, k.N}, {&e, k.E}, {&d, k.D}, {&p, k.P}, {&q, k.Q}} {
+			if *f.dst, err = decodeBigInt(f.src); err != nil {
+				return nil, "", fmt.Errorf("cannot decode RSA key %s: %v", k.Kid, err)
+			}
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+
+		if err := key.Validate(); err != nil {
+			return nil, "", fmt.Errorf("invalid RSA key %s: %v", k.Kid, err)
+		}
+
+		key.Precompute()
+
+		return key, "RS384", nil
+
+	case "EC":
+		if k.Crv != "P-384" {
+			return nil, "", fmt.Errorf("unsupported curve %s of EC key %s, only P-384 is supported", k.Crv, k.Kid)
+		}
+
+		x, err := decodeBigInt(k.X)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot decode EC key %s: %v", k.Kid, err)
+		}
+
+		y, err := decodeBigInt(k.Y)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot decode EC key %s: %v", k.Kid, err)
+		}
+
+		d, err := decodeBigInt(k.D)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot decode EC key %s: %v", k.Kid, err)
+		}
+
+		key := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P384(), X: x, Y: y},
+			D:         d,
+		}
+
+		return key, "ES384", nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported key type %s of key %s", k.Kty, k.Kid)
+}
+
+// loadSigningKey reads the private key from JWKS file. If kid is empty,
+// the first RS384 or ES384 private key is used.
+func loadSigningKey(fileName string, kid string) (crypto.Signer, string, string, error) {
+	content, err := os.ReadFile(fileName)
+
+	if err != nil {
+		return nil, "", "", fmt.Errorf("cannot read JWKS file: %v", err)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := jsoniter.Unmarshal(content, &jwks); err != nil {
+		return nil, "", "", fmt.Errorf("cannot parse JWKS file: %v", err)
+	}
+
+	for _, k := range jwks.Keys {
+		if (kid != "" && k.Kid != kid) || k.D == "" {
+			continue
+		}
+
+		if k.Alg != "" && k.Alg != "RS384" && k.Alg != "ES384" {
+			continue
+		}
+
+		key, alg, err := k.privateKey()
+
+		if err != nil {
+			if kid != "" {
+				return nil, "", "", err
+			}
+
+			continue
+		}
+
+		return key, alg, k.Kid, nil
+	}
+
+	if kid != "" {
+		return nil, "", "", fmt.Errorf("cannot find private key %s in %s", kid, fileName)
+	}
+
+	return nil, "", "", fmt.Errorf("cannot find RS384 or ES384 private key in %s", fileName)
+}
+
+func (a *smartBackendAuth) clientAssertion() (string, error) {
+	now := time.Now()
+
+	header, err := jsoniter.Marshal(map[string]interface{}{"alg": a.alg, "typ": "JWT", "kid": a.kid})
+
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := jsoniter.Marshal(map[string]interface{}{
+		"iss": a.clientID,
+		"sub": a.clientID,
+		"aud": a.tokenURL,
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"jti": uuid.New().String(),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha512.Sum384([]byte(signingInput))
+
+	var signature []byte
+
+	switch key := a.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA384, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+
+		if err == nil {
+			// JWS wants fixed-size big-endian R || S instead of ASN.1
+			signature = make([]byte, 96)
+			r.FillBytes(signature[:48])
+			s.FillBytes(signature[48:])
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", a.key)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("cannot sign client assertion: %v", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (a *smartBackendAuth) fetchToken(ctx context.Context) error {
+	assertion, err := a.clientAssertion()
+
+	if err != nil {
+		return err
+	}
+
+	form := urlPkg.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", a.scope)
+	form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	form.Set("client_assertion", assertion)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.tokenURL, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("error while requesting access token: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return fmt.Errorf("error reading token response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint returned %d; response body is: %s", resp.StatusCode, body)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err := jsoniter.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return fmt.Errorf("cannot get access_token from token response: %s", body)
+	}
+
+	if token.ExpiresIn <= 0 {
+		token.ExpiresIn = 300
+	}
+
+	a.token = token.AccessToken
+	// refresh a bit earlier so long downloads don't hit expired token
+	a.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 30*time.Second)
+
+	return nil
+}
+
+func (a *smartBackendAuth) Authorize(req *http.Request, refresh bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if refresh || a.token == "" || time.Now().After(a.expiresAt) {
+		if err := a.fetchToken(req.Context()); err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	return nil
+}
+
+// fhirBaseURL strips the operation part from a kick-off URL, i.e.
+// https://server/fhir/Group/1/$export becomes https://server/fhir
+func fhirBaseURL(url string) string {
+	base := url
+
+	if idx := strings.Index(base, "?"); idx >= 0 {
+		base = base[:idx]
+	}
+
+	if idx := strings.Index(base, "/$"); idx >= 0 {
+		base = base[:idx]
+	}
+
+	parts := strings.Split(strings.TrimRight(base, "/"), "/")
+
+	if len(parts) > 1 && parts[len(parts)-2] == "Group" {
+		parts = parts[:len(parts)-2]
+	} else if len(parts) > 0 && (parts[len(parts)-1] == "Patient" || parts[len(parts)-1] == "Group") {
+		parts = parts[:len(parts)-1]
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// discoverTokenURL reads token endpoint from server's SMART configuration
+func discoverTokenURL(ctx context.Context, client *http.Client, serverURL string) (string, error) {
+	configURL := fhirBaseURL(serverURL) + "/.well-known/smart-configuration"
+	req, err := http.NewRequestWithContext(ctx, "GET", configURL, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return "", fmt.Errorf("cannot get SMART configuration: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot get SMART configuration from %s, got %d response; use --token-url flag", configURL, resp.StatusCode)
+	}
+
+	var config struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err == nil {
+		err = jsoniter.Unmarshal(body, &config)
+	}
+
+	if err != nil || config.TokenEndpoint == "" {
+		return "", fmt.Errorf("cannot find token_endpoint in SMART configuration at %s", configURL)
+	}
+
+	return config.TokenEndpoint, nil
+}
+
+// newAuthenticator creates authenticator from the auth flags, it
+// returns nil if no authentication is configured
+func newAuthenticator(ctx context.Context, serverURL string) (authenticator, error) {
+	if token := viper.GetString("bearer-token"); token != "" {
+		return &bearerAuth{token: token}, nil
+	}
+
+	if creds := viper.GetString("basic-auth"); creds != "" {
+		username, password, ok := strings.Cut(creds, ":")
+
+		if !ok {
+			return nil, fmt.Errorf("--basic-auth value should be in user:password form")
+		}
+
+		return &basicAuth{username: username, password: password}, nil
+	}
+
+	clientID := viper.GetString("client-id")
+
+	if clientID == "" {
+		return nil, nil
+	}
+
+	jwksFile := viper.GetString("jwks")
+
+	if jwksFile == "" {
+		return nil, fmt.Errorf("--jwks flag is required for SMART Backend Services authentication")
+	}
+
+	key, alg, kid, err := loadSigningKey(jwksFile, viper.GetString("kid"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	tokenURL := viper.GetString("token-url")
+
+	if tokenURL == "" {
+		tokenURL, err = discoverTokenURL(ctx, client, serverURL)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &smartBackendAuth{
+		clientID: clientID,
+		tokenURL: tokenURL,
+		scope:    viper.GetString("scope"),
+		kid:      kid,
+		alg:      alg,
+		key:      key,
+		client:   client,
+	}, nil
+}
+
+// authTransport authorizes requests to the FHIR server host. Requests
+// to other hosts (like pre-signed cloud storage URLs with exported
+// files) are sent as-is, unless their context is marked with
+// withAccessToken. On 401 response credentials are refreshed and the
+// request is retried once.
+type authTransport struct {
+	base http.RoundTripper
+	auth authenticator
+	host string
+}
+
+type accessTokenKey struct{}
+
+// withAccessToken marks requests made with ctx as needing credentials
+// whatever their host is, like downloads of Bulk Data files when the
+// manifest has "requiresAccessToken": true
+func withAccessToken(ctx context.Context) context.Context {
+	return context.WithValue(ctx, accessTokenKey{}, true)
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host && req.Context().Value(accessTokenKey{}) == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	authReq := req.Clone(req.Context())
+
+	if err := t.auth.Authorize(authReq, false); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(authReq)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	retryReq := req.Clone(req.Context())
+
+	if req.GetBody != nil {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.auth.Authorize(retryReq, true); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(retryReq)
+}
+
+// newFHIRClient returns HTTP client which authenticates against the
+// server from serverURL according to auth flags
+func newFHIRClient(ctx context.Context, serverURL string) (*http.Client, error) {
+	auth, err := newAuthenticator(ctx, serverURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if auth == nil {
+		return &http.Client{}, nil
+	}
+
+	parsed, err := urlPkg.Parse(serverURL)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse URL %s: %v", serverURL, err)
+	}
+
+	return &http.Client{
+		Transport: &authTransport{base: http.DefaultTransport, auth: auth, host: parsed.Host},
+	}, nil
+}
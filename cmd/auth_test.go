@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// writeJWKS writes private keys into JWKS file and returns its name
+func writeJWKS(t *testing.T, keys ...jsonWebKey) string {
+	t.Helper()
+
+	content, err := jsoniter.Marshal(map[string]interface{}{"keys": keys})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(fileName, content, 0600)
+
+	return fileName
+}
+
+func rsaJWK(t *testing.T, kid string) (jsonWebKey, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Alg: "RS384",
+		N:   encodeBigInt(key.N),
+		E:   encodeBigInt(big.NewInt(int64(key.E))),
+		D:   encodeBigInt(key.D),
+		P:   encodeBigInt(key.Primes[0]),
+		Q:   encodeBigInt(key.Primes[1]),
+	}, key
+}
+
+func ecJWK(t *testing.T, kid string) (jsonWebKey, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-384",
+		X:   encodeBigInt(key.X),
+		Y:   encodeBigInt(key.Y),
+		D:   encodeBigInt(key.D),
+	}, key
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	rsaKey, _ := rsaJWK(t, "rsa-1")
+	ecKey, _ := ecJWK(t, "ec-1")
+	publicKey := rsaKey
+	publicKey.Kid = "public"
+	publicKey.D = ""
+	fileName := writeJWKS(t, publicKey, rsaKey, ecKey)
+
+	tests := []struct {
+		kid string
+		alg string
+		key string
+	}{
+		// public keys are skipped when kid isn't provided
+		{"", "RS384", "rsa-1"},
+		{"rsa-1", "RS384", "rsa-1"},
+		{"ec-1", "ES384", "ec-1"},
+	}
+
+	for _, tt := range tests {
+		_, alg, kid, err := loadSigningKey(fileName, tt.kid)
+
+		if err != nil || alg != tt.alg || kid != tt.key {
+			t.Errorf("kid %q: got %s %s %v, want %s %s", tt.kid, alg, kid, err, tt.alg, tt.key)
+		}
+	}
+
+	for _, kid := range []string{"public", "missing"} {
+		if _, _, _, err := loadSigningKey(fileName, kid); err == nil {
+			t.Errorf("kid %q: expected error", kid)
+		}
+	}
+
+	p256 := ecKey
+	p256.Crv = "P-256"
+
+	if _, _, _, err := loadSigningKey(writeJWKS(t, p256), ""); err == nil {
+		t.Error("expected error for unsupported curve")
+	}
+}
+
+// verifyAssertion checks client assertion signature and returns its
+// header and claims
+func verifyAssertion(t *testing.T, assertion string, key crypto.PublicKey) (map[string]interface{}, map[string]interface{}) {
+	t.Helper()
+
+	parts := strings.Split(assertion, ".")
+
+	if len(parts) != 3 {
+		t.Fatalf("invalid JWT: %s", assertion)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha512.Sum384([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA384, digest[:], signature); err != nil {
+			t.Errorf("invalid RS384 signature: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		if len(signature) != 96 {
+			t.Fatalf("got %d bytes ES384 signature, want 96", len(signature))
+		}
+
+		r, s := new(big.Int).SetBytes(signature[:48]), new(big.Int).SetBytes(signature[48:])
+
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			t.Error("invalid ES384 signature")
+		}
+	}
+
+	var header, claims map[string]interface{}
+
+	for i, dst := range []*map[string]interface{}{&header, &claims} {
+		content, _ := base64.RawURLEncoding.DecodeString(parts[i])
+
+		if err := jsoniter.Unmarshal(content, dst); err != nil {
+			t.Fatalf("invalid JWT part %s: %v", content, err)
+		}
+	}
+
+	return header, claims
+}
+
+func TestClientAssertion(t *testing.T) {
+	rsaKey, rsaPrivate := rsaJWK(t, "rsa-1")
+	ecKey, ecPrivate := ecJWK(t, "ec-1")
+	fileName := writeJWKS(t, rsaKey, ecKey)
+
+	for kid, public := range map[string]crypto.PublicKey{"rsa-1": &rsaPrivate.PublicKey, "ec-1": &ecPrivate.PublicKey} {
+		key, alg, _, err := loadSigningKey(fileName, kid)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := &smartBackendAuth{clientID: "client-1", tokenURL: "https://auth.test/token", kid: kid, alg: alg, key: key}
+		assertion, err := a.clientAssertion()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, claims := verifyAssertion(t, assertion, public)
+
+		if header["alg"] != alg || header["kid"] != kid || header["typ"] != "JWT" {
+			t.Errorf("%s: wrong header %v", kid, header)
+		}
+
+		if claims["iss"] != "client-1" || claims["sub"] != "client-1" || claims["aud"] != "https://auth.test/token" || claims["jti"] == "" {
+			t.Errorf("%s: wrong claims %v", kid, claims)
+		}
+	}
+}
+
+func TestSmartBackendAuth(t *testing.T) {
+	rsaKey, rsaPrivate := rsaJWK(t, "rsa-1")
+	key, alg, kid, _ := loadSigningKey(writeJWKS(t, rsaKey), "")
+
+	var tokens, unauthorized int32
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "system/*.read" {
+			t.Errorf("wrong token request: %v", r.Form)
+		}
+
+		verifyAssertion(t, r.Form.Get("client_assertion"), &rsaPrivate.PublicKey)
+		n := atomic.AddInt32(&tokens, 1)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, n)
+	}))
+	defer tokenServer.Close()
+
+	// the first token is rejected, so the client should get a new one
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			atomic.AddInt32(&unauthorized, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte("{}"))
+	}))
+	defer fhirServer.Close()
+
+	a := &smartBackendAuth{
+		clientID: "client-1",
+		tokenURL: tokenServer.URL,
+		scope:    "system/*.read",
+		kid:      kid,
+		alg:      alg,
+		key:      key,
+		client:   tokenServer.Client(),
+	}
+
+	client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, auth: a, host: strings.TrimPrefix(fhirServer.URL, "http://")}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(fhirServer.URL + "/Patient")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("request %d: got status %d", i, resp.StatusCode)
+		}
+	}
+
+	// the second request reuses the cached token
+	if tokens != 2 || unauthorized != 1 {
+		t.Errorf("got %d token requests and %d unauthorized responses, want 2 and 1", tokens, unauthorized)
+	}
+}
+
+func TestAuthTransportOtherHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("credentials shouldn't be sent to other hosts")
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, auth: &bearerAuth{token: "secret"}, host: "fhir.test"}}
+	resp, err := client.Get(server.URL + "/files/Patient.ndjson")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+}
+
+func TestDiscoverTokenURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fhir/.well-known/smart-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte(`{"token_endpoint": "https://auth.test/token"}`))
+	}))
+	defer server.Close()
+
+	tokenURL, err := discoverTokenURL(context.Background(), server.Client(), server.URL+"/fhir/Group/g-1/$export?_type=Patient")
+
+	if err != nil || tokenURL != "https://auth.test/token" {
+		t.Errorf("got %s, %v", tokenURL, err)
+	}
+
+	if _, err := discoverTokenURL(context.Background(), server.Client(), server.URL+"/other/$export"); err == nil {
+		t.Error("expected error for missing SMART configuration")
+	}
+}
+
+func TestFhirBaseURL(t *testing.T) {
+	tests := map[string]string{
+		"https://server.test/fhir/$export":                       "https://server.test/fhir",
+		"https://server.test/fhir/Patient/$export?_type=Patient": "https://server.test/fhir",
+		"https://server.test/fhir/Group/g-1/$export":             "https://server.test/fhir",
+		"https://server.test/fhir/":                              "https://server.test/fhir",
+	}
+
+	for url, expected := range tests {
+		if base := fhirBaseURL(url); base != expected {
+			t.Errorf("%s: got %s, want %s", url, base, expected)
+		}
+	}
+}
@@ -4,6 +4,9 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"math"
@@ -32,9 +35,12 @@ var acceptHeader string = "application/fhir+json"
 
 // bulkCmd represents the bulk command
 var bulkCmd = &cobra.Command{
-	Use:     "bulkget",
-	Short:   "Downloads FHIR data from Bulk Data API endpoint and saves NDJSON files on local filesystem into specified directory",
-	Example: "fhirbase bulkget [--numdl=10] http://some-fhir-server.com/fhir/Patient/$everything /output/dir/",
+	Use:   "bulkget",
+	Short: "Downloads FHIR data from Bulk Data API endpoint and saves NDJSON files on local filesystem into specified directory",
+	Example: `fhirbase bulkget [--numdl=10] http://some-fhir-server.com/fhir/Patient/$export /output/dir/
+fhirbase bulkget --resume /output/dir/
+fhirbase bulkget --cancel http://some-fhir-server.com/fhir/$export-poll-status?job=42
+fhirbase bulkget --level=group --group=42 --type=Patient,Observation --since=2024-01-01T00:00:00Z http://some-fhir-server.com/fhir /output/dir/`,
 	Long: `
 Downloads FHIR data from Bulk Data API endpoint and saves results into
 specific directory on a local filesystem.
@@ -47,10 +53,91 @@ is an "--accept-header" option which sets the value for "Accept"
 header. Most likely you won't need to set it, but if Bulk Data server
 rejects queries because of "Accept" header value, consider explicitly
 set it to something it expects.
+
+Files are named after the resource type they contain, like
+"Patient.1.ndjson", "Patient.2.ndjson", "Observation.1.ndjson".
+OperationOutcomes from the "error" part of the export are saved into
+"errors" subdirectory and summary of reported issues is printed.
+Bundles listing resources deleted since "--since" instant are saved
+into "deleted" subdirectory, load command applies them as deletions.
+
+Progress is recorded in the "bulkget-manifest.json" file in the output
+directory: export status URL and URL, file name, size in bytes,
+number of lines and status of every file. Failed downloads are retried
+"--retries" times with exponential backoff, continuing partially
+written files with HTTP Range requests when server supports them. If
+a download was interrupted or some files failed, run
+
+  fhirbase bulkget --resume /output/dir/
+
+to poll the export again (if it wasn't finished) and to fetch only
+missing files.
+
+While the server prepares the export, its status is polled as often
+as the server asks in the Retry-After header, and the progress
+reported by the server is shown. Rate limiting and temporary server
+errors don't stop polling. Use "--poll-timeout" flag (i.e.
+"--poll-timeout=48h") to limit the total waiting time, default is 24
+hours.
+
+If bulkget is interrupted (i.e. with Ctrl-C) while the server is still
+preparing the export, the export is cancelled on the server with
+DELETE request to its status URL, so it doesn't consume server
+resources. Interrupted file downloads can be resumed, so the export
+isn't cancelled then. To cancel an export explicitly, run
+
+  fhirbase bulkget --cancel <status URL>
+
+Export parameters are set with flags and sent in the query string of
+the kick-off GET request:
+
+  --type=Patient,Observation     _type, resource types to export
+  --since=2024-01-01T00:00:00Z   _since, only resources changed after
+                                 this instant, use it for incremental
+                                 exports
+  --type-filter=QUERY            _typeFilter, can be repeated, i.e.
+                                 --type-filter="Observation?status=final"
+  --output-format=FORMAT         _outputFormat
+  --elements=Patient.name,id     _elements
+  --patient=Patient/123          patient, can be repeated
+
+With "--post" flag (implied by "--patient") kick-off is sent as POST
+request with a Parameters resource in the body instead.
+
+If the URL doesn't contain "$export" operation, it's treated as FHIR
+server base URL and the operation is chosen with "--level" flag:
+"system" for [base]/$export (default), "patient" for
+[base]/Patient/$export and "group" for [base]/Group/[id]/$export
+where id is provided with "--group" flag.
+
+If the server requires authentication, use one of the following:
+
+  --bearer-token=TOKEN        sends a static bearer token
+  --basic-auth=user:password  uses HTTP Basic authentication
+  --client-id=ID --jwks=keys.json
+                              uses SMART Backend Services authorization.
+                              Client assertion is signed with RS384 or
+                              ES384 private key from the JWKS file
+                              (choose one with "--kid"), the token
+                              endpoint is read from the server's
+                              .well-known/smart-configuration unless
+                              "--token-url" is set. Requested scopes are
+                              set with "--scope". Access token is
+                              refreshed automatically when it expires
+                              during long downloads.
+
+Credentials are sent only to the host of the Bulk Data API endpoint,
+so files hosted elsewhere (i.e. pre-signed cloud storage URLs) are
+downloaded without them, unless the export manifest has
+"requiresAccessToken": true. All these options can be set in the config
+file as well to keep secrets out of the command line.
 `,
-	Args: cobra.ExactArgs(2),
+	Args: cobra.RangeArgs(0, 2),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindCommandFlags(cmd, append(append(authFlags, exportFlags...), "numdl", "accept-header", "retries", "resume", "cancel", "poll-timeout")...)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) < 2 {
+		if viper.GetString("cancel") == "" && (len(args) == 0 || len(args) < 2 && !viper.GetBool("resume")) {
 			fmt.Println("Not enough arguments")
 			return
 		}
@@ -71,9 +158,13 @@ func init() {
 	// Cobra supports Persistent Flags which will work for this command
 	// and all subcommands, e.g.:
 	bulkCmd.PersistentFlags().IntVarP(&numdl, "numdl", "n", 5, "Number of parallel downloads")
-	bulkCmd.PersistentFlags().StringVar(&acceptHeader, "accept-header", "a", "application/fhir+json")
-	viper.BindPFlag("numdl", bulkCmd.PersistentFlags().Lookup("numdl"))
-	viper.BindPFlag("accept-header", bulkCmd.PersistentFlags().Lookup("accept-header"))
+	bulkCmd.PersistentFlags().StringVar(&acceptHeader, "accept-header", "application/fhir+json", "Value for Accept HTTP header")
+	bulkCmd.PersistentFlags().Int("retries", 5, "Number of retries for every file download")
+	bulkCmd.PersistentFlags().Bool("resume", false, "Resume interrupted download using manifest in the output directory")
+	bulkCmd.PersistentFlags().String("cancel", "", "Cancel export with the given status URL and exit")
+	bulkCmd.PersistentFlags().Duration("poll-timeout", 24*time.Hour, "How long to wait for the server to prepare the export, 0 to wait forever")
+	addAuthFlags(bulkCmd)
+	addExportFlags(bulkCmd)
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// bulkCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -81,72 +172,363 @@ func init() {
 
 var matchNonDigits, _ = regexp.Compile("[^\\d]")
 
-func getBulkDataFiles(pingURL string, client *http.Client) ([]string, error) {
-	maxRetries := 10
-	baseDelay := 10 * time.Second
-	var fileURLs []string
-	fmt.Println("Waiting for Bulk Data API server to prepare files...")
+// exportFlags are names of the flags with Bulk Data kick-off parameters
+var exportFlags = []string{"type", "since", "type-filter", "output-format", "elements", "patient", "post", "level", "group"}
+
+// addExportFlags registers flags with Bulk Data kick-off parameters on
+// a command
+func addExportFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringSlice("type", nil, "Resource types to export (_type parameter)")
+	cmd.PersistentFlags().String("since", "", "Export only resources changed after this instant (_since parameter)")
+	cmd.PersistentFlags().StringArray("type-filter", nil, "Search query to filter exported resources (_typeFilter parameter), can be repeated")
+	cmd.PersistentFlags().String("output-format", "", "Format of exported files (_outputFormat parameter)")
+	cmd.PersistentFlags().StringSlice("elements", nil, "Elements to include into exported resources (_elements parameter)")
+	cmd.PersistentFlags().StringSlice("patient", nil, "Patient references to export data for (patient parameter), implies --post")
+	cmd.PersistentFlags().Bool("post", false, "Send kick-off request as POST with Parameters resource in the body")
+	cmd.PersistentFlags().String("level", "system", "Export operation to use when URL is a server base: system, patient or group")
+	cmd.PersistentFlags().String("group", "", "Group ID for group-level export")
+}
+
+// exportKickoffURL returns URL of $export operation. URLs already
+// containing the operation are returned as-is, others are treated as
+// FHIR server base.
+func exportKickoffURL(url string) (string, error) {
+	if strings.Contains(url, "$export") {
+		return url, nil
+	}
+
+	base := strings.TrimRight(url, "/")
+
+	switch viper.GetString("level") {
+	case "", "system":
+		return base + "/$export", nil
+	case "patient":
+		return base + "/Patient/$export", nil
+	case "group":
+		group := viper.GetString("group")
+
+		if group == "" {
+			return "", fmt.Errorf("--group flag is required for group-level export")
+		}
+
+		return base + "/Group/" + urlPkg.PathEscape(group) + "/$export", nil
+	}
+
+	return "", fmt.Errorf("invalid value for --level flag. Possible values are 'system', 'patient' or 'group'")
+}
+
+type exportParameter struct {
+	name  string
+	value string
+}
+
+// exportParameters collects kick-off parameters from the flags
+func exportParameters() ([]exportParameter, error) {
+	params := make([]exportParameter, 0)
+
+	if types := viper.GetStringSlice("type"); len(types) > 0 {
+		params = append(params, exportParameter{"_type", strings.Join(types, ",")})
+	}
+
+	if since := viper.GetString("since"); since != "" {
+		if _, err := time.Parse(time.RFC3339, since); err != nil {
+			return nil, fmt.Errorf("--since should be an instant like 2024-01-01T00:00:00Z: %v", err)
+		}
+
+		params = append(params, exportParameter{"_since", since})
+	}
+
+	for _, filter := range viper.GetStringSlice("type-filter") {
+		params = append(params, exportParameter{"_typeFilter", filter})
+	}
+
+	if format := viper.GetString("output-format"); format != "" {
+		params = append(params, exportParameter{"_outputFormat", format})
+	}
+
+	if elements := viper.GetStringSlice("elements"); len(elements) > 0 {
+		params = append(params, exportParameter{"_elements", strings.Join(elements, ",")})
+	}
+
+	for _, patient := range viper.GetStringSlice("patient") {
+		params = append(params, exportParameter{"patient", patient})
+	}
+
+	return params, nil
+}
+
+// exportParametersResource builds Parameters resource for POST kick-off
+func exportParametersResource(params []exportParameter) map[string]interface{} {
+	items := make([]interface{}, 0, len(params))
+
+	for _, p := range params {
+		item := map[string]interface{}{"name": p.name}
+
+		switch p.name {
+		case "_since":
+			item["valueInstant"] = p.value
+		case "patient":
+			item["valueReference"] = map[string]interface{}{"reference": p.value}
+		default:
+			item["valueString"] = p.value
+		}
+
+		items = append(items, item)
+	}
+
+	return map[string]interface{}{
+		"resourceType": "Parameters",
+		"parameter":    items,
+	}
+}
+
+// newKickoffRequest creates Bulk Data kick-off request with parameters
+// from the flags
+func newKickoffRequest(ctx context.Context, url string, acceptHdr string) (*http.Request, error) {
+	kickoffURL, err := exportKickoffURL(url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := exportParameters()
 
-	for i := 0; i < maxRetries; i++ {
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+
+	if viper.GetBool("post") || len(viper.GetStringSlice("patient")) > 0 {
+		body, err := jsoniter.Marshal(exportParametersResource(params))
 
-		req, err := http.NewRequest("GET", pingURL, nil)
 		if err != nil {
-			return nil, fmt.Errorf("error while creating HTTP request: %w", err)
+			return nil, err
 		}
 
-		resp, err := client.Do(req)
+		req, err = http.NewRequestWithContext(ctx, "POST", kickoffURL, bytes.NewReader(body))
 
 		if err != nil {
-			return nil, fmt.Errorf("error while performing polling request: %w", err)
+			return nil, err
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode == 202 {
-			fmt.Println("still waiting...")
-			// read Retry-After header or use an exponential backoff
-			retryAfter := resp.Header.Get("Retry-After")
-
-			if retryAfter != "" {
-				delay, err := strconv.Atoi(retryAfter)
-				fmt.Printf("Retry in %d seconds...\r", delay)
-				if err != nil {
-					time.Sleep(time.Duration(delay) * time.Second)
-					// show countdown
-					continue
-				}
+		req.Header.Set("Content-Type", "application/fhir+json")
+	} else {
+		parsedURL, err := urlPkg.Parse(kickoffURL)
+
+		if err != nil {
+			return nil, err
+		}
+
+		query := parsedURL.Query()
+
+		for _, p := range params {
+			query.Add(p.name, p.value)
+		}
+
+		parsedURL.RawQuery = query.Encode()
+
+		req, err = http.NewRequestWithContext(ctx, "GET", parsedURL.String(), nil)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// add headers for async response
+	req.Header.Add("Prefer", "respond-async")
+	req.Header.Add("Accept", acceptHdr)
+
+	return req, nil
+}
+
+// parseRetryAfter returns delay from Retry-After header, which is
+// either number of seconds or HTTP-date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+
+		if delay < 0 {
+			delay = 0
+		}
+
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// printPollStatus prints status line over the previous one
+func printPollStatus(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+
+	if len(line) < 79 {
+		line += strings.Repeat(" ", 79-len(line))
+	}
+
+	fmt.Printf("\r%s", line)
+}
+
+// getBulkDataFiles polls export status URL until the export is
+// complete and returns its outputs. Delays between polls come from
+// Retry-After header or grow exponentially if it's missing. Rate
+// limiting, server errors and connection failures are retried as well,
+// unless there are too many of them in a row. Polling stops after
+// "--poll-timeout".
+func getBulkDataFiles(ctx context.Context, pingURL string, client *http.Client) ([]bulkOutput, error) {
+	const maxTransientErrors = 10
+	const minDelay = 2 * time.Second
+	const maxDelay = time.Minute
+
+	timeout := viper.GetDuration("poll-timeout")
+	startTime := time.Now()
+	delay := minDelay
+	transientErrors := 0
+	progress := ""
+
+	fmt.Println("Waiting for Bulk Data API server to prepare files...")
+	defer fmt.Println("")
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", pingURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error while creating HTTP request: %w", err)
+		}
+
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		var retryAfter time.Duration
+		var hasRetryAfter bool
+
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
 
-			// exponential backoff
-			delay := time.Duration(math.Pow(2, float64(i))) * baseDelay
-			time.Sleep(delay)
-			continue
-		} else if resp.StatusCode == 200 {
-			//parse the response body
+			transientErrors++
+
+			if transientErrors > maxTransientErrors {
+				return nil, fmt.Errorf("error while performing polling request: %w", err)
+			}
+
+			progress = fmt.Sprintf("polling failed: %v", err)
+
+		case resp.StatusCode == http.StatusOK:
 			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
 			if err != nil {
 				return nil, fmt.Errorf("error reading response body: %w", err)
 			}
-			fileURLs, err = parseFileURLs(body)
+
+			printPollStatus("Export is complete after %s", time.Since(startTime).Round(time.Second))
+
+			outputs, err := parseBulkManifest(body)
+
 			if err != nil {
 				return nil, fmt.Errorf("error parsing response body: %w", err)
 			}
-			break
 
-		} else {
+			return outputs, nil
+
+		case resp.StatusCode == http.StatusAccepted:
+			transientErrors = 0
+			progress = resp.Header.Get("X-Progress")
+
+			if progress == "" {
+				progress = "in progress"
+			}
+
+			retryAfter, hasRetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			resp.Body.Close()
+
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			transientErrors++
+
+			if transientErrors > maxTransientErrors {
+				return nil, fmt.Errorf("got %d response %d times in a row; response body is: %s", resp.StatusCode, transientErrors, respBody)
+			}
+
+			progress = fmt.Sprintf("server responded with %d", resp.StatusCode)
+			retryAfter, hasRetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+
+		default:
 			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
 			return nil, fmt.Errorf("expected 202 response, got %d; response body is: %s", resp.StatusCode, respBody)
 		}
-	}
 
-	if fileURLs == nil {
-		return nil, fmt.Errorf("Bulk Data API server did not return any files")
+		if !hasRetryAfter {
+			retryAfter = delay
+			delay = time.Duration(math.Min(float64(delay*2), float64(maxDelay)))
+		}
+
+		// Retry-After of 0 or a date in the past mustn't make us poll
+		// in a tight loop
+		if retryAfter < minDelay {
+			retryAfter = minDelay
+		}
+
+		elapsed := time.Since(startTime)
+
+		if timeout > 0 && elapsed+retryAfter > timeout {
+			return nil, fmt.Errorf("export is not complete after %s (%s), use --poll-timeout flag to wait longer", elapsed.Round(time.Second), progress)
+		}
+
+		printPollStatus("[%s] %s, next check in %s", elapsed.Round(time.Second), progress, retryAfter.Round(time.Second))
+
+		if err := sleepContext(ctx, retryAfter); err != nil {
+			return nil, err
+		}
 	}
+}
+
+const (
+	bulkOutputKind  = "output"
+	bulkErrorKind   = "error"
+	bulkDeletedKind = "deleted"
+)
+
+// bulkErrorsDir and bulkDeletedDir are subdirectories of the output
+// directory for OperationOutcomes reported by the server and Bundles
+// with deleted resources
+const (
+	bulkErrorsDir  = "errors"
+	bulkDeletedDir = "deleted"
+)
 
-	return fileURLs, nil
+// bulkOutput is an item of "output", "error" or "deleted" arrays of
+// the Bulk Data manifest
+type bulkOutput struct {
+	Kind  string
+	Type  string
+	URL   string
+	Count int64
+
+	// RequiresAccessToken comes from the manifest, files are
+	// downloaded with the same credentials as the manifest then
+	RequiresAccessToken bool
 }
 
-func parseFileURLs(body []byte) ([]string, error) {
-	// fmt.Println("Bulk Data API server is ready", body)
+func parseBulkManifest(body []byte) ([]bulkOutput, error) {
 	iter := jsoniter.ConfigDefault.BorrowIterator(body)
 	defer jsoniter.ConfigDefault.ReturnIterator(iter)
 
@@ -156,48 +538,57 @@ func parseFileURLs(body []byte) ([]string, error) {
 		return nil, fmt.Errorf("cannot parse JSON from Bulk Data API server")
 	}
 
-	fileURLs := make([]string, 0)
 	objMap, ok := obj.(map[string]interface{})
 
 	if !ok {
 		return nil, fmt.Errorf("expecting JSON object at the top level")
 	}
 
-	output := objMap["output"]
-
-	if output == nil {
+	if objMap["output"] == nil {
 		return nil, fmt.Errorf("expecting to have 'output' attribute")
 	}
 
-	outputArr, ok := output.([]interface{})
+	outputs := make([]bulkOutput, 0)
+	requiresAccessToken, _ := objMap["requiresAccessToken"].(bool)
 
-	if !ok {
-		return nil, fmt.Errorf("'output' attribute is not an JSON Array")
-	}
+	for _, kind := range []string{bulkOutputKind, bulkErrorKind, bulkDeletedKind} {
+		attr := objMap[kind]
 
-	for _, v := range outputArr {
-		item, ok := v.(map[string]interface{})
+		if attr == nil {
+			continue
+		}
+
+		arr, ok := attr.([]interface{})
 
 		if !ok {
-			return nil, fmt.Errorf("got non-object in 'output' array")
+			return nil, fmt.Errorf("'%s' attribute is not an JSON Array", kind)
 		}
 
-		url := item["url"]
+		for _, v := range arr {
+			item, ok := v.(map[string]interface{})
 
-		if url == nil {
-			return nil, fmt.Errorf("cannot get 'url' attribute in item of 'output' array")
-		}
+			if !ok {
+				return nil, fmt.Errorf("got non-object in '%s' array", kind)
+			}
 
-		urlString, ok := url.(string)
+			url, ok := item["url"].(string)
 
-		if !ok {
-			return nil, fmt.Errorf("'url' attribute is not a string")
-		}
+			if !ok {
+				return nil, fmt.Errorf("cannot get 'url' string attribute in item of '%s' array", kind)
+			}
 
-		fileURLs = append(fileURLs, urlString)
+			output := bulkOutput{Kind: kind, URL: url, RequiresAccessToken: requiresAccessToken}
+			output.Type, _ = item["type"].(string)
+
+			if count, ok := item["count"].(float64); ok {
+				output.Count = int64(count)
+			}
+
+			outputs = append(outputs, output)
+		}
 	}
 
-	return fileURLs, nil
+	return outputs, nil
 }
 
 func stripURL(url string, length int) string {
@@ -220,184 +611,928 @@ func ensureDirectoryExists(dir string) error {
 	return nil
 }
 
-func startDlWorker(jobs chan string, results chan interface{}, targetDir string, wg *sync.WaitGroup) {
-	defer wg.Done() // Signal when the worker is done
+// bulkManifestFileName is the name of the file in the output directory
+// which tracks progress of the downloads
+const bulkManifestFileName = "bulkget-manifest.json"
 
-	client := &http.Client{}
+const (
+	downloadPending  = "pending"
+	downloadComplete = "complete"
+	downloadFailed   = "failed"
+)
 
-	for url := range jobs {
-		parsedURL, err := urlPkg.Parse(url)
-		fileName := path.Base(parsedURL.EscapedPath())
+// downloadManifest records the state of a Bulk Data export download,
+// so an interrupted download can be resumed with "--resume" flag
+type downloadManifest struct {
+	mu   sync.Mutex
+	path string
 
-		if err != nil {
-			results <- fmt.Errorf("cannot parse URL: %v", err)
-			continue
-		}
+	KickoffURL string               `json:"kickoffUrl,omitempty"`
+	StatusURL  string               `json:"statusUrl,omitempty"`
+	Files      []*manifestFileEntry `json:"files"`
+}
 
-		// Ensure the file has the .ndjson extension
-		if !strings.HasSuffix(fileName, ".ndjson") {
-			fileName += ".ndjson"
-		}
+type manifestFileEntry struct {
+	URL                 string `json:"url"`
+	Kind                string `json:"kind,omitempty"`
+	Type                string `json:"type,omitempty"`
+	Count               int64  `json:"count,omitempty"`
+	RequiresAccessToken bool   `json:"requiresAccessToken,omitempty"`
+	File                string `json:"file"`
+	Bytes               int64  `json:"bytes"`
+	Lines               int64  `json:"lines"`
+	Status              string `json:"status"`
+	Error               string `json:"error,omitempty"`
+}
 
-		// Create a file in the target directory
-		targetPath := path.Join(targetDir, fileName)
-		targetFile, err := os.Create(targetPath)
+func newDownloadManifest(targetDir string) *downloadManifest {
+	return &downloadManifest{
+		path:  path.Join(targetDir, bulkManifestFileName),
+		Files: make([]*manifestFileEntry, 0),
+	}
+}
 
-		if err != nil {
-			results <- fmt.Errorf("cannot create file: %v", err)
-			continue
-		}
+func readDownloadManifest(targetDir string) (*downloadManifest, error) {
+	m := newDownloadManifest(targetDir)
+	content, err := os.ReadFile(m.path)
 
-		req, err := http.NewRequest("GET", url, nil)
-		req.Header.Add("Accept-Encoding", "gzip")
-		resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read download manifest: %v", err)
+	}
 
-		if err != nil {
-			results <- fmt.Errorf("cannot download %s: %v", url, err)
-			continue
-		}
-		defer resp.Body.Close()
+	if err := jsoniter.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("cannot parse download manifest %s: %v", m.path, err)
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			results <- fmt.Errorf("got non-200 response while downloading %s", url)
-			continue
-		}
+	return m, nil
+}
 
-		// Write response body to the file
-		_, err = io.Copy(targetFile, resp.Body)
-		if err != nil {
-			results <- fmt.Errorf("error while downloading %s: %v", targetFile.Name(), err)
-			continue
-		}
+// Save writes the manifest to the output directory, it's safe to call
+// from several download workers
+func (m *downloadManifest) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, err := jsoniter.ConfigDefault.MarshalIndent(m, "", "  ")
 
-		results <- targetFile
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so manifest is never left
+	// half-written
+	tmpPath := m.path + ".tmp"
+
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return fmt.Errorf("cannot write download manifest: %v", err)
 	}
 
+	return os.Rename(tmpPath, m.path)
 }
 
-func downloadAllFiles(fileURLs []string, numWorkers uint, targetDir string) ([]*os.File, error) {
-	jobs := make(chan string, len(fileURLs))
-	results := make(chan interface{}, len(fileURLs))
-	files := make([]*os.File, 0)
+// SetFiles adds entries for the exported files. Files are named
+// <Type>.<n>.ndjson, errors go into "errors" and deleted resources
+// into "deleted" subdirectory.
+func (m *downloadManifest) SetFiles(outputs []bulkOutput) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	var wg sync.WaitGroup
+	m.Files = make([]*manifestFileEntry, 0, len(outputs))
+	counters := make(map[string]int)
 
-	// Start workers
-	for i := uint(0); i < numWorkers; i++ {
-		wg.Add(1)
-		go startDlWorker(jobs, results, targetDir, &wg)
-	}
+	for _, output := range outputs {
+		rt := output.Type
 
-	// Send jobs to the channel
-	for _, url := range fileURLs {
-		jobs <- url
-	}
-	close(jobs) // Close jobs channel to signal workers no more jobs
+		if rt == "" {
+			rt = "output"
+		}
 
-	// Wait for all workers to finish
-	go func() {
-		wg.Wait()
-		close(results) // Close results channel once all workers are done
-	}()
+		dir := ""
 
-	// Collect results
-	for res := range results {
-		switch r := res.(type) {
-		case error:
-			fmt.Printf("Got an error while downloading file: %s\n", r.Error())
-		case *os.File:
-			files = append(files, r)
-		default:
-			fmt.Printf("Got result of unknown type: %v\n", r)
+		switch output.Kind {
+		case bulkErrorKind:
+			dir = bulkErrorsDir
+		case bulkDeletedKind:
+			dir = bulkDeletedDir
 		}
+
+		key := path.Join(dir, rt)
+		counters[key]++
+
+		m.Files = append(m.Files, &manifestFileEntry{
+			URL:                 output.URL,
+			Kind:                output.Kind,
+			Type:                output.Type,
+			Count:               output.Count,
+			RequiresAccessToken: output.RequiresAccessToken,
+			File:                path.Join(dir, fmt.Sprintf("%s.%d.ndjson", rt, counters[key])),
+			Status:              downloadPending,
+		})
 	}
+}
 
-	fmt.Printf("Finished downloading, got %d files\n", len(files))
-	return files, nil
+// Update changes an entry under the lock
+func (m *downloadManifest) Update(entry *manifestFileEntry, fn func(entry *manifestFileEntry)) {
+	m.mu.Lock()
+	fn(entry)
+	m.mu.Unlock()
 }
 
-func getBulkData(url string, numWorkers uint, acceptHdr string, targetDir string) ([]*os.File, error) {
-	client := &http.Client{}
+// countLines returns number of lines in the file, the last line
+// doesn't have to end with a newline
+func countLines(fileName string) (int64, error) {
+	f, err := os.Open(fileName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, 64*1024)
+	lines := int64(0)
+	last := byte('\n')
 
-	if strings.Contains(url, "$export-poll-status") {
-		fileURLs, err := getBulkDataFiles(url, client)
+	for {
+		n, err := f.Read(buf)
+
+		if n > 0 {
+			lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+		}
+
+		if err == io.EOF {
+			break
+		}
 
 		if err != nil {
-			return nil, fmt.Errorf("error while getting files from Bulk Data API server: %v", err)
+			return 0, err
 		}
+	}
+
+	if last != '\n' {
+		lines++
+	}
 
-		return downloadAllFiles(fileURLs, numWorkers, targetDir)
+	return lines, nil
+}
+
+// downloadError is returned by downloadAttempt, retry tells whether
+// another attempt makes sense
+type downloadError struct {
+	err   error
+	retry bool
+}
+
+func (e *downloadError) Error() string {
+	return e.err.Error()
+}
+
+// downloadAttempt downloads url into targetPath. If the file already
+// has some data, the download continues from where it stopped with
+// HTTP Range request. Servers not supporting ranges will just send the
+// whole file again.
+func downloadAttempt(ctx context.Context, client *http.Client, url string, targetPath string) error {
+	var offset int64
+
+	if fi, err := os.Stat(targetPath); err == nil {
+		offset = fi.Size()
 	}
-	req, err := http.NewRequest("GET", url, nil)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 
 	if err != nil {
-		return nil, fmt.Errorf("error while creating request to Bulk Data API server: %v", err)
+		return &downloadError{err: fmt.Errorf("cannot create request: %v", err)}
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
 	}
 
-	// add headers for async response
-	req.Header.Add("Prefer", "respond-async")
-	req.Header.Add("Accept", acceptHdr)
 	resp, err := client.Do(req)
 
 	if err != nil {
-		return nil, fmt.Errorf("error while pinging Bulk Data API server: %v", err)
+		return &downloadError{err: fmt.Errorf("cannot download %s: %v", url, err), retry: true}
 	}
 
 	defer resp.Body.Close()
 
-	// check if we got 20x response
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+	flags := os.O_WRONLY | os.O_CREATE
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the file is already downloaded completely
+		return nil
+	default:
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("expected 20x response, got %d; response body is: %s", resp.StatusCode, respBody)
-	}
-
-	pingURL := resp.Header.Get("Content-Location")
 
-	if len(pingURL) == 0 {
-		return nil, fmt.Errorf("No Content-Location header was returned by Bulk Data API server")
+		return &downloadError{
+			err:   fmt.Errorf("got %d response while downloading %s: %s", resp.StatusCode, url, respBody),
+			retry: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+		}
 	}
 
-	fileURLs, err := getBulkDataFiles(pingURL, client)
+	targetFile, err := os.OpenFile(targetPath, flags, 0644)
 
 	if err != nil {
-		return nil, fmt.Errorf("error while getting files from Bulk Data API server: %v", err)
+		return &downloadError{err: fmt.Errorf("cannot create file: %v", err)}
 	}
 
-	return downloadAllFiles(fileURLs, numWorkers, targetDir)
-}
-
-// BulkGetCommand loads data from Bulk Data Endpoint and saves it to local filesystem
-func BulkGetCommand(ctx context.Context, args []string) error {
-
-	numWorkers := uint(viper.GetInt("numdl"))
-	acceptHdr := viper.GetString("accept-header")
-	bulkURL := args[0]
-	destPath := args[1]
+	defer targetFile.Close()
 
-	// Ensure the destination directory exists before downloading files
-	err := ensureDirectoryExists(destPath)
+	written, err := io.Copy(targetFile, resp.Body)
 
 	if err != nil {
-		return err
+		return &downloadError{err: fmt.Errorf("error while downloading %s: %v", targetPath, err), retry: true}
 	}
 
-	fileHndlrs, err := getBulkData(bulkURL, numWorkers, acceptHdr, destPath)
-
-	if err != nil {
-		return err
+	// Content-Length is unknown for compressed responses
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return &downloadError{
+			err:   fmt.Errorf("server closed connection after %d of %d bytes of %s", written, resp.ContentLength, url),
+			retry: true,
+		}
 	}
 
-	for _, f := range fileHndlrs {
-		fn := f.Name()
-		fbn := path.Base(fn)
+	return nil
+}
+
+// retryDownload calls attempt until it succeeds or fails with an error
+// which isn't worth retrying, waiting with exponential backoff between
+// attempts
+func retryDownload(ctx context.Context, name string, retries int, attempt func() error) error {
+	var err error
+
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			delay := time.Duration(math.Min(math.Pow(2, float64(i-1)), 60)) * time.Second
+			fmt.Printf("Retrying %s in %s: %v\n", name, delay, err)
+
+			if err := sleepContext(ctx, delay); err != nil {
+				return err
+			}
+		}
+
+		err = attempt()
+
+		if dlErr, ok := err.(*downloadError); ok && dlErr.retry && ctx.Err() == nil {
+			continue
+		}
+
+		break
+	}
+
+	return err
+}
+
+// completeEntry marks manifest entry as downloaded
+func completeEntry(manifest *downloadManifest, entry *manifestFileEntry, size int64, lines int64) {
+	if entry.Count > 0 && entry.Count != lines {
+		fmt.Printf("Warning: server reported %d resources in %s, but got %d lines\n", entry.Count, entry.File, lines)
+	}
+
+	manifest.Update(entry, func(e *manifestFileEntry) {
+		e.Status = downloadComplete
+		e.Error = ""
+		e.Bytes = size
+		e.Lines = lines
+	})
+}
+
+func failEntry(manifest *downloadManifest, entry *manifestFileEntry, err error) {
+	manifest.Update(entry, func(e *manifestFileEntry) {
+		e.Status = downloadFailed
+		e.Error = err.Error()
+	})
+}
+
+// downloadFile downloads a file from the manifest, retrying with
+// exponential backoff
+func downloadFile(ctx context.Context, client *http.Client, manifest *downloadManifest, entry *manifestFileEntry, targetDir string, retries int) error {
+	targetPath := path.Join(targetDir, entry.File)
+	err := ensureDirectoryExists(path.Dir(targetPath))
+
+	if err != nil {
+		return err
+	}
+
+	err = retryDownload(ctx, entry.File, retries, func() error {
+		return downloadAttempt(ctx, client, entry.URL, targetPath)
+	})
+
+	if err != nil {
+		failEntry(manifest, entry, err)
+		return err
+	}
+
+	fi, err := os.Stat(targetPath)
+
+	if err != nil {
+		return err
+	}
+
+	lines, err := countLines(targetPath)
+
+	if err != nil {
+		return err
+	}
+
+	completeEntry(manifest, entry, fi.Size(), lines)
+
+	return nil
+}
+
+// countingReader counts bytes and lines read from a streamed response
+// body and remembers read errors
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	lines int64
+	last  byte
+	err   error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+
+	if n > 0 {
+		c.n += int64(n)
+		c.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+		c.last = p[n-1]
+	}
+
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+
+	return n, err
+}
+
+// Lines returns number of lines read so far, the last line doesn't
+// have to end with a newline
+func (c *countingReader) Lines() int64 {
+	if c.n > 0 && c.last != '\n' {
+		return c.lines + 1
+	}
+
+	return c.lines
+}
+
+// streamAttempt passes response body of url to onStream. Gzipped
+// bodies are decompressed, even if server didn't set Content-Encoding.
+func streamAttempt(ctx context.Context, client *http.Client, entry *manifestFileEntry, onStream func(entry *manifestFileEntry, body io.Reader) error) (*countingReader, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", entry.URL, nil)
+
+	if err != nil {
+		return nil, &downloadError{err: fmt.Errorf("cannot create request: %v", err)}
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, &downloadError{err: fmt.Errorf("cannot download %s: %v", entry.URL, err), retry: true}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+
+		return nil, &downloadError{
+			err:   fmt.Errorf("got %d response while downloading %s: %s", resp.StatusCode, entry.URL, respBody),
+			retry: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+		}
+	}
+
+	br := bufio.NewReader(resp.Body)
+	var rdr io.Reader = br
+
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzr, err := gzip.NewReader(br)
+
+		if err != nil {
+			return nil, &downloadError{err: fmt.Errorf("cannot decompress %s: %v", entry.URL, err), retry: true}
+		}
+
+		defer gzr.Close()
+		rdr = gzr
+	}
+
+	body := &countingReader{r: rdr}
+	err = onStream(entry, body)
+
+	if err != nil {
+		// connection failures are worth retrying, the file is
+		// streamed again from the start
+		return body, &downloadError{err: err, retry: body.err != nil}
+	}
+
+	return body, nil
+}
+
+// streamFile streams a file from the manifest, retrying with
+// exponential backoff
+func streamFile(ctx context.Context, client *http.Client, manifest *downloadManifest, entry *manifestFileEntry, retries int, onStream func(entry *manifestFileEntry, body io.Reader) error) error {
+	var body *countingReader
+
+	err := retryDownload(ctx, entry.File, retries, func() error {
+		var err error
+		body, err = streamAttempt(ctx, client, entry, onStream)
+
+		return err
+	})
+
+	if err != nil {
+		failEntry(manifest, entry, err)
+		return err
+	}
+
+	completeEntry(manifest, entry, body.n, body.Lines())
+
+	return nil
+}
+
+// bulkDownload holds settings of Bulk Data export download
+type bulkDownload struct {
+	numWorkers uint
+	acceptHdr  string
+	targetDir  string
+	resume     bool
+	retries    int
+
+	// resumable is set when the download can be resumed later with
+	// "--resume" flag, so the export isn't cancelled on the server when
+	// the download is interrupted
+	resumable bool
+
+	// onFile is called with the path of every downloaded file with
+	// resources or deleted resources as soon as it's downloaded, while
+	// other files are still being downloaded
+	onFile func(fileName string) error
+
+	// onStream receives response bodies of files with resources
+	// instead of saving them to targetDir if set. It's called
+	// concurrently from download workers and gets whole file again if
+	// the download is retried.
+	onStream func(entry *manifestFileEntry, body io.Reader) error
+}
+
+// streams tells if entry is passed to onStream instead of being saved
+func (dl *bulkDownload) streams(entry *manifestFileEntry) bool {
+	return dl.onStream != nil && (entry.Kind == bulkOutputKind || entry.Kind == "")
+}
+
+func startDlWorker(ctx context.Context, client *http.Client, manifest *downloadManifest, dl *bulkDownload, jobs chan *manifestFileEntry, results chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done() // Signal when the worker is done
+
+	for entry := range jobs {
+		// interrupted download leaves the rest of the files pending
+		if ctx.Err() != nil {
+			return
+		}
+
+		var err error
+		fileCtx := ctx
+
+		if entry.RequiresAccessToken {
+			fileCtx = withAccessToken(ctx)
+		}
+
+		if dl.streams(entry) {
+			err = streamFile(fileCtx, client, manifest, entry, dl.retries, dl.onStream)
+		} else {
+			err = downloadFile(fileCtx, client, manifest, entry, dl.targetDir, dl.retries)
+		}
+
+		if saveErr := manifest.Save(); saveErr != nil {
+			fmt.Printf("Cannot save download manifest: %v\n", saveErr)
+		}
+
+		if err != nil {
+			results <- fmt.Errorf("cannot download %s: %v", entry.URL, err)
+			continue
+		}
+
+		results <- entry
+	}
+}
+
+// downloadAllFiles downloads files from the manifest which aren't
+// complete yet and returns paths of all complete files with resources
+// and deleted resources. Errors reported by the server are summarized
+// but not returned.
+func downloadAllFiles(ctx context.Context, client *http.Client, manifest *downloadManifest, dl *bulkDownload) ([]string, error) {
+	jobs := make(chan *manifestFileEntry, len(manifest.Files))
+	results := make(chan interface{}, len(manifest.Files))
+	files := make([]string, 0)
+	failed := 0
+	skipped := 0
+	streamed := 0
+	var onFileErr error
+
+	addFile := func(entry *manifestFileEntry) {
+		if entry.Kind == bulkErrorKind {
+			return
+		}
+
+		if dl.streams(entry) {
+			streamed++
+			return
+		}
+
+		fileName := path.Join(dl.targetDir, entry.File)
+		files = append(files, fileName)
+
+		if dl.onFile != nil && onFileErr == nil {
+			onFileErr = dl.onFile(fileName)
+		}
+	}
+
+	for _, entry := range manifest.Files {
+		if entry.Status == downloadComplete {
+			skipped++
+			addFile(entry)
+			continue
+		}
+
+		if !dl.resume {
+			// leftovers from previous downloads shouldn't be resumed
+			os.Remove(path.Join(dl.targetDir, entry.File))
+		}
+
+		jobs <- entry
+	}
+	close(jobs) // Close jobs channel to signal workers no more jobs
+
+	if skipped > 0 {
+		fmt.Printf("Skipping %d already downloaded files\n", skipped)
+	}
+
+	var wg sync.WaitGroup
+
+	// Start workers
+	for i := uint(0); i < dl.numWorkers; i++ {
+		wg.Add(1)
+		go startDlWorker(ctx, client, manifest, dl, jobs, results, &wg)
+	}
+
+	// Wait for all workers to finish
+	go func() {
+		wg.Wait()
+		close(results) // Close results channel once all workers are done
+	}()
+
+	// Collect results
+	for res := range results {
+		switch r := res.(type) {
+		case error:
+			failed++
+			fmt.Printf("Got an error while downloading file: %s\n", r.Error())
+		case *manifestFileEntry:
+			addFile(r)
+		default:
+			fmt.Printf("Got result of unknown type: %v\n", r)
+		}
+	}
+
+	if streamed > 0 {
+		fmt.Printf("Finished downloading, streamed %d files and got %d files\n", streamed, len(files))
+	} else {
+		fmt.Printf("Finished downloading, got %d files\n", len(files))
+	}
+
+	printExportErrors(manifest, dl.targetDir)
+
+	if ctx.Err() != nil {
+		return files, ctx.Err()
+	}
+
+	if onFileErr != nil {
+		return files, onFileErr
+	}
+
+	if failed > 0 {
+		return files, fmt.Errorf("%d files failed to download, run bulkget with --resume flag to retry", failed)
+	}
+
+	return files, nil
+}
+
+// printExportErrors prints summary of OperationOutcomes from the
+// downloaded error files
+func printExportErrors(manifest *downloadManifest, targetDir string) {
+	errorFiles := make([]string, 0)
+
+	for _, entry := range manifest.Files {
+		if entry.Kind == bulkErrorKind && entry.Status == downloadComplete {
+			errorFiles = append(errorFiles, path.Join(targetDir, entry.File))
+		}
+	}
+
+	if len(errorFiles) == 0 {
+		return
+	}
+
+	bndl, err := newMultifileBundle(errorFiles)
+
+	if err != nil {
+		fmt.Printf("Cannot read export errors: %v\n", err)
+		return
+	}
+
+	defer bndl.Close()
+
+	const maxMessages = 10
+	counts := make(map[string]int)
+	messages := make([]string, 0, maxMessages)
+	total := 0
+
+	for {
+		res, err := bndl.Next()
+
+		if err != nil {
+			break
+		}
+
+		issues, _ := res["issue"].([]interface{})
+
+		for _, i := range issues {
+			issue, ok := i.(map[string]interface{})
+
+			if !ok {
+				continue
+			}
+
+			severity, _ := issue["severity"].(string)
+			counts[severity]++
+			total++
+
+			if len(messages) < maxMessages {
+				msg, _ := issue["diagnostics"].(string)
+
+				if details, ok := issue["details"].(map[string]interface{}); ok && msg == "" {
+					msg, _ = details["text"].(string)
+				}
+
+				if msg == "" {
+					msg, _ = issue["code"].(string)
+				}
+
+				messages = append(messages, fmt.Sprintf("  %s: %s", severity, msg))
+			}
+		}
+	}
+
+	fmt.Printf("Server reported %d issues during export (see %s directory):", total, path.Join(targetDir, bulkErrorsDir))
+
+	for severity, cnt := range counts {
+		fmt.Printf(" %s: %d", severity, cnt)
+	}
 
-		err := os.Rename(f.Name(), path.Join(destPath, fbn))
+	fmt.Println("")
+
+	for _, msg := range messages {
+		fmt.Println(msg)
+	}
+
+	if total > len(messages) {
+		fmt.Printf("  ... and %d more\n", total-len(messages))
+	}
+}
+
+// getBulkData performs Bulk Data export and downloads its files, see
+// downloadAllFiles
+func getBulkData(ctx context.Context, url string, dl *bulkDownload) ([]string, error) {
+	targetDir := dl.targetDir
+	resume := dl.resume
+
+	var manifest *downloadManifest
+
+	if resume {
+		var err error
+		manifest, err = readDownloadManifest(targetDir)
 
 		if err != nil {
-			fmt.Printf("Error moving %s to %s: %v", f.Name(), path.Join(destPath, fbn), err)
+			return nil, err
+		}
+
+		if url == "" {
+			url = manifest.KickoffURL
+		}
+	} else {
+		manifest = newDownloadManifest(targetDir)
+		manifest.KickoffURL = url
+	}
+
+	if url == "" {
+		url = manifest.StatusURL
+	}
+
+	if url == "" {
+		return nil, fmt.Errorf("download manifest in %s has neither kick-off nor status URL", targetDir)
+	}
+
+	client, err := newFHIRClient(ctx, url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Files) > 0 {
+		return downloadFilesOrCancel(ctx, client, manifest, dl)
+	}
+
+	pingURL := manifest.StatusURL
+
+	if pingURL == "" && strings.Contains(url, "$export-poll-status") {
+		pingURL = url
+	}
+
+	if pingURL == "" {
+		req, err := newKickoffRequest(ctx, url, dl.acceptHdr)
+
+		if err != nil {
+			return nil, fmt.Errorf("error while creating request to Bulk Data API server: %v", err)
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			return nil, fmt.Errorf("error while pinging Bulk Data API server: %v", err)
+		}
+
+		defer resp.Body.Close()
+
+		// check if we got 20x response
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			respBody, _ := io.ReadAll(resp.Body)
+			return nil, fmt.Errorf("expected 20x response, got %d; response body is: %s", resp.StatusCode, respBody)
+		}
+
+		pingURL = resp.Header.Get("Content-Location")
+
+		if len(pingURL) == 0 {
+			return nil, fmt.Errorf("No Content-Location header was returned by Bulk Data API server")
 		}
 	}
 
+	// remember status URL so an interrupted export can be resumed
+	manifest.StatusURL = pingURL
+
+	if err := manifest.Save(); err != nil {
+		return nil, err
+	}
+
+	outputs, err := getBulkDataFiles(ctx, pingURL, client)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			// export is abandoned, the server can stop working on it
+			cancelInterruptedExport(client, manifest)
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("error while getting files from Bulk Data API server: %v", err)
+	}
+
+	manifest.SetFiles(outputs)
+
+	if err := manifest.Save(); err != nil {
+		return nil, err
+	}
+
+	return downloadFilesOrCancel(ctx, client, manifest, dl)
+}
+
+// downloadFilesOrCancel downloads files of the finished export. If the
+// download is interrupted and can't be resumed later, the export is
+// cancelled on the server.
+func downloadFilesOrCancel(ctx context.Context, client *http.Client, manifest *downloadManifest, dl *bulkDownload) ([]string, error) {
+	files, err := downloadAllFiles(ctx, client, manifest, dl)
+
+	if ctx.Err() != nil {
+		if dl.resumable {
+			fmt.Printf("Download interrupted, run bulkget with --resume flag to continue\n")
+		} else {
+			cancelInterruptedExport(client, manifest)
+		}
+	}
+
+	return files, err
+}
+
+// cancelInterruptedExport sends DELETE to the status URL of the export
+// after the command was interrupted
+func cancelInterruptedExport(client *http.Client, manifest *downloadManifest) {
+	if manifest.StatusURL == "" {
+		return
+	}
+
+	// the command's context is already cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := cancelBulkExport(ctx, client, manifest.StatusURL); err != nil {
+		fmt.Printf("Cannot cancel export on the server: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Export was cancelled on the server\n")
+
+	manifest.StatusURL = ""
+
+	if err := manifest.Save(); err != nil {
+		fmt.Printf("Cannot save download manifest: %v\n", err)
+	}
+}
+
+// cancelBulkExport asks the server to cancel the export or to delete
+// its files, as described in Bulk Data spec
+func cancelBulkExport(ctx context.Context, client *http.Client, statusURL string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", statusURL, nil)
+
+	if err != nil {
+		return fmt.Errorf("error while creating HTTP request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("error while sending DELETE request: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("expected 202 response, got %d; response body is: %s", resp.StatusCode, respBody)
+	}
+
 	return nil
+}
+
+// sleepContext sleeps for the given duration or until the context is
+// cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// BulkGetCommand loads data from Bulk Data Endpoint and saves it to local filesystem
+func BulkGetCommand(ctx context.Context, args []string) error {
+
+	numWorkers := uint(viper.GetInt("numdl"))
+	acceptHdr := viper.GetString("accept-header")
+	resume := viper.GetBool("resume")
+	if statusURL := viper.GetString("cancel"); statusURL != "" {
+		client, err := newFHIRClient(ctx, statusURL)
+
+		if err != nil {
+			return err
+		}
+
+		if err := cancelBulkExport(ctx, client, statusURL); err != nil {
+			return err
+		}
+
+		fmt.Println("Export was cancelled")
+
+		return nil
+	}
+
+	bulkURL := ""
+	destPath := args[len(args)-1]
+
+	if len(args) > 1 {
+		bulkURL = args[0]
+	}
+
+	// Ensure the destination directory exists before downloading files
+	err := ensureDirectoryExists(destPath)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = getBulkData(ctx, bulkURL, &bulkDownload{
+		numWorkers: numWorkers,
+		acceptHdr:  acceptHdr,
+		targetDir:  destPath,
+		resume:     resume,
+		retries:    viper.GetInt("retries"),
+		resumable:  true,
+	})
 
+	return err
 }
@@ -0,0 +1,772 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"soon", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"0", 0, true},
+		{"-3", 0, true},
+		{"Wed, 01 Jan 2020 12:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 01 Jan 2020 11:00:00 GMT", 0, true},
+	}
+
+	for _, tt := range tests {
+		delay, ok := parseRetryAfter(tt.value, now)
+
+		if delay != tt.delay || ok != tt.ok {
+			t.Errorf("%q: got %v %v, want %v %v", tt.value, delay, ok, tt.delay, tt.ok)
+		}
+	}
+}
+
+func TestGetBulkDataFilesRetryAfterZero(t *testing.T) {
+	var mu sync.Mutex
+	var polls []time.Time
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls = append(polls, time.Now())
+		n := len(polls)
+		mu.Unlock()
+
+		if n < 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		w.Write([]byte(`{"transactionTime": "2020-01-01T00:00:00Z", "output": [{"type": "Patient", "url": "http://example.org/Patient.ndjson"}]}`))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	outputs, err := getBulkDataFiles(ctx, server.URL, server.Client())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outputs) != 1 || outputs[0].Type != "Patient" {
+		t.Errorf("unexpected outputs %+v", outputs)
+	}
+
+	if d := polls[1].Sub(polls[0]); d < 2*time.Second {
+		t.Errorf("polled again after %s despite minimal delay", d)
+	}
+}
+
+func TestGetBulkDataFilesStatus(t *testing.T) {
+	setConfig(t, map[string]interface{}{"poll-timeout": time.Minute})
+	retryAt := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		status  int
+		headers map[string]string
+		err     string
+	}{
+		// waiting longer than --poll-timeout fails right away
+		{http.StatusAccepted, map[string]string{"X-Progress": "Patient: 50%", "Retry-After": "120"}, "(Patient: 50%), use --poll-timeout"},
+		{http.StatusAccepted, map[string]string{"Retry-After": retryAt}, "(in progress), use --poll-timeout"},
+		{http.StatusServiceUnavailable, map[string]string{"Retry-After": "120"}, "(server responded with 503)"},
+		{http.StatusTooManyRequests, map[string]string{"Retry-After": "120"}, "(server responded with 429)"},
+		{http.StatusNotFound, nil, "expected 202 response, got 404"},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range tt.headers {
+				w.Header().Set(k, v)
+			}
+
+			w.WriteHeader(tt.status)
+		}))
+
+		startTime := time.Now()
+		_, err := getBulkDataFiles(context.Background(), server.URL, server.Client())
+		server.Close()
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%d %v: got error %v, want %q", tt.status, tt.headers, err, tt.err)
+		}
+
+		if d := time.Since(startTime); d > time.Second {
+			t.Errorf("%d %v: polling took %s", tt.status, tt.headers, d)
+		}
+	}
+}
+
+func TestGetBulkDataFilesTransientError(t *testing.T) {
+	var polls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&polls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Write([]byte(`{"transactionTime": "2020-01-01T00:00:00Z", "output": [{"type": "Patient", "url": "http://example.org/Patient.ndjson"}]}`))
+	}))
+	defer server.Close()
+
+	outputs, err := getBulkDataFiles(context.Background(), server.URL, server.Client())
+
+	if err != nil || len(outputs) != 1 || polls != 2 {
+		t.Errorf("got %+v, %v after %d polls", outputs, err, polls)
+	}
+}
+
+func TestGetBulkDataFilesCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := getBulkDataFiles(ctx, server.URL, server.Client()); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// setConfig sets config values for the duration of the test
+func setConfig(t *testing.T, values map[string]interface{}) {
+	t.Helper()
+
+	for k, v := range values {
+		viper.Set(k, v)
+	}
+
+	t.Cleanup(func() {
+		for k := range values {
+			viper.Set(k, nil)
+		}
+	})
+}
+
+func TestExportKickoffURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		level  string
+		group  string
+		result string
+	}{
+		{"https://fhir.test/r4/", "", "", "https://fhir.test/r4/$export"},
+		{"https://fhir.test/r4", "system", "", "https://fhir.test/r4/$export"},
+		{"https://fhir.test/r4", "patient", "", "https://fhir.test/r4/Patient/$export"},
+		{"https://fhir.test/r4", "group", "g 1", "https://fhir.test/r4/Group/g%201/$export"},
+		{"https://fhir.test/r4/Group/g-2/$export", "patient", "", "https://fhir.test/r4/Group/g-2/$export"},
+	}
+
+	for _, tt := range tests {
+		setConfig(t, map[string]interface{}{"level": tt.level, "group": tt.group})
+
+		if result, err := exportKickoffURL(tt.url); err != nil || result != tt.result {
+			t.Errorf("%s %s: got %s, %v, want %s", tt.url, tt.level, result, err, tt.result)
+		}
+	}
+
+	for _, level := range []string{"group", "encounter"} {
+		setConfig(t, map[string]interface{}{"level": level, "group": ""})
+
+		if _, err := exportKickoffURL("https://fhir.test/r4"); err == nil {
+			t.Errorf("%s: expected error", level)
+		}
+	}
+}
+
+func TestKickoffRequestGET(t *testing.T) {
+	setConfig(t, map[string]interface{}{
+		"type":        []string{"Patient", "Observation"},
+		"since":       "2024-01-01T00:00:00Z",
+		"type-filter": []string{"Patient?active=true", "Observation?status=final"},
+		"elements":    []string{"id", "code"},
+	})
+
+	req, err := newKickoffRequest(context.Background(), "https://fhir.test/r4/$export", "application/fhir+json")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := req.URL.Query()
+
+	if req.Method != "GET" || query.Get("_type") != "Patient,Observation" || query.Get("_since") != "2024-01-01T00:00:00Z" || query.Get("_elements") != "id,code" {
+		t.Errorf("wrong kick-off request %s %s", req.Method, req.URL)
+	}
+
+	if filters := query["_typeFilter"]; len(filters) != 2 || filters[1] != "Observation?status=final" {
+		t.Errorf("every type filter should be a separate parameter, got %q", filters)
+	}
+
+	if req.Header.Get("Prefer") != "respond-async" || req.Header.Get("Accept") != "application/fhir+json" {
+		t.Errorf("wrong kick-off headers %v", req.Header)
+	}
+}
+
+func TestKickoffRequestPOST(t *testing.T) {
+	setConfig(t, map[string]interface{}{
+		"type":    []string{"Patient"},
+		"patient": []string{"Patient/pt-1", "Patient/pt-2"},
+	})
+
+	req, err := newKickoffRequest(context.Background(), "https://fhir.test/r4/Group/g-1/$export", "application/fhir+json")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Method != "POST" || req.URL.RawQuery != "" || req.Header.Get("Content-Type") != "application/fhir+json" {
+		t.Fatalf("patient parameter should be sent with POST, got %s %s", req.Method, req.URL)
+	}
+
+	var body map[string]interface{}
+	content, _ := io.ReadAll(req.Body)
+
+	if err := jsoniter.Unmarshal(content, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"resourceType": "Parameters",
+		"parameter": []interface{}{
+			map[string]interface{}{"name": "_type", "valueString": "Patient"},
+			map[string]interface{}{"name": "patient", "valueReference": map[string]interface{}{"reference": "Patient/pt-1"}},
+			map[string]interface{}{"name": "patient", "valueReference": map[string]interface{}{"reference": "Patient/pt-2"}},
+		},
+	}
+
+	if !reflect.DeepEqual(body, expected) {
+		t.Errorf("got %v, want %v", body, expected)
+	}
+}
+
+func TestKickoffRequestInvalidSince(t *testing.T) {
+	setConfig(t, map[string]interface{}{"since": "2024-01-01"})
+
+	if _, err := newKickoffRequest(context.Background(), "https://fhir.test/r4", "application/fhir+json"); err == nil {
+		t.Error("expected error for --since without time")
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	dir := t.TempDir()
+
+	for content, expected := range map[string]int64{"": 0, "{}\n": 1, "{}\n{}\n": 2, "{}\n{}": 2} {
+		fileName := filepath.Join(dir, "file.ndjson")
+		os.WriteFile(fileName, []byte(content), 0644)
+
+		if lines, err := countLines(fileName); err != nil || lines != expected {
+			t.Errorf("%q: got %d lines, %v, want %d", content, lines, err, expected)
+		}
+	}
+}
+
+func TestDownloadManifest(t *testing.T) {
+	dir := t.TempDir()
+	m := newDownloadManifest(dir)
+	m.KickoffURL = "https://fhir.test/$export"
+	m.StatusURL = "https://fhir.test/status/1"
+	m.SetFiles([]bulkOutput{{Kind: bulkOutputKind, Type: "Patient", URL: "https://fhir.test/1", Count: 10}})
+	m.Update(m.Files[0], func(e *manifestFileEntry) { e.Status = downloadComplete })
+
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := readDownloadManifest(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.StatusURL != m.StatusURL || len(saved.Files) != 1 || *saved.Files[0] != *m.Files[0] {
+		t.Errorf("got %+v, want %+v", saved, m)
+	}
+
+	if _, err := readDownloadManifest(t.TempDir()); err == nil {
+		t.Error("expected error for directory without manifest")
+	}
+}
+
+func TestDownloadAttemptResume(t *testing.T) {
+	content := []byte("{\"id\": \"1\"}\n{\"id\": \"2\"}\n{\"id\": \"3\"}\n")
+	var ranges []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "Patient.ndjson", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	targetPath := filepath.Join(t.TempDir(), "Patient.1.ndjson")
+	os.WriteFile(targetPath, content[:10], 0644)
+
+	if err := downloadAttempt(context.Background(), server.Client(), server.URL, targetPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if downloaded, _ := os.ReadFile(targetPath); !bytes.Equal(downloaded, content) {
+		t.Errorf("got %q, want %q", downloaded, content)
+	}
+
+	// the file is complete already, so server responds with 416
+	if err := downloadAttempt(context.Background(), server.Client(), server.URL, targetPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"bytes=10-", fmt.Sprintf("bytes=%d-", len(content))}; !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("got Range headers %q, want %q", ranges, expected)
+	}
+}
+
+func TestDownloadFileRetries(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case requests == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("{}\n{}\n"))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	m := newDownloadManifest(dir)
+	m.SetFiles([]bulkOutput{
+		{Kind: bulkOutputKind, Type: "Patient", URL: server.URL + "/Patient", Count: 2},
+		{Kind: bulkOutputKind, Type: "Patient", URL: server.URL + "/missing"},
+	})
+
+	if err := downloadFile(context.Background(), server.Client(), m, m.Files[0], dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := m.Files[0]; e.Status != downloadComplete || e.Lines != 2 || e.Bytes != 6 || requests != 2 {
+		t.Errorf("got entry %+v after %d requests", e, requests)
+	}
+
+	// client errors aren't retried
+	requests = 0
+
+	if err := downloadFile(context.Background(), server.Client(), m, m.Files[1], dir, 2); err == nil || requests != 1 {
+		t.Errorf("got %v after %d requests, want error after 1 request", err, requests)
+	}
+
+	if e := m.Files[1]; e.Status != downloadFailed || e.Error == "" {
+		t.Errorf("failed download should be recorded in the manifest, got %+v", e)
+	}
+}
+
+func TestDownloadAllFilesResume(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("{}\n"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	m := newDownloadManifest(dir)
+	m.SetFiles([]bulkOutput{
+		{Kind: bulkOutputKind, Type: "Patient", URL: server.URL + "/1"},
+		{Kind: bulkOutputKind, Type: "Patient", URL: server.URL + "/2"},
+	})
+	m.Files[0].Status = downloadComplete
+	os.WriteFile(filepath.Join(dir, m.Files[0].File), []byte("{}\n"), 0644)
+
+	dl := &bulkDownload{numWorkers: 2, targetDir: dir, resume: true}
+	files, err := downloadAllFiles(context.Background(), server.Client(), m, dl)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || requests != 1 {
+		t.Errorf("got %q after %d requests, want 2 files after 1 request", files, requests)
+	}
+
+	if saved, _ := readDownloadManifest(dir); saved == nil || saved.Files[1].Status != downloadComplete {
+		t.Error("manifest isn't updated after download")
+	}
+}
+
+func TestParseBulkManifest(t *testing.T) {
+	outputs, err := parseBulkManifest([]byte(`{
+		"transactionTime": "2024-01-01T00:00:00Z",
+		"output": [
+			{"type": "Patient", "url": "https://fhir.test/1", "count": 10},
+			{"type": "Patient", "url": "https://fhir.test/2"},
+			{"url": "https://fhir.test/3"}
+		],
+		"error": [{"type": "OperationOutcome", "url": "https://fhir.test/4"}],
+		"deleted": [{"type": "Bundle", "url": "https://fhir.test/5"}]
+	}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []bulkOutput{
+		{Kind: bulkOutputKind, Type: "Patient", URL: "https://fhir.test/1", Count: 10},
+		{Kind: bulkOutputKind, Type: "Patient", URL: "https://fhir.test/2"},
+		{Kind: bulkOutputKind, URL: "https://fhir.test/3"},
+		{Kind: bulkErrorKind, Type: "OperationOutcome", URL: "https://fhir.test/4"},
+		{Kind: bulkDeletedKind, Type: "Bundle", URL: "https://fhir.test/5"},
+	}
+
+	if !reflect.DeepEqual(outputs, expected) {
+		t.Fatalf("got %+v, want %+v", outputs, expected)
+	}
+
+	m := newDownloadManifest(t.TempDir())
+	m.SetFiles(outputs)
+	files := make([]string, 0, len(m.Files))
+
+	for _, e := range m.Files {
+		files = append(files, e.File)
+	}
+
+	expectedFiles := []string{"Patient.1.ndjson", "Patient.2.ndjson", "output.1.ndjson", "errors/OperationOutcome.1.ndjson", "deleted/Bundle.1.ndjson"}
+
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("got files %q, want %q", files, expectedFiles)
+	}
+}
+
+func TestParseBulkManifestInvalid(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"error": []}`,
+		`{"output": {}}`,
+		`{"output": [], "error": [{"type": "OperationOutcome"}]}`,
+		`{"output": ["https://fhir.test/1"]}`,
+	} {
+		if _, err := parseBulkManifest([]byte(body)); err == nil {
+			t.Errorf("%s: expected error", body)
+		}
+	}
+}
+
+func TestParseBulkManifestAccessToken(t *testing.T) {
+	outputs, err := parseBulkManifest([]byte(`{
+		"requiresAccessToken": true,
+		"output": [{"type": "Patient", "url": "https://storage.test/1"}],
+		"deleted": [{"type": "Bundle", "url": "https://storage.test/2"}]
+	}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDownloadManifest(t.TempDir())
+	m.SetFiles(outputs)
+
+	for _, e := range m.Files {
+		if !e.RequiresAccessToken {
+			t.Errorf("%s: requiresAccessToken is lost", e.URL)
+		}
+	}
+
+	// resumed downloads keep using credentials
+	m.Save()
+	saved, err := readDownloadManifest(filepath.Dir(m.path))
+
+	if err != nil || len(saved.Files) != 2 || !saved.Files[0].RequiresAccessToken {
+		t.Errorf("requiresAccessToken isn't saved: %+v, %v", saved, err)
+	}
+}
+
+// TestDownloadRequiresAccessToken downloads files from a storage on
+// another host than the FHIR server
+func TestDownloadRequiresAccessToken(t *testing.T) {
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" && r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path == "/public" && r.Header.Get("Authorization") != "" {
+			t.Error("credentials shouldn't be sent when files don't require them")
+		}
+
+		w.Write([]byte("{}\n"))
+	}))
+	defer storage.Close()
+
+	dir := t.TempDir()
+	m := newDownloadManifest(dir)
+	m.SetFiles([]bulkOutput{
+		{Kind: bulkOutputKind, Type: "Patient", URL: storage.URL + "/private", RequiresAccessToken: true},
+		{Kind: bulkOutputKind, Type: "Observation", URL: storage.URL + "/public"},
+	})
+
+	client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, auth: &bearerAuth{token: "secret"}, host: "fhir.test"}}
+	files, err := downloadAllFiles(context.Background(), client, m, &bulkDownload{numWorkers: 2, targetDir: dir})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Errorf("got files %q, want both", files)
+	}
+}
+
+func TestDownloadAllFilesKinds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.Write([]byte(`{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "processing", "diagnostics": "failed"}]}` + "\n"))
+			return
+		}
+
+		w.Write([]byte("{}\n"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	m := newDownloadManifest(dir)
+	m.SetFiles([]bulkOutput{
+		{Kind: bulkOutputKind, Type: "Patient", URL: server.URL + "/output"},
+		{Kind: bulkErrorKind, Type: "OperationOutcome", URL: server.URL + "/error"},
+		{Kind: bulkDeletedKind, Type: "Bundle", URL: server.URL + "/deleted"},
+	})
+
+	var onFile []string
+	dl := &bulkDownload{numWorkers: 1, targetDir: dir, onFile: func(fileName string) error {
+		onFile = append(onFile, fileName)
+		return nil
+	}}
+
+	files, err := downloadAllFiles(context.Background(), server.Client(), m, dl)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// errors are downloaded but not returned for loading
+	expected := []string{filepath.Join(dir, "Patient.1.ndjson"), filepath.Join(dir, "deleted", "Bundle.1.ndjson")}
+
+	if !reflect.DeepEqual(files, expected) || !reflect.DeepEqual(onFile, expected) {
+		t.Errorf("got files %q and onFile calls %q, want %q", files, onFile, expected)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "errors", "OperationOutcome.1.ndjson")); err != nil {
+		t.Errorf("error file isn't downloaded: %v", err)
+	}
+}
+
+func TestStreamFile(t *testing.T) {
+	content := "{\"id\": \"1\"}\n{\"id\": \"2\"}"
+	var gzipped bytes.Buffer
+	gzw := gzip.NewWriter(&gzipped)
+	gzw.Write([]byte(content))
+	gzw.Close()
+
+	// gzipped body without Content-Encoding, as some storages serve it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+ndjson")
+		w.Write(gzipped.Bytes())
+	}))
+	defer server.Close()
+
+	m := newDownloadManifest(t.TempDir())
+	m.SetFiles([]bulkOutput{{Kind: bulkOutputKind, Type: "Patient", URL: server.URL}})
+
+	var streamed []byte
+	err := streamFile(context.Background(), server.Client(), m, m.Files[0], 2, func(entry *manifestFileEntry, body io.Reader) error {
+		var err error
+		streamed, err = io.ReadAll(body)
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(streamed) != content {
+		t.Errorf("got %q, want %q", streamed, content)
+	}
+
+	if e := m.Files[0]; e.Status != downloadComplete || e.Lines != 2 || e.Bytes != int64(len(content)) {
+		t.Errorf("got entry %+v", e)
+	}
+}
+
+func TestStreamFileLoadError(t *testing.T) {
+	requests := int32(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("{}\n"))
+	}))
+	defer server.Close()
+
+	m := newDownloadManifest(t.TempDir())
+	m.SetFiles([]bulkOutput{{Kind: bulkOutputKind, Type: "Patient", URL: server.URL}})
+
+	// errors of loading aren't fixed by downloading the file again
+	err := streamFile(context.Background(), server.Client(), m, m.Files[0], 2, func(entry *manifestFileEntry, body io.Reader) error {
+		io.ReadAll(body)
+		return fmt.Errorf("cannot insert resource")
+	})
+
+	if err == nil || requests != 1 || m.Files[0].Status != downloadFailed {
+		t.Errorf("got %v after %d requests, entry %+v", err, requests, m.Files[0])
+	}
+}
+
+func TestBulkDownloadStreams(t *testing.T) {
+	dl := &bulkDownload{}
+	entry := &manifestFileEntry{Kind: bulkOutputKind}
+
+	if dl.streams(entry) {
+		t.Error("files shouldn't be streamed without onStream")
+	}
+
+	dl.onStream = func(entry *manifestFileEntry, body io.Reader) error { return nil }
+
+	for kind, expected := range map[string]bool{"": true, bulkOutputKind: true, bulkErrorKind: false, bulkDeletedKind: false} {
+		if dl.streams(&manifestFileEntry{Kind: kind}) != expected {
+			t.Errorf("%q: streams should be %v", kind, expected)
+		}
+	}
+}
+
+// exportServer is a Bulk Data server which never finishes the export
+// and records DELETE requests to the status URL
+func exportServer(t *testing.T, deletes *int32) *httptest.Server {
+	t.Helper()
+
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/$export":
+			w.Header().Set("Content-Location", server.URL+"/status/1")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == "DELETE":
+			atomic.AddInt32(deletes, 1)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Header().Set("X-Progress", "in progress")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestGetBulkDataCancel(t *testing.T) {
+	var deletes int32
+	server := exportServer(t, &deletes)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err := getBulkData(ctx, server.URL+"/$export", &bulkDownload{numWorkers: 1, targetDir: dir})
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context error", err)
+	}
+
+	if deletes != 1 {
+		t.Errorf("abandoned export should be cancelled on the server, got %d DELETE requests", deletes)
+	}
+
+	if m, _ := readDownloadManifest(dir); m == nil || m.StatusURL != "" {
+		t.Error("status URL of cancelled export should be removed from the manifest")
+	}
+}
+
+func TestDownloadFilesOrCancel(t *testing.T) {
+	for _, resumable := range []bool{false, true} {
+		var deletes int32
+		server := exportServer(t, &deletes)
+
+		m := newDownloadManifest(t.TempDir())
+		m.StatusURL = server.URL + "/status/1"
+		m.SetFiles([]bulkOutput{{Kind: bulkOutputKind, Type: "Patient", URL: server.URL + "/Patient"}})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		dl := &bulkDownload{numWorkers: 1, targetDir: t.TempDir(), resumable: resumable}
+
+		if _, err := downloadFilesOrCancel(ctx, server.Client(), m, dl); err != context.Canceled {
+			t.Errorf("resumable %v: got %v, want context error", resumable, err)
+		}
+
+		if expected := map[bool]int32{false: 1, true: 0}[resumable]; deletes != expected {
+			t.Errorf("resumable %v: got %d DELETE requests, want %d", resumable, deletes, expected)
+		}
+
+		if m.Files[0].Status != downloadPending {
+			t.Errorf("resumable %v: interrupted download should stay pending, got %s", resumable, m.Files[0].Status)
+		}
+	}
+}
+
+func TestCancelBulkExport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" || r.URL.Path != "/status/1" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	if err := cancelBulkExport(context.Background(), server.Client(), server.URL+"/status/1"); err != nil {
+		t.Error(err)
+	}
+
+	if err := cancelBulkExport(context.Background(), server.Client(), server.URL+"/status/2"); err == nil {
+		t.Error("expected error for unknown export")
+	}
+}
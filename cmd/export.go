@@ -0,0 +1,791 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+)
+
+// fhirBasePath is the path of FHIR API served by the web command
+const fhirBasePath = "/fhir"
+
+// exportStatusPath is the path of export status and output files. It's
+// outside of fhirBasePath, as "/fhir/_export/{job}" would overlap with
+// "/fhir/{type}/_history" routes of the RESTful API.
+const exportStatusPath = "/_export"
+
+const (
+	// exportRetention is how long files of finished export jobs are
+	// kept, the manifest advertises it with Expires header
+	exportRetention = 24 * time.Hour
+
+	// exportCleanupInterval is how often expired jobs are removed
+	exportCleanupInterval = 10 * time.Minute
+)
+
+const (
+	exportInProgress = "in-progress"
+	exportComplete   = "complete"
+	exportFailed     = "failed"
+)
+
+type exportOutput struct {
+	Type  string
+	Count int64
+	file  string
+}
+
+// exportJob is a Bulk Data export running in the background
+type exportJob struct {
+	mu sync.Mutex
+
+	id              string
+	request         string
+	level           string
+	group           string
+	types           []string
+	since           *time.Time
+	dir             string
+	status          string
+	progress        string
+	message         string
+	transactionTime time.Time
+	expires         time.Time
+	outputs         []*exportOutput
+	deleted         bool
+	cancel          context.CancelFunc
+}
+
+func (j *exportJob) setProgress(format string, args ...interface{}) {
+	j.mu.Lock()
+	j.progress = fmt.Sprintf(format, args...)
+	j.mu.Unlock()
+}
+
+// exportManager keeps Bulk Data export jobs of the web server
+type exportManager struct {
+	mu          sync.Mutex
+	ctx         context.Context
+	db          *pgxpool.Pool
+	layout      tableLayout
+	fhirVersion string
+	dir         string
+	jobs        map[string]*exportJob
+
+	// requiresAccessToken tells clients that output files need the same
+	// credentials as the rest of the server
+	requiresAccessToken bool
+}
+
+func newExportManager(ctx context.Context, database *pgxpool.Pool, layout tableLayout) (*exportManager, error) {
+	dir := viper.GetString("export-dir")
+
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "fhirbase-export")
+	}
+
+	if err := ensureDirectoryExists(dir); err != nil {
+		return nil, err
+	}
+
+	m := &exportManager{
+		ctx:                 ctx,
+		db:                  database,
+		layout:              layout,
+		fhirVersion:         viper.GetString("fhir"),
+		dir:                 dir,
+		jobs:                make(map[string]*exportJob),
+		requiresAccessToken: newWebAuth().Enabled(),
+	}
+
+	m.removeStale(time.Now())
+	go m.cleanup(ctx)
+
+	return m, nil
+}
+
+// removeExpired removes finished jobs whose files expired
+func (m *exportManager) removeExpired(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		expired := job.status != exportInProgress && now.After(job.expires)
+		job.mu.Unlock()
+
+		if expired {
+			delete(m.jobs, id)
+			os.RemoveAll(job.dir)
+		}
+	}
+}
+
+// removeStale removes directories of jobs left by previous runs of the
+// server, jobs don't survive restarts so nobody can download them
+func (m *exportManager) removeStale(now time.Time) {
+	entries, err := os.ReadDir(m.dir)
+
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+
+		if err != nil || !e.IsDir() || now.Sub(info.ModTime()) < exportRetention {
+			continue
+		}
+
+		if _, err := uuid.Parse(e.Name()); err == nil {
+			os.RemoveAll(filepath.Join(m.dir, e.Name()))
+		}
+	}
+}
+
+// cleanup removes expired jobs until the context is cancelled
+func (m *exportManager) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(exportCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.removeExpired(now)
+		}
+	}
+}
+
+// writeOperationOutcome responds with OperationOutcome describing an
+// error
+func writeOperationOutcome(w http.ResponseWriter, status int, code string, format string, args ...interface{}) {
+	severity := "error"
+
+	if status < 400 {
+		severity = "information"
+	}
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.WriteHeader(status)
+
+	jsoniter.NewEncoder(w).Encode(map[string]interface{}{
+		"resourceType": "OperationOutcome",
+		"issue": []interface{}{
+			map[string]interface{}{
+				"severity":    severity,
+				"code":        code,
+				"diagnostics": fmt.Sprintf(format, args...),
+			},
+		},
+	})
+}
+
+// requestBaseURL returns absolute URL of the server from the request
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// exportParams reads kick-off parameters from query string or from
+// Parameters resource in POST body
+func exportParams(r *http.Request) (map[string][]string, error) {
+	params := make(map[string][]string)
+
+	for k, v := range r.URL.Query() {
+		params[k] = v
+	}
+
+	if r.Method != "POST" {
+		return params, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %v", err)
+	}
+
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return params, nil
+	}
+
+	var parameters struct {
+		ResourceType string                   `json:"resourceType"`
+		Parameter    []map[string]interface{} `json:"parameter"`
+	}
+
+	if err := jsoniter.Unmarshal(body, &parameters); err != nil || parameters.ResourceType != "Parameters" {
+		return nil, fmt.Errorf("expecting Parameters resource in the request body")
+	}
+
+	for _, p := range parameters.Parameter {
+		name, _ := p["name"].(string)
+
+		for k, v := range p {
+			if !strings.HasPrefix(k, "value") {
+				continue
+			}
+
+			switch value := v.(type) {
+			case string:
+				params[name] = append(params[name], value)
+			case map[string]interface{}:
+				if ref, ok := value["reference"].(string); ok {
+					params[name] = append(params[name], ref)
+				}
+			}
+		}
+	}
+
+	return params, nil
+}
+
+// setExportParams sets types and since of the job from kick-off
+// parameters, it returns OperationOutcome issue code with the error
+func setExportParams(job *exportJob, params url.Values) (string, error) {
+	for name, values := range params {
+		switch name {
+		case "_type":
+			for _, v := range values {
+				for _, t := range strings.Split(v, ",") {
+					if t = strings.TrimSpace(t); t != "" {
+						job.types = append(job.types, t)
+					}
+				}
+			}
+		case "_since":
+			since, err := time.Parse(time.RFC3339, values[0])
+
+			if err != nil {
+				return "invalid", fmt.Errorf("_since should be an instant: %v", err)
+			}
+
+			job.since = &since
+		case "_outputFormat":
+			switch values[0] {
+			case "application/fhir+ndjson", "application/ndjson", "ndjson":
+			default:
+				return "not-supported", fmt.Errorf("only application/fhir+ndjson output format is supported")
+			}
+		default:
+			return "not-supported", fmt.Errorf("%s parameter is not supported", name)
+		}
+	}
+
+	return "", nil
+}
+
+// kickoffHandler starts a new export job
+func (m *exportManager) kickoffHandler(level string, w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Prefer"), "respond-async") {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "Prefer: respond-async header is required")
+		return
+	}
+
+	params, err := exportParams(r)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "%v", err)
+		return
+	}
+
+	job := &exportJob{
+		id:       uuid.New().String(),
+		request:  requestBaseURL(r) + r.URL.RequestURI(),
+		level:    level,
+		group:    r.PathValue("id"),
+		status:   exportInProgress,
+		progress: "queued",
+	}
+
+	if code, err := setExportParams(job, params); err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, code, "%v", err)
+		return
+	}
+
+	knownTypes, err := m.layout.ResourceTypes(r.Context(), m.db)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	if len(job.types) == 0 {
+		job.types = knownTypes
+	} else {
+		known := make(map[string]bool)
+
+		for _, t := range knownTypes {
+			known[t] = true
+		}
+
+		for _, t := range job.types {
+			if !known[t] {
+				writeOperationOutcome(w, http.StatusBadRequest, "not-supported", "unknown resource type %s in _type parameter", t)
+				return
+			}
+		}
+	}
+
+	if level == "group" {
+		query, args := m.layout.ResourceQuery("Group")
+		query += fmt.Sprintf(" AND id = $%d", len(args)+1)
+		var group map[string]interface{}
+
+		if err := m.db.QueryRow(r.Context(), query, append(args, job.group)...).Scan(&group); err != nil {
+			if err == pgx.ErrNoRows {
+				writeOperationOutcome(w, http.StatusNotFound, "not-found", "Group %s not found", job.group)
+			} else {
+				writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			}
+
+			return
+		}
+	}
+
+	job.dir = filepath.Join(m.dir, job.id)
+
+	if err := ensureDirectoryExists(job.dir); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	job.cancel = cancel
+
+	m.mu.Lock()
+	m.jobs[job.id] = job
+	m.mu.Unlock()
+
+	go m.run(ctx, job)
+
+	w.Header().Set("Content-Location", requestBaseURL(r)+exportStatusPath+"/"+job.id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (m *exportManager) getJob(w http.ResponseWriter, r *http.Request) *exportJob {
+	m.mu.Lock()
+	job := m.jobs[r.PathValue("job")]
+	m.mu.Unlock()
+
+	if job == nil {
+		writeOperationOutcome(w, http.StatusNotFound, "not-found", "export job %s not found", r.PathValue("job"))
+	}
+
+	return job
+}
+
+// statusHandler reports status of the export job, responding with the
+// manifest when it's complete
+func (m *exportManager) statusHandler(w http.ResponseWriter, r *http.Request) {
+	job := m.getJob(w, r)
+
+	if job == nil {
+		return
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	switch job.status {
+	case exportInProgress:
+		w.Header().Set("X-Progress", job.progress)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusAccepted)
+	case exportFailed:
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "export failed: %s", job.message)
+	default:
+		output := make([]interface{}, 0, len(job.outputs))
+
+		for _, o := range job.outputs {
+			output = append(output, map[string]interface{}{
+				"type":  o.Type,
+				"url":   requestBaseURL(r) + exportStatusPath + "/" + job.id + "/" + o.file,
+				"count": o.Count,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Expires", job.expires.UTC().Format(http.TimeFormat))
+
+		jsoniter.NewEncoder(w).Encode(map[string]interface{}{
+			"transactionTime":     job.transactionTime.Format(time.RFC3339Nano),
+			"request":             job.request,
+			"requiresAccessToken": m.requiresAccessToken,
+			"output":              output,
+			"error":               []interface{}{},
+		})
+	}
+}
+
+// deleteHandler cancels the export job and removes its files
+func (m *exportManager) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	job := m.getJob(w, r)
+
+	if job == nil {
+		return
+	}
+
+	m.mu.Lock()
+	delete(m.jobs, job.id)
+	m.mu.Unlock()
+
+	job.mu.Lock()
+	job.deleted = true
+	finished := job.status != exportInProgress
+	job.mu.Unlock()
+
+	job.cancel()
+
+	// running job removes its files when it stops
+	if finished {
+		os.RemoveAll(job.dir)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// fileHandler serves NDJSON file of the complete export job
+func (m *exportManager) fileHandler(w http.ResponseWriter, r *http.Request) {
+	job := m.getJob(w, r)
+
+	if job == nil {
+		return
+	}
+
+	job.mu.Lock()
+	var output *exportOutput
+
+	for _, o := range job.outputs {
+		if o.file == r.PathValue("file") && job.status == exportComplete {
+			output = o
+		}
+	}
+
+	job.mu.Unlock()
+
+	if output == nil {
+		writeOperationOutcome(w, http.StatusNotFound, "not-found", "file %s not found", r.PathValue("file"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/fhir+ndjson")
+	http.ServeFile(w, r, filepath.Join(job.dir, output.file))
+}
+
+// run performs the export. All resource types are read in a single
+// REPEATABLE READ transaction, so the export is a consistent snapshot
+// as of its transactionTime.
+func (m *exportManager) run(ctx context.Context, job *exportJob) {
+	err := m.export(ctx, job)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if err != nil {
+		job.status = exportFailed
+		job.message = err.Error()
+	} else {
+		job.status = exportComplete
+	}
+
+	job.expires = time.Now().Add(exportRetention)
+
+	if job.deleted {
+		os.RemoveAll(job.dir)
+	}
+}
+
+func (m *exportManager) export(ctx context.Context, job *exportJob) error {
+	tx, err := m.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %v", err)
+	}
+
+	defer tx.Rollback(context.Background())
+
+	var transactionTime time.Time
+
+	if err := tx.QueryRow(ctx, "SELECT now()").Scan(&transactionTime); err != nil {
+		return err
+	}
+
+	job.mu.Lock()
+	job.transactionTime = transactionTime
+	job.mu.Unlock()
+
+	var patientIDs []string
+
+	if job.level == "group" {
+		patientIDs, err = m.groupMembers(ctx, tx, job.group)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	total := int64(0)
+
+	for i, rt := range job.types {
+		job.setProgress("exporting %s (%d of %d types), %d resources exported", rt, i+1, len(job.types), total)
+
+		output, err := m.exportType(ctx, tx, job, rt, patientIDs)
+
+		if err != nil {
+			return fmt.Errorf("cannot export %s: %v", rt, err)
+		}
+
+		if output != nil {
+			total += output.Count
+
+			job.mu.Lock()
+			job.outputs = append(job.outputs, output)
+			job.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// groupMembers returns IDs of patients from Group.member
+func (m *exportManager) groupMembers(ctx context.Context, tx pgx.Tx, groupID string) ([]string, error) {
+	query, args := m.layout.ResourceQuery("Group")
+	query += fmt.Sprintf(" AND id = $%d", len(args)+1)
+
+	var group map[string]interface{}
+
+	if err := tx.QueryRow(ctx, query, append(args, groupID)...).Scan(&group); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("Group %s not found", groupID)
+		}
+
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	members, _ := group["member"].([]interface{})
+
+	for _, mbr := range members {
+		member, _ := mbr.(map[string]interface{})
+		entity, _ := member["entity"].(map[string]interface{})
+
+		if rt, _ := entity["resourceType"].(string); rt == "Patient" {
+			if id, ok := entity["id"].(string); ok {
+				ids = append(ids, id)
+			}
+		} else if ref, _ := entity["reference"].(string); strings.HasPrefix(ref, "Patient/") {
+			ids = append(ids, strings.TrimPrefix(ref, "Patient/"))
+		}
+	}
+
+	return ids, nil
+}
+
+// patientCompartmentParams returns reference search parameters of the
+// resource type which can point to Patient (like Observation.subject or
+// Observation.performer); resources referencing a patient by any of them
+// are in the patient's compartment
+func patientCompartmentParams(definitions searchParams, rt string) []*searchParam {
+	names := make([]string, 0)
+
+	for name, param := range definitions[rt] {
+		if param.Type == "reference" && slices.Contains(param.Target, "Patient") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	result := make([]*searchParam, 0, len(names))
+
+	for _, name := range names {
+		result = append(result, definitions[rt][name])
+	}
+
+	return result
+}
+
+// exportQuery returns query selecting resources of the type for the
+// job. Patient and group level exports are limited to the patients'
+// compartments, patientIDs are members of the exported group.
+func (m *exportManager) exportQuery(job *exportJob, rt string, patientIDs []string) (string, []interface{}, error) {
+	q := &search{rt: rt}
+	q.query, q.args = m.layout.ResourceQuery(rt)
+
+	if job.since != nil {
+		q.where = append(q.where, "ts > "+q.arg(*job.since))
+	}
+
+	// patient level exports include all patients
+	if job.level == "system" || (job.level == "patient" && rt == "Patient") {
+		return q.filteredSQL(), q.args, nil
+	}
+
+	definitions, err := getSearchParams(m.fhirVersion)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	tr, err := getTransformData(m.fhirVersion)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	ids := ""
+
+	if job.level == "group" {
+		ids = q.arg(patientIDs)
+	}
+
+	conditions := make([]string, 0)
+
+	if rt == "Patient" {
+		conditions = append(conditions, fmt.Sprintf("id = ANY(%s::text[])", ids))
+	}
+
+	// parameters often share paths (i.e. "patient" and "subject")
+	seen := make(map[string]bool)
+
+	for _, param := range patientCompartmentParams(definitions, rt) {
+		for _, p := range param.Path {
+			if seen[p] {
+				continue
+			}
+
+			seen[p] = true
+			cond := referenceTypeSQL(q, param) + " = 'Patient'"
+
+			if job.level == "group" {
+				cond += fmt.Sprintf(" AND ref.v->>'id' = ANY(%s::text[])", ids)
+			}
+
+			conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_path_query(resource, %s::jsonpath) AS ref(v) WHERE %s)", q.arg(searchJSONPath(tr, rt, p)), cond))
+		}
+	}
+
+	// resources which can't reference patients aren't exported
+	if len(conditions) == 0 {
+		conditions = append(conditions, "false")
+	}
+
+	q.where = append(q.where, "("+strings.Join(conditions, " OR ")+")")
+
+	return q.filteredSQL(), q.args, nil
+}
+
+// exportType writes resources of the type into NDJSON file, it returns
+// nil if there are no such resources
+func (m *exportManager) exportType(ctx context.Context, tx pgx.Tx, job *exportJob, rt string, patientIDs []string) (*exportOutput, error) {
+	query, args, err := m.exportQuery(job, rt, patientIDs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	output := &exportOutput{Type: rt, file: rt + ".ndjson"}
+	fileName := filepath.Join(job.dir, output.file)
+	f, err := os.Create(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	for rows.Next() {
+		var res map[string]interface{}
+
+		if err := rows.Scan(&res); err != nil {
+			return nil, err
+		}
+
+		res, _, err = doReverseTransform(res, m.fhirVersion)
+
+		if err != nil {
+			return nil, err
+		}
+
+		line, err := jsoniter.Marshal(res)
+
+		if err != nil {
+			return nil, err
+		}
+
+		w.Write(line)
+		w.WriteByte('\n')
+		output.Count++
+
+		if output.Count%1000 == 0 {
+			job.setProgress("exporting %s, %d resources of this type exported", rt, output.Count)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	if output.Count == 0 {
+		os.Remove(fileName)
+		return nil, nil
+	}
+
+	return output, nil
+}
+
+// registerExportHandlers adds Bulk Data export endpoints to the router
+func registerExportHandlers(router *http.ServeMux, m *exportManager) {
+	for _, method := range []string{"GET", "POST"} {
+		router.HandleFunc(method+" "+fhirBasePath+"/$export", func(w http.ResponseWriter, r *http.Request) {
+			m.kickoffHandler("system", w, r)
+		})
+		router.HandleFunc(method+" "+fhirBasePath+"/Patient/$export", func(w http.ResponseWriter, r *http.Request) {
+			m.kickoffHandler("patient", w, r)
+		})
+		router.HandleFunc(method+" "+fhirBasePath+"/Group/{id}/$export", func(w http.ResponseWriter, r *http.Request) {
+			m.kickoffHandler("group", w, r)
+		})
+	}
+
+	router.HandleFunc("GET "+exportStatusPath+"/{job}", m.statusHandler)
+	router.HandleFunc("DELETE "+exportStatusPath+"/{job}", m.deleteHandler)
+	router.HandleFunc("GET "+exportStatusPath+"/{job}/{file}", m.fileHandler)
+}
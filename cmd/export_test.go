@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func testExportManager(t *testing.T) *exportManager {
+	t.Helper()
+
+	return &exportManager{dir: t.TempDir(), jobs: make(map[string]*exportJob)}
+}
+
+func testExportJob(t *testing.T, m *exportManager, status string, expires time.Time) *exportJob {
+	t.Helper()
+
+	job := &exportJob{id: uuid.New().String(), status: status, expires: expires, cancel: func() {}}
+	job.dir = filepath.Join(m.dir, job.id)
+
+	if err := os.MkdirAll(job.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m.jobs[job.id] = job
+
+	return job
+}
+
+func TestExportManifest(t *testing.T) {
+	for _, requiresAccessToken := range []bool{false, true} {
+		m := testExportManager(t)
+		m.requiresAccessToken = requiresAccessToken
+		job := testExportJob(t, m, exportComplete, time.Now().Add(exportRetention))
+		job.outputs = []*exportOutput{{Type: "Patient", Count: 2, file: "Patient.ndjson"}}
+
+		router := http.NewServeMux()
+		registerExportHandlers(router, m)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://fhirbase.test"+exportStatusPath+"/"+job.id, nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+
+		var manifest struct {
+			RequiresAccessToken bool `json:"requiresAccessToken"`
+			Output              []struct {
+				Type string `json:"type"`
+				URL  string `json:"url"`
+			} `json:"output"`
+		}
+
+		if err := jsoniter.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+			t.Fatal(err)
+		}
+
+		if manifest.RequiresAccessToken != requiresAccessToken {
+			t.Errorf("requiresAccessToken is %v, want %v", manifest.RequiresAccessToken, requiresAccessToken)
+		}
+
+		if len(manifest.Output) != 1 || manifest.Output[0].URL != "http://fhirbase.test/_export/"+job.id+"/Patient.ndjson" {
+			t.Errorf("unexpected output %+v", manifest.Output)
+		}
+
+		expires, err := http.ParseTime(w.Header().Get("Expires"))
+
+		if err != nil || expires.Sub(job.expires) > time.Second || job.expires.Sub(expires) > time.Second {
+			t.Errorf("Expires header %q doesn't match job expiry %v", w.Header().Get("Expires"), job.expires)
+		}
+	}
+}
+
+func TestExportRemoveExpired(t *testing.T) {
+	m := testExportManager(t)
+	now := time.Now()
+	expired := testExportJob(t, m, exportComplete, now.Add(-time.Minute))
+	failed := testExportJob(t, m, exportFailed, now.Add(-time.Minute))
+	current := testExportJob(t, m, exportComplete, now.Add(time.Hour))
+	running := testExportJob(t, m, exportInProgress, time.Time{})
+
+	m.removeExpired(now)
+
+	for _, job := range []*exportJob{expired, failed} {
+		if _, ok := m.jobs[job.id]; ok {
+			t.Errorf("%s job should be removed", job.status)
+		}
+
+		if _, err := os.Stat(job.dir); !os.IsNotExist(err) {
+			t.Errorf("files of %s job should be removed", job.status)
+		}
+	}
+
+	for _, job := range []*exportJob{current, running} {
+		if _, ok := m.jobs[job.id]; !ok {
+			t.Errorf("%s job shouldn't be removed", job.status)
+		}
+	}
+}
+
+func TestExportRemoveStale(t *testing.T) {
+	m := testExportManager(t)
+	old := filepath.Join(m.dir, uuid.New().String())
+	recent := filepath.Join(m.dir, uuid.New().String())
+	other := filepath.Join(m.dir, "not-a-job")
+
+	for _, dir := range []string{old, recent, other} {
+		os.MkdirAll(dir, 0755)
+	}
+
+	past := time.Now().Add(-2 * exportRetention)
+	os.Chtimes(old, past, past)
+	os.Chtimes(other, past, past)
+
+	m.removeStale(time.Now())
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("stale job directory should be removed")
+	}
+
+	for _, dir := range []string{recent, other} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("%s shouldn't be removed", dir)
+		}
+	}
+}
+
+func TestSetExportParams(t *testing.T) {
+	job := &exportJob{}
+	params := url.Values{"_type": {"Patient, Observation", ",Encounter"}, "_since": {"2024-05-01T12:30:00+02:00"}, "_outputFormat": {"ndjson"}}
+
+	if _, err := setExportParams(job, params); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(job.types, " ") != "Patient Observation Encounter" {
+		t.Errorf("wrong types %q", job.types)
+	}
+
+	if job.since == nil || !job.since.Equal(time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("wrong since %v", job.since)
+	}
+
+	tests := map[string]string{
+		"_since=2024-05-01":                   "invalid",
+		"_since=yesterday":                    "invalid",
+		"_outputFormat=application/fhir+json": "not-supported",
+		"_typeFilter=Observation%3Fcode%3Dx":  "not-supported",
+	}
+
+	for query, expected := range tests {
+		params, _ := url.ParseQuery(query)
+
+		if code, err := setExportParams(&exportJob{}, params); err == nil || code != expected {
+			t.Errorf("%s: got %q %v, want %q", query, code, err, expected)
+		}
+	}
+}
+
+func TestExportKickoffInvalidSince(t *testing.T) {
+	m := testExportManager(t)
+	router := http.NewServeMux()
+	registerExportHandlers(router, m)
+
+	// parameters are validated before the database is used
+	r := httptest.NewRequest("GET", fhirBasePath+"/Patient/$export?_type=Patient&_since=2024-05-01", nil)
+	r.Header.Set("Prefer", "respond-async")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "_since") {
+		t.Errorf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	if len(m.jobs) != 0 {
+		t.Errorf("job shouldn't be started, got %d", len(m.jobs))
+	}
+}
+
+func TestExportQuery(t *testing.T) {
+	m := testExportManager(t)
+	m.fhirVersion = "4.0.0"
+	since := time.Now()
+
+	tests := []struct {
+		level    string
+		rt       string
+		contains []string
+		args     int
+	}{
+		{"system", "Observation", []string{"ts > $1"}, 1},
+		{"patient", "Patient", []string{"ts > $1"}, 1},
+		// Observation references patients by subject and performer
+		{"patient", "Observation", []string{"subject", "performer"}, 4},
+		{"group", "Patient", []string{"id = ANY($2::text[])", "link", "other"}, 3},
+		{"group", "Observation", []string{"ref.v->>'id' = ANY($2::text[])", "performer"}, 5},
+		{"patient", "Organization", []string{"(false)"}, 1},
+	}
+
+	for _, tt := range tests {
+		job := &exportJob{level: tt.level, since: &since}
+		query, args, err := m.exportQuery(job, tt.rt, []string{"pt-1"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(args) != tt.args || maxPlaceholder(query) != len(args) {
+			t.Errorf("%s %s: got %d args for %d placeholders, want %d: %s", tt.level, tt.rt, len(args), maxPlaceholder(query), tt.args, query)
+		}
+
+		content := query + " " + jsonString(t, args)
+
+		for _, s := range tt.contains {
+			if !strings.Contains(content, s) {
+				t.Errorf("%s %s: %s is missing in %s", tt.level, tt.rt, s, content)
+			}
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	urlPkg "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	db "github.com/labordude/fhirbase/db"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// fetchCmd represents the fetch command
+var fetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Downloads results of FHIR search queries as NDJSON files or loads them into the database",
+	Example: `fhirbase fetch 'http://some-fhir-server.com/fhir/Patient?_lastUpdated=gt2024-01-01' /output/dir/
+fhirbase fetch --include=Observation:subject 'http://some-fhir-server.com/fhir/Observation?code=1234-5' /output/dir/
+fhirbase fetch --load 'http://some-fhir-server.com/fhir/Patient' 'http://some-fhir-server.com/fhir/Encounter'`,
+	Long: `
+Fetch command runs FHIR search queries against a FHIR server which
+doesn't support Bulk Data API and follows "next" links of returned
+search Bundles until all pages are fetched.
+
+Resources are saved into the directory given as the last argument, one
+<ResourceType>.ndjson file per resource type, which can be loaded with
+the "load" command later. With "--load" flag no directory is needed:
+resources are loaded into the database as they arrive, page by page.
+
+Several search URLs can be given, they are fetched in parallel and you
+can specify number of threads with "--numdl" flag.
+
+Resources matched by "_include" and "_revinclude" parameters are saved
+as well. The parameters can be given in the URL or with "--include"
+and "--revinclude" flags, which are added to every search URL:
+
+  --include=Observation:subject     _include=Observation:subject
+  --revinclude=Provenance:target    _revinclude=Provenance:target
+
+Resources returned several times (included resources often are) are
+saved only once.
+
+Failed page requests are retried "--retries" times with exponential
+backoff. Authentication options and "--accept-header" are the same as
+for the "bulkget" command.`,
+	Args: cobra.MinimumNArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindCommandFlags(cmd, append(authFlags, "numdl", "accept-header", "retries", "include", "revinclude", "load", "mode", "memusage")...)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if !viper.GetBool("load") && len(args) < 2 {
+			fmt.Println("Not enough arguments")
+			return
+		}
+
+		err := FetchCommand(cmd.Context(), args)
+
+		if err != nil {
+			fmt.Printf("Error fetching resources: %v\n", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+
+	fetchCmd.PersistentFlags().IntP("numdl", "n", 5, "Number of search queries fetched in parallel")
+	fetchCmd.PersistentFlags().String("accept-header", "application/fhir+json", "Value for Accept HTTP header")
+	fetchCmd.PersistentFlags().Int("retries", 5, "Number of retries for every page request")
+	fetchCmd.PersistentFlags().StringArray("include", []string{}, "Adds _include parameter to every search URL, can be repeated")
+	fetchCmd.PersistentFlags().StringArray("revinclude", []string{}, "Adds _revinclude parameter to every search URL, can be repeated")
+	fetchCmd.PersistentFlags().Bool("load", false, "Load fetched resources into the database instead of saving them")
+	fetchCmd.PersistentFlags().StringP("mode", "m", "insert", "insert or copy, used with --load")
+	fetchCmd.PersistentFlags().Bool("memusage", false, "memory usage")
+	addAuthFlags(fetchCmd)
+}
+
+// searchURL adds _include and _revinclude parameters from the flags
+// to the search URL
+func searchURL(url string) (string, error) {
+	includes := viper.GetStringSlice("include")
+	revincludes := viper.GetStringSlice("revinclude")
+
+	if len(includes) == 0 && len(revincludes) == 0 {
+		return url, nil
+	}
+
+	parsed, err := urlPkg.Parse(url)
+
+	if err != nil {
+		return "", fmt.Errorf("cannot parse URL %s: %v", url, err)
+	}
+
+	query := parsed.Query()
+
+	for _, inc := range includes {
+		query.Add("_include", inc)
+	}
+
+	for _, inc := range revincludes {
+		query.Add("_revinclude", inc)
+	}
+
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
+
+// searchPage is a page of search results
+type searchPage struct {
+	ResourceType string `json:"resourceType"`
+	Link         []struct {
+		Relation string `json:"relation"`
+		URL      string `json:"url"`
+	} `json:"link"`
+	Entry []struct {
+		Resource map[string]interface{} `json:"resource"`
+		Search   struct {
+			Mode string `json:"mode"`
+		} `json:"search"`
+	} `json:"entry"`
+}
+
+// nextURL returns URL of the next page resolved against the URL of the
+// current page, or empty string for the last page
+func (p *searchPage) nextURL(current string) (string, error) {
+	for _, l := range p.Link {
+		if l.Relation != "next" || l.URL == "" {
+			continue
+		}
+
+		base, err := urlPkg.Parse(current)
+
+		if err != nil {
+			return "", err
+		}
+
+		next, err := base.Parse(l.URL)
+
+		if err != nil {
+			return "", fmt.Errorf("cannot parse next link %s: %v", l.URL, err)
+		}
+
+		return next.String(), nil
+	}
+
+	return "", nil
+}
+
+// fetchPageAttempt requests a single page of search results
+func fetchPageAttempt(ctx context.Context, client *http.Client, url string, acceptHdr string) (*searchPage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+
+	if err != nil {
+		return nil, &downloadError{err: fmt.Errorf("cannot create request: %v", err)}
+	}
+
+	req.Header.Set("Accept", acceptHdr)
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, &downloadError{err: fmt.Errorf("cannot fetch %s: %v", url, err), retry: true}
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, &downloadError{err: fmt.Errorf("cannot read response of %s: %v", url, err), retry: true}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &downloadError{
+			err:   fmt.Errorf("got %d response while fetching %s: %s", resp.StatusCode, url, body),
+			retry: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+		}
+	}
+
+	var page searchPage
+
+	if err := jsoniter.ConfigFastest.Unmarshal(body, &page); err != nil {
+		return nil, &downloadError{err: fmt.Errorf("cannot parse response of %s: %v", url, err)}
+	}
+
+	if page.ResourceType != "Bundle" {
+		return nil, &downloadError{err: fmt.Errorf("expected a Bundle from %s, got %s: %s", url, page.ResourceType, body)}
+	}
+
+	return &page, nil
+}
+
+// fetchedResources remembers fetched resources, so resources returned
+// several times are saved only once. It's safe for concurrent use.
+type fetchedResources struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// Add returns false if the resource was already fetched
+func (f *fetchedResources) Add(res map[string]interface{}) bool {
+	rt, _ := res["resourceType"].(string)
+	id, _ := res["id"].(string)
+
+	if id == "" {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := rt + "/" + id
+
+	if f.seen[key] {
+		return false
+	}
+
+	f.seen[key] = true
+
+	return true
+}
+
+// searchBundle reads resources from search results, fetching the next
+// page when the current one is over
+type searchBundle struct {
+	ctx       context.Context
+	client    *http.Client
+	url       string
+	acceptHdr string
+	retries   int
+	fetched   *fetchedResources
+
+	pages     int
+	resources []map[string]interface{}
+}
+
+func (b *searchBundle) Count() int {
+	return 0
+}
+
+func (b *searchBundle) Close() {
+}
+
+func (b *searchBundle) Next() (map[string]interface{}, error) {
+	for len(b.resources) == 0 {
+		if b.url == "" {
+			return nil, io.EOF
+		}
+
+		err := b.fetchPage()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := b.resources[0]
+	b.resources = b.resources[1:]
+
+	return res, nil
+}
+
+func (b *searchBundle) fetchPage() error {
+	var page *searchPage
+
+	err := retryDownload(b.ctx, b.url, b.retries, func() error {
+		var err error
+		page, err = fetchPageAttempt(b.ctx, b.client, b.url, b.acceptHdr)
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	b.pages++
+
+	for _, e := range page.Entry {
+		if e.Resource == nil {
+			continue
+		}
+
+		if e.Search.Mode == "outcome" {
+			fmt.Printf("Warning: server returned OperationOutcome for %s: %s\n", b.url, operationOutcomeText(e.Resource))
+			continue
+		}
+
+		if b.fetched.Add(e.Resource) {
+			b.resources = append(b.resources, e.Resource)
+		}
+	}
+
+	next, err := page.nextURL(b.url)
+
+	if err != nil {
+		return err
+	}
+
+	if next == b.url {
+		return fmt.Errorf("next link of %s points to the same page", b.url)
+	}
+
+	b.url = next
+
+	return nil
+}
+
+// operationOutcomeText joins diagnostics of OperationOutcome issues
+func operationOutcomeText(oo map[string]interface{}) string {
+	issues, _ := oo["issue"].([]interface{})
+	texts := make([]string, 0, len(issues))
+
+	for _, i := range issues {
+		issue, _ := i.(map[string]interface{})
+		text, _ := issue["diagnostics"].(string)
+
+		if text == "" {
+			details, _ := issue["details"].(map[string]interface{})
+			text, _ = details["text"].(string)
+		}
+
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+
+	return strings.Join(texts, "; ")
+}
+
+// fetchAll fetches every search URL with numWorkers in parallel, passing
+// every search to onSearch
+func fetchAll(ctx context.Context, urls []string, numWorkers int, onSearch func(url string, bndl *searchBundle) error) error {
+	acceptHdr := viper.GetString("accept-header")
+	retries := viper.GetInt("retries")
+	fetched := &fetchedResources{seen: make(map[string]bool)}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan string, len(urls))
+	errs := make(chan error, len(urls))
+	var wg sync.WaitGroup
+
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for url := range jobs {
+				err := fetchSearch(ctx, url, acceptHdr, retries, fetched, onSearch)
+
+				if err != nil {
+					errs <- err
+					cancel()
+				}
+			}
+		}()
+	}
+
+	for _, url := range urls {
+		jobs <- url
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != context.Canceled {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
+func fetchSearch(ctx context.Context, url string, acceptHdr string, retries int, fetched *fetchedResources, onSearch func(url string, bndl *searchBundle) error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	fullURL, err := searchURL(url)
+
+	if err != nil {
+		return err
+	}
+
+	client, err := newFHIRClient(ctx, fullURL)
+
+	if err != nil {
+		return err
+	}
+
+	bndl := &searchBundle{
+		ctx:       ctx,
+		client:    client,
+		url:       fullURL,
+		acceptHdr: acceptHdr,
+		retries:   retries,
+		fetched:   fetched,
+	}
+
+	err = onSearch(url, bndl)
+
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error fetching %s: %v", url, err)
+	}
+
+	fmt.Printf("Fetched %d pages of %s\n", bndl.pages, url)
+
+	return nil
+}
+
+// fetchToFiles saves search results into dir, one NDJSON file per
+// resource type
+func fetchToFiles(ctx context.Context, urls []string, dir string) error {
+	out, err := newTransformOutput(dir, false)
+
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	counts := make(map[string]int)
+
+	err = fetchAll(ctx, urls, viper.GetInt("numdl"), func(url string, bndl *searchBundle) error {
+		for {
+			res, err := bndl.Next()
+
+			if err != nil {
+				return err
+			}
+
+			rt, _ := res["resourceType"].(string)
+
+			mu.Lock()
+			err = out.Write(res)
+			counts[rt]++
+			mu.Unlock()
+
+			if err != nil {
+				return err
+			}
+		}
+	})
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	for rt, cnt := range counts {
+		fmt.Printf("%s: %d resources\n", rt, cnt)
+	}
+
+	return err
+}
+
+// fetchToDatabase loads search results into the database page by page
+func fetchToDatabase(ctx context.Context, urls []string) error {
+	mode := viper.GetString("mode")
+	memUsage := viper.GetBool("memusage")
+	var ldr loader
+
+	switch mode {
+	case "copy":
+		ldr = &copyLoader{fhirVersion: viper.GetString("fhir"), strict: viper.GetBool("strict")}
+	case "insert":
+		ldr = &insertLoader{fhirVersion: viper.GetString("fhir"), strict: viper.GetBool("strict")}
+	default:
+		return fmt.Errorf("invalid value for --mode flag. Possible values are either 'copy' or 'insert'")
+	}
+
+	database, err := db.GetConnection()
+
+	if err != nil {
+		return fmt.Errorf("Failed to get connection config: %v", err)
+	}
+
+	defer database.Close()
+
+	layout, err := detectTableLayout(ctx, database)
+
+	if err != nil {
+		return err
+	}
+
+	startTime := time.Now()
+	stats := newLoadStats()
+	bar := newLoadProgressBar(-1)
+
+	err = fetchAll(ctx, urls, viper.GetInt("numdl"), func(url string, bndl *searchBundle) error {
+		return ldr.Load(ctx, database, layout, bndl, func(curType string, duration time.Duration, warnings transformErrors) {
+			if stats.Add(curType, warnings)%3000 == 0 && memUsage {
+				PrintMemUsage()
+			}
+
+			bar.Add(1)
+		})
+	})
+
+	bar.Finish()
+	fmt.Println("")
+	stats.Print(startTime)
+
+	return err
+}
+
+// FetchCommand fetches results of FHIR search queries following
+// paging links and saves them as NDJSON or loads them into the database
+func FetchCommand(ctx context.Context, args []string) error {
+	if viper.GetBool("load") {
+		return fetchToDatabase(ctx, args)
+	}
+
+	return fetchToFiles(ctx, args[:len(args)-1], args[len(args)-1])
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// searchServer serves two pages of Patient search results with the
+// same included Organization on both pages
+func searchServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("_include") != "Patient:organization" {
+			t.Errorf("_include parameter is missing in %s", r.URL)
+		}
+
+		w.Header().Set("Content-Type", "application/fhir+json")
+
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Write([]byte(`{"resourceType": "Bundle", "link": [{"relation": "next", "url": "Patient?page=2&_include=Patient:organization"}], "entry": [
+				{"resource": {"resourceType": "Patient", "id": "pt-1"}, "search": {"mode": "match"}},
+				{"resource": {"resourceType": "Organization", "id": "org-1"}, "search": {"mode": "include"}},
+				{"resource": {"resourceType": "OperationOutcome", "issue": [{"diagnostics": "unknown parameter"}]}, "search": {"mode": "outcome"}}
+			]}`))
+		case "2":
+			w.Write([]byte(`{"resourceType": "Bundle", "entry": [
+				{"resource": {"resourceType": "Patient", "id": "pt-2"}, "search": {"mode": "match"}},
+				{"resource": {"resourceType": "Organization", "id": "org-1"}, "search": {"mode": "include"}}
+			]}`))
+		default:
+			w.Write([]byte(`{"resourceType": "Bundle", "link": [{"relation": "next", "url": "` + r.URL.String() + `"}]}`))
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestFetchToFiles(t *testing.T) {
+	server := searchServer(t)
+	setConfig(t, map[string]interface{}{"include": []string{"Patient:organization"}, "numdl": 2})
+	dir := t.TempDir()
+
+	if err := fetchToFiles(context.Background(), []string{server.URL + "/Patient"}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	patients := readNDJSON(t, filepath.Join(dir, "Patient.ndjson"))
+	organizations := readNDJSON(t, filepath.Join(dir, "Organization.ndjson"))
+
+	if len(patients) != 2 || patients[1]["id"] != "pt-2" {
+		t.Errorf("both pages should be fetched, got %v", patients)
+	}
+
+	// resources included on several pages are saved once
+	if len(organizations) != 1 {
+		t.Errorf("got %d organizations, want 1", len(organizations))
+	}
+}
+
+func TestFetchSamePage(t *testing.T) {
+	server := searchServer(t)
+	setConfig(t, map[string]interface{}{"include": []string{"Patient:organization"}})
+
+	err := fetchToFiles(context.Background(), []string{server.URL + "/Patient?page=loop"}, t.TempDir())
+
+	if err == nil || !strings.Contains(err.Error(), "same page") {
+		t.Errorf("expected error for next link pointing to the same page, got %v", err)
+	}
+}
+
+func TestSearchURL(t *testing.T) {
+	setConfig(t, map[string]interface{}{
+		"include":    []string{"Observation:subject"},
+		"revinclude": []string{"Provenance:target"},
+	})
+
+	url, err := searchURL("https://fhir.test/Observation?code=1234")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "https://fhir.test/Observation?_include=Observation%3Asubject&_revinclude=Provenance%3Atarget&code=1234"; url != expected {
+		t.Errorf("got %s, want %s", url, expected)
+	}
+}
+
+func TestSearchPageNextURL(t *testing.T) {
+	var page searchPage
+
+	jsoniter.UnmarshalFromString(`{"resourceType": "Bundle", "link": [
+		{"relation": "self", "url": "Patient?page=1"},
+		{"relation": "next", "url": "Patient?page=2"}
+	]}`, &page)
+
+	if next, err := page.nextURL("https://fhir.test/r4/Patient?page=1"); err != nil || next != "https://fhir.test/r4/Patient?page=2" {
+		t.Errorf("got %s, %v", next, err)
+	}
+
+	if next, _ := (&searchPage{}).nextURL("https://fhir.test/r4/Patient"); next != "" {
+		t.Errorf("last page shouldn't have next URL, got %s", next)
+	}
+}
@@ -0,0 +1,567 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	jsoniter "github.com/json-iterator/go"
+	db "github.com/labordude/fhirbase/db"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history [resource type] [id]",
+	Short: "Prints all versions of a resource and changes between them",
+	Example: `fhirbase history Patient 123
+fhirbase history --at=2024-03-01 Patient 123`,
+	Long: `
+History command prints every version of the resource kept by Fhirbase,
+from the oldest to the current one. The first version is printed as a
+whole, every next one as a list of changed (~), added (+) and removed
+(-) elements compared to the previous version.
+
+With "--at" flag only the version which was current at the given date
+or instant is printed, as a whole. Dates like 2024-03-01 cover the
+whole day, and the last version of that day is printed.`,
+	Args: cobra.ExactArgs(2),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindCommandFlags(cmd, "at")
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := HistoryCommand(cmd.Context(), args[0], args[1])
+
+		if err != nil {
+			fmt.Printf("Error reading history: %v\n", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+
+	historyCmd.PersistentFlags().String("at", "", "Print only the version current at this date or instant")
+}
+
+// historyDiffIgnored are elements which change with every version and
+// are printed in version headers instead of diffs
+var historyDiffIgnored = map[string]bool{
+	"meta.versionId":   true,
+	"meta.lastUpdated": true,
+}
+
+// newHistory returns query for versions of resources of the provided
+// types (or of the single resource if id is given), rows have resource
+// and status columns
+func newHistory(layout tableLayout, resourceTypes []string, id string) *search {
+	s := &search{count: defaultSearchCount, used: url.Values{}}
+	versions, args := layout.VersionsQuery(resourceTypes)
+	s.args = args
+	s.query = fmt.Sprintf(`SELECT resource, status FROM (
+SELECT %s AS resource, id, txid, ts, status,
+lead(ts) OVER (PARTITION BY resource_type, id ORDER BY txid) AS next_ts
+FROM (%s) v) h WHERE true`, resourceJSONExpr, versions)
+	s.orderBy = []string{"txid DESC"}
+
+	if id != "" {
+		s.where = append(s.where, "id = "+s.arg(id))
+	}
+
+	return s
+}
+
+// historySince keeps only versions created at or after the instant
+func (s *search) historySince(value string) error {
+	value = strings.ReplaceAll(value, " ", "+")
+
+	if !matchSearchDate.MatchString(value) {
+		return newSearchError("invalid", "invalid _since value %s", value)
+	}
+
+	s.where = append(s.where, "ts >= "+dateLowerSQL(s.arg(value)+"::text"))
+
+	return nil
+}
+
+// historyAt keeps only versions which were current at some point during
+// the period covered by the date
+func (s *search) historyAt(value string) error {
+	value = strings.ReplaceAll(value, " ", "+")
+
+	if !matchSearchDate.MatchString(value) {
+		return newSearchError("invalid", "invalid _at value %s", value)
+	}
+
+	param := s.arg(value) + "::text"
+	s.where = append(s.where, fmt.Sprintf("ts < %s AND (next_ts IS NULL OR next_ts > %s)", dateUpperSQL(param), dateLowerSQL(param)))
+
+	return nil
+}
+
+// parseHistory applies _count, _offset, _since and _at parameters of
+// history interactions
+func parseHistory(s *search, params url.Values) error {
+	for name, values := range params {
+		switch name {
+		case "_count", "_offset":
+			n, err := strconv.Atoi(values[0])
+
+			if err != nil || n < 0 {
+				return newSearchError("invalid", "%s should be a non-negative integer", name)
+			}
+
+			if name == "_count" {
+				s.count = int(math.Min(float64(n), maxSearchCount))
+
+				// _count=0 asks for the number of versions only
+				s.total = n == 0
+			} else {
+				s.offset = n
+			}
+		case "_since":
+			if err := s.historySince(values[0]); err != nil {
+				return err
+			}
+
+			s.used[name] = values
+		case "_at":
+			if err := s.historyAt(values[0]); err != nil {
+				return err
+			}
+
+			s.used[name] = values
+		}
+	}
+
+	return nil
+}
+
+// historyLink returns URL of the history page starting at offset
+func historyLink(r *http.Request, s *search, offset int) string {
+	q := url.Values{}
+
+	for k, v := range s.used {
+		q[k] = v
+	}
+
+	q.Set("_count", strconv.Itoa(s.count))
+	q.Set("_offset", strconv.Itoa(offset))
+
+	return requestBaseURL(r) + r.URL.Path + "?" + q.Encode()
+}
+
+// historyEntry returns history Bundle entry for the version of a
+// resource, deleted versions have no resource
+func (a *restAPI) historyEntry(r *http.Request, res map[string]interface{}, status string) (map[string]interface{}, error) {
+	rt, _ := res["resourceType"].(string)
+	id, _ := res["id"].(string)
+	versionID, lastUpdated := resourceMeta(res)
+
+	entry := map[string]interface{}{
+		"fullUrl": fmt.Sprintf("%s%s/%s/%s", requestBaseURL(r), fhirBasePath, rt, id),
+	}
+
+	request := map[string]interface{}{"method": "PUT", "url": rt + "/" + id}
+	response := map[string]interface{}{"status": "200 OK"}
+
+	switch status {
+	case "created", "recreated":
+		request = map[string]interface{}{"method": "POST", "url": rt}
+		response["status"] = "201 Created"
+	case "deleted":
+		request["method"] = "DELETE"
+		response["status"] = "204 No Content"
+	}
+
+	response["etag"] = versionETag(versionID)
+
+	if lastUpdated != "" {
+		response["lastModified"] = lastUpdated
+	}
+
+	if status != "deleted" {
+		res, _, err := doReverseTransform(res, a.fhirVersion)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry["resource"] = res
+	}
+
+	entry["request"] = request
+	entry["response"] = response
+
+	return entry, nil
+}
+
+// historyHandler implements history interactions:
+// GET [base]/_history, GET [base]/[type]/_history and
+// GET [base]/[type]/[id]/_history
+func (a *restAPI) historyHandler(w http.ResponseWriter, r *http.Request) {
+	var types []string
+
+	if r.PathValue("type") == "" {
+		for rt := range a.types {
+			types = append(types, rt)
+		}
+
+		sort.Strings(types)
+	} else {
+		rt, ok := a.resourceType(w, r)
+
+		if !ok {
+			return
+		}
+
+		types = []string{rt}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "cannot parse history parameters: %v", err)
+		return
+	}
+
+	s := newHistory(a.layout, types, r.PathValue("id"))
+
+	if err := parseHistory(s, r.Form); err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "%v", err)
+		return
+	}
+
+	bundle := map[string]interface{}{
+		"resourceType": "Bundle",
+		"id":           uuid.New().String(),
+		"meta":         map[string]interface{}{"lastUpdated": time.Now().UTC().Format(time.RFC3339Nano)},
+		"type":         "history",
+	}
+
+	if s.total {
+		var total int64
+		query, args := s.CountSQL()
+
+		if err := a.db.QueryRow(r.Context(), query, args...).Scan(&total); err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			return
+		}
+
+		bundle["total"] = total
+	}
+
+	query, args := s.SQL()
+	rows, err := a.db.Query(r.Context(), query, args...)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	defer rows.Close()
+
+	entries := make([]interface{}, 0)
+	hasNext := false
+
+	for s.count > 0 && rows.Next() {
+		if len(entries) == s.count {
+			hasNext = true
+			break
+		}
+
+		var res map[string]interface{}
+		var status string
+
+		if err := rows.Scan(&res, &status); err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			return
+		}
+
+		entry, err := a.historyEntry(r, res, status)
+
+		if err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			return
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	links := []interface{}{
+		map[string]interface{}{"relation": "self", "url": historyLink(r, s, s.offset)},
+		map[string]interface{}{"relation": "first", "url": historyLink(r, s, 0)},
+	}
+
+	if s.offset > 0 && s.count > 0 {
+		links = append(links, map[string]interface{}{"relation": "previous", "url": historyLink(r, s, int(math.Max(0, float64(s.offset-s.count))))})
+	}
+
+	if hasNext {
+		links = append(links, map[string]interface{}{"relation": "next", "url": historyLink(r, s, s.offset+s.count)})
+	}
+
+	bundle["link"] = links
+	bundle["entry"] = entries
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	jsoniter.NewEncoder(w).Encode(bundle)
+}
+
+// vreadHandler implements vread interaction:
+// GET [base]/[type]/[id]/_history/[vid]
+func (a *restAPI) vreadHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := a.resourceType(w, r)
+
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	vid, err := strconv.ParseInt(r.PathValue("vid"), 10, 64)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "invalid version id %s", r.PathValue("vid"))
+		return
+	}
+
+	s := newHistory(a.layout, []string{rt}, id)
+	s.where = append(s.where, "txid = "+s.arg(vid))
+
+	var res map[string]interface{}
+	var status string
+
+	err = a.db.QueryRow(r.Context(), s.filteredSQL(), s.args...).Scan(&res, &status)
+
+	if err == pgx.ErrNoRows {
+		writeOperationOutcome(w, http.StatusNotFound, "not-found", "%s/%s version %d not found", rt, id, vid)
+		return
+	}
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	if status == "deleted" {
+		writeOperationOutcome(w, http.StatusGone, "deleted", "%s/%s was deleted in version %d", rt, id, vid)
+		return
+	}
+
+	a.writeResource(w, r, http.StatusOK, res)
+}
+
+// compactJSON formats value for diff output
+func compactJSON(v interface{}) string {
+	b, err := jsoniter.Marshal(v)
+
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return string(b)
+}
+
+// jsonDiff appends differences between JSON values a and b found at
+// path to changes, one line per changed (~), added (+) or removed (-)
+// element
+func jsonDiff(path string, a interface{}, b interface{}, changes []string) []string {
+	if historyDiffIgnored[path] {
+		return changes
+	}
+
+	am, aIsMap := a.(map[string]interface{})
+	bm, bIsMap := b.(map[string]interface{})
+
+	if aIsMap && bIsMap {
+		keys := make([]string, 0, len(am)+len(bm))
+
+		for k := range am {
+			keys = append(keys, k)
+		}
+
+		for k := range bm {
+			if _, ok := am[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p := k
+
+			if path != "" {
+				p = path + "." + k
+			}
+
+			av, inA := am[k]
+			bv, inB := bm[k]
+
+			switch {
+			case historyDiffIgnored[p]:
+			case !inA:
+				changes = append(changes, fmt.Sprintf("+ %s: %s", p, compactJSON(bv)))
+			case !inB:
+				changes = append(changes, fmt.Sprintf("- %s: %s", p, compactJSON(av)))
+			default:
+				changes = jsonDiff(p, av, bv, changes)
+			}
+		}
+
+		return changes
+	}
+
+	aa, aIsArray := a.([]interface{})
+	ba, bIsArray := b.([]interface{})
+
+	if aIsArray && bIsArray {
+		for i := 0; i < len(aa) || i < len(ba); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+
+			switch {
+			case i >= len(aa):
+				changes = append(changes, fmt.Sprintf("+ %s: %s", p, compactJSON(ba[i])))
+			case i >= len(ba):
+				changes = append(changes, fmt.Sprintf("- %s: %s", p, compactJSON(aa[i])))
+			default:
+				changes = jsonDiff(p, aa[i], ba[i], changes)
+			}
+		}
+
+		return changes
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		changes = append(changes, fmt.Sprintf("~ %s: %s -> %s", path, compactJSON(a), compactJSON(b)))
+	}
+
+	return changes
+}
+
+// HistoryCommand prints versions of the resource
+func HistoryCommand(ctx context.Context, rt string, id string) error {
+	database, err := db.GetConnection()
+
+	if err != nil {
+		return fmt.Errorf("Failed to get connection config: %v", err)
+	}
+
+	defer database.Close()
+
+	layout, err := detectTableLayout(ctx, database)
+
+	if err != nil {
+		return err
+	}
+
+	types, err := layout.ResourceTypes(ctx, database)
+
+	if err != nil {
+		return err
+	}
+
+	if !isTypeName(rt) || !slices.Contains(types, rt) {
+		return fmt.Errorf("unknown resource type %s", rt)
+	}
+
+	fhirVersion := viper.GetString("fhir")
+	at := viper.GetString("at")
+	s := newHistory(layout, []string{rt}, id)
+	query := s.filteredSQL() + " ORDER BY txid"
+
+	if at != "" {
+		if err := s.historyAt(at); err != nil {
+			return err
+		}
+
+		query = s.filteredSQL() + " ORDER BY txid DESC LIMIT 1"
+	}
+
+	rows, err := database.Query(ctx, query, s.args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var previous map[string]interface{}
+	versions := 0
+
+	for rows.Next() {
+		var res map[string]interface{}
+		var status string
+
+		if err := rows.Scan(&res, &status); err != nil {
+			return err
+		}
+
+		versions++
+		versionID, lastUpdated := resourceMeta(res)
+		fmt.Printf("Version %s (%s at %s)\n", versionID, status, lastUpdated)
+
+		if status == "deleted" {
+			fmt.Println()
+			previous = nil
+			continue
+		}
+
+		res, _, err = doReverseTransform(res, fhirVersion)
+
+		if err != nil {
+			return err
+		}
+
+		if previous == nil {
+			out, err := jsoniter.MarshalIndent(res, "", "  ")
+
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(string(out))
+		} else {
+			changes := jsonDiff("", previous, res, nil)
+
+			if len(changes) == 0 {
+				fmt.Println("  no changes")
+			}
+
+			for _, c := range changes {
+				fmt.Println("  " + c)
+			}
+		}
+
+		fmt.Println()
+		previous = res
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if versions == 0 && at != "" {
+		return fmt.Errorf("%s/%s didn't exist at %s", rt, id, at)
+	}
+
+	if versions == 0 {
+		return fmt.Errorf("%s/%s not found", rt, id)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestParseHistory(t *testing.T) {
+	queries := []string{
+		"",
+		"_count=10&_offset=20",
+		"_since=2020-01-01T00:00:00Z&_count=5",
+		"_at=2020-01&_since=2019",
+	}
+
+	for _, layout := range []tableLayout{tablesLayout, partitionedLayout} {
+		for _, q := range queries {
+			params, _ := url.ParseQuery(q)
+			s := newHistory(layout, []string{"Observation", "Patient"}, "pt-1")
+
+			if err := parseHistory(s, params); err != nil {
+				t.Fatalf("%s: %v", q, err)
+			}
+
+			for _, sql := range []func() (string, []interface{}){s.SQL, s.CountSQL} {
+				query, args := sql()
+
+				if n := maxPlaceholder(query); n != len(args) {
+					t.Errorf("%s %s: %d placeholders and %d args: %s", layout, q, n, len(args), query)
+				}
+			}
+		}
+	}
+}
+
+func TestHistoryVersionWindow(t *testing.T) {
+	s := newHistory(tablesLayout, []string{"Patient"}, "pt-1")
+
+	// "+" of the time zone is decoded as a space in query strings
+	params, _ := url.ParseQuery("_at=2020-01-01T10:00:00+02:00&_since=2019")
+
+	if err := parseHistory(s, params); err != nil {
+		t.Fatal(err)
+	}
+
+	query, args := s.SQL()
+
+	// a version is current from its ts until ts of the next version
+	if !strings.Contains(query, "lead(ts) OVER (PARTITION BY resource_type, id ORDER BY txid) AS next_ts") {
+		t.Errorf("next version time is missing in %s", query)
+	}
+
+	expected := map[string]string{
+		"2020-01-01T10:00:00+02:00": "ts < %[1]s AND (next_ts IS NULL OR next_ts > %[2]s)",
+		"2019":                      "ts >= %[2]s",
+	}
+
+	for i, arg := range args {
+		format, ok := expected[fmt.Sprint(arg)]
+
+		if !ok {
+			continue
+		}
+
+		param := fmt.Sprintf("$%d::text", i+1)
+		cond := fmt.Sprintf(format, dateUpperSQL(param), dateLowerSQL(param))
+
+		if !strings.Contains(query, cond) {
+			t.Errorf("%v: %s is missing in %s", arg, cond, query)
+		}
+
+		delete(expected, fmt.Sprint(arg))
+	}
+
+	if len(expected) != 0 {
+		t.Errorf("args %v are missing in %v", expected, args)
+	}
+}
+
+func TestParseHistoryCountZero(t *testing.T) {
+	s := newHistory(tablesLayout, []string{"Patient"}, "")
+	params, _ := url.ParseQuery("_count=0")
+
+	if err := parseHistory(s, params); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.count != 0 || !s.total {
+		t.Errorf("_count=0 should ask for total only, got count %d and total %v", s.count, s.total)
+	}
+}
+
+func TestParseHistoryInvalid(t *testing.T) {
+	for _, q := range []string{"_count=-1", "_since=yesterday", "_at=2020/01/01"} {
+		s := newHistory(tablesLayout, []string{"Patient"}, "")
+		params, _ := url.ParseQuery(q)
+
+		if err := parseHistory(s, params); err == nil {
+			t.Errorf("%s: expected error", q)
+		}
+	}
+}
+
+func TestJSONDiff(t *testing.T) {
+	var a, b interface{}
+
+	jsoniter.UnmarshalFromString(`{
+		"id": "pt-1",
+		"meta": {"versionId": "1", "lastUpdated": "2020-01-01"},
+		"active": true,
+		"name": [{"family": "Smith", "given": ["John"]}],
+		"gender": "male"
+	}`, &a)
+	jsoniter.UnmarshalFromString(`{
+		"id": "pt-1",
+		"meta": {"versionId": "2", "lastUpdated": "2020-02-01"},
+		"name": [{"family": "Smith", "given": ["John", "Paul"]}],
+		"gender": "unknown",
+		"birthDate": "1970-01-01"
+	}`, &b)
+
+	expected := []string{
+		`- active: true`,
+		`+ birthDate: "1970-01-01"`,
+		`~ gender: "male" -> "unknown"`,
+		`+ name[0].given[1]: "Paul"`,
+	}
+
+	if changes := jsonDiff("", a, b, nil); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("got %q, want %q", changes, expected)
+	}
+}
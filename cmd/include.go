@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// maxIncludeDepth limits how many times _include:iterate and
+// _revinclude:iterate are applied to already included resources
+const maxIncludeDepth = 5
+
+// searchInclude is a parsed _include or _revinclude parameter
+// [source]:[param](:[target]), "*" stands for any source type or any
+// reference parameter
+type searchInclude struct {
+	rev     bool
+	iterate bool
+	source  string
+	param   string
+	target  string
+}
+
+// parseInclude parses value of _include or _revinclude parameter,
+// name is the parameter name with its modifier (i.e. _include:iterate).
+// It returns nil if the parameter is unknown and strict handling isn't
+// requested.
+func (a *restAPI) parseInclude(definitions searchParams, name string, value string, strict bool) (*searchInclude, error) {
+	paramName, modifier, _ := strings.Cut(name, ":")
+	inc := &searchInclude{rev: paramName == "_revinclude"}
+
+	switch modifier {
+	case "":
+	case "iterate", "recurse":
+		inc.iterate = true
+	default:
+		return nil, newSearchError("not-supported", "modifier :%s is not supported for %s", modifier, paramName)
+	}
+
+	if value == "*" && !inc.rev {
+		inc.source, inc.param = "*", "*"
+		return inc, nil
+	}
+
+	parts := strings.Split(value, ":")
+
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, newSearchError("invalid", "invalid %s value %s, expected [type]:[parameter] or [type]:[parameter]:[target type]", paramName, value)
+	}
+
+	inc.source, inc.param = parts[0], parts[1]
+
+	if len(parts) == 3 {
+		inc.target = parts[2]
+	}
+
+	unknown := !a.types[inc.source] || (inc.target != "" && !a.types[inc.target])
+
+	if inc.param != "*" {
+		param := definitions.Lookup(inc.source, inc.param)
+		unknown = unknown || param == nil || param.Type != "reference"
+	}
+
+	if unknown {
+		if strict {
+			return nil, newSearchError("not-supported", "unknown %s %s", paramName, value)
+		}
+
+		return nil, nil
+	}
+
+	return inc, nil
+}
+
+// referenceParams returns reference search parameters of the resource
+// type matching the include
+func (inc *searchInclude) referenceParams(definitions searchParams, rt string) []*searchParam {
+	if inc.source != "*" && inc.source != rt {
+		return nil
+	}
+
+	if inc.param != "*" {
+		return []*searchParam{definitions.Lookup(rt, inc.param)}
+	}
+
+	names := make([]string, 0)
+
+	for name, param := range definitions[rt] {
+		if param.Type == "reference" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	result := make([]*searchParam, 0, len(names))
+
+	for _, name := range names {
+		result = append(result, definitions[rt][name])
+	}
+
+	return result
+}
+
+// includeTargets returns resource types an included reference can point
+// to, limited to the types stored in the database
+func (a *restAPI) includeTargets(inc *searchInclude, param *searchParam) []string {
+	if inc.target != "" {
+		return []string{inc.target}
+	}
+
+	result := make([]string, 0, len(param.Target))
+
+	for _, t := range param.Target {
+		if a.types[t] {
+			result = append(result, t)
+		}
+	}
+
+	return result
+}
+
+// referenceTypeSQL returns SQL expression for resourceType of the
+// reference ref.v; references to single-target parameters may be
+// stored without resourceType
+func referenceTypeSQL(q *search, param *searchParam) string {
+	if len(param.Target) == 1 {
+		return fmt.Sprintf("coalesce(ref.v->>'resourceType', %s)", q.arg(param.Target[0]))
+	}
+
+	return "(ref.v->>'resourceType')"
+}
+
+// includeQueries returns queries selecting resources included by inc for
+// resources with provided ids (grouped by resource type)
+func (a *restAPI) includeQueries(tr map[string]interface{}, definitions searchParams, inc *searchInclude, ids map[string][]string) []*search {
+	result := make([]*search, 0)
+
+	// parameters often share paths (i.e. "patient" and "subject")
+	seen := make(map[string]bool)
+
+	for rt, rtIDs := range ids {
+		if inc.rev {
+			// resources of the source type referencing these ones
+			for _, param := range inc.referenceParams(definitions, inc.source) {
+				if inc.target != "" && inc.target != rt {
+					continue
+				}
+
+				if len(param.Target) > 0 && !slices.Contains(param.Target, rt) {
+					continue
+				}
+
+				for _, p := range param.Path {
+					key := rt + ":" + p
+
+					if seen[key] {
+						continue
+					}
+
+					seen[key] = true
+
+					q := &search{rt: inc.source}
+					q.query, q.args = a.layout.ResourceQuery(inc.source)
+					q.where = append(q.where, fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_path_query(resource, %s::jsonpath) AS ref(v) WHERE %s = %s AND ref.v->>'id' = ANY(%s::text[]))",
+						q.arg(searchJSONPath(tr, inc.source, p)), referenceTypeSQL(q, param), q.arg(rt), q.arg(rtIDs)))
+					result = append(result, q)
+				}
+			}
+
+			continue
+		}
+
+		// resources referenced by these ones
+		for _, param := range inc.referenceParams(definitions, rt) {
+			for _, target := range a.includeTargets(inc, param) {
+				for _, p := range param.Path {
+					key := rt + ":" + p + ":" + target
+
+					if seen[key] {
+						continue
+					}
+
+					seen[key] = true
+
+					q := &search{rt: target}
+					q.query, q.args = a.layout.ResourceQuery(target)
+					src := "true"
+
+					if a.layout == partitionedLayout {
+						src = "src.resource_type = " + q.arg(rt)
+					}
+
+					q.where = append(q.where, fmt.Sprintf("id IN (SELECT ref.v->>'id' FROM %s AS src, jsonb_path_query(src.resource, %s::jsonpath) AS ref(v) WHERE %s AND src.id = ANY(%s::text[]) AND %s = %s)",
+						a.layout.Table(rt), q.arg(searchJSONPath(tr, rt, p)), src, q.arg(rtIDs), referenceTypeSQL(q, param), q.arg(target)))
+					result = append(result, q)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// resolveIncludes returns resources included into search results by
+// _include and _revinclude parameters, matches are resource ids of the
+// search page. Includes with :iterate are applied to included resources
+// as well, until nothing new is found.
+func (a *restAPI) resolveIncludes(ctx context.Context, s *search, matches []string) ([]map[string]interface{}, error) {
+	if len(s.includes) == 0 || len(matches) == 0 {
+		return nil, nil
+	}
+
+	definitions, err := getSearchParams(a.fhirVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := getTransformData(a.fhirVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+
+	for _, id := range matches {
+		seen[s.rt+"/"+id] = true
+	}
+
+	result := make([]map[string]interface{}, 0)
+	current := map[string][]string{s.rt: matches}
+
+	for depth := 0; depth <= maxIncludeDepth && len(current) > 0; depth++ {
+		next := make(map[string][]string)
+
+		for _, inc := range s.includes {
+			if depth > 0 && !inc.iterate {
+				continue
+			}
+
+			for _, q := range a.includeQueries(tr, definitions, inc, current) {
+				rows, err := a.db.Query(ctx, q.filteredSQL(), q.args...)
+
+				if err != nil {
+					return nil, fmt.Errorf("cannot resolve includes: %v", err)
+				}
+
+				for rows.Next() {
+					var res map[string]interface{}
+
+					if err := rows.Scan(&res); err != nil {
+						rows.Close()
+						return nil, err
+					}
+
+					id, _ := res["id"].(string)
+					key := q.rt + "/" + id
+
+					if seen[key] {
+						continue
+					}
+
+					seen[key] = true
+					result = append(result, res)
+					next[q.rt] = append(next[q.rt], id)
+				}
+
+				rows.Close()
+
+				if err := rows.Err(); err != nil {
+					return nil, fmt.Errorf("cannot resolve includes: %v", err)
+				}
+			}
+		}
+
+		current = next
+	}
+
+	return result, nil
+}
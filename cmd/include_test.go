@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"net/url"
+	"testing"
+)
+
+func includeTestAPI(layout tableLayout) *restAPI {
+	return &restAPI{
+		layout:      layout,
+		fhirVersion: "4.0.0",
+		types:       map[string]bool{"Patient": true, "Observation": true, "Organization": true},
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	a := includeTestAPI(tablesLayout)
+	definitions, err := getSearchParams(a.fhirVersion)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		inc   searchInclude
+	}{
+		{"_include", "Observation:subject", searchInclude{source: "Observation", param: "subject"}},
+		{"_include", "Observation:subject:Patient", searchInclude{source: "Observation", param: "subject", target: "Patient"}},
+		{"_include:iterate", "Patient:organization", searchInclude{iterate: true, source: "Patient", param: "organization"}},
+		{"_include", "*", searchInclude{source: "*", param: "*"}},
+		{"_revinclude", "Observation:*", searchInclude{rev: true, source: "Observation", param: "*"}},
+	}
+
+	for _, tt := range tests {
+		inc, err := a.parseInclude(definitions, tt.name, tt.value, true)
+
+		if err != nil || inc == nil || *inc != tt.inc {
+			t.Errorf("%s=%s: got %+v, %v, want %+v", tt.name, tt.value, inc, err, tt.inc)
+		}
+	}
+
+	for _, value := range []string{"Observation:code", "Encounter:subject", "Observation:subject:Device"} {
+		if inc, err := a.parseInclude(definitions, "_include", value, false); inc != nil || err != nil {
+			t.Errorf("%s: unknown include should be ignored, got %+v, %v", value, inc, err)
+		}
+
+		if _, err := a.parseInclude(definitions, "_include", value, true); err == nil {
+			t.Errorf("%s: expected error with strict handling", value)
+		}
+	}
+
+	for _, tt := range [][2]string{{"_include:deep", "Observation:subject"}, {"_include", "Observation"}, {"_revinclude", "*"}} {
+		if _, err := a.parseInclude(definitions, tt[0], tt[1], false); err == nil {
+			t.Errorf("%s=%s: expected error", tt[0], tt[1])
+		}
+	}
+}
+
+func TestIncludeQueries(t *testing.T) {
+	for _, layout := range []tableLayout{tablesLayout, partitionedLayout} {
+		a := includeTestAPI(layout)
+		definitions, _ := getSearchParams(a.fhirVersion)
+		tr, _ := getTransformData(a.fhirVersion)
+
+		tests := []struct {
+			name   string
+			value  string
+			ids    map[string][]string
+			target string
+		}{
+			// subject can reference Group, Device and Location too, but
+			// they aren't stored in the database
+			{"_include", "Observation:subject", map[string][]string{"Observation": {"obs-1"}}, "Patient"},
+			{"_revinclude", "Observation:subject", map[string][]string{"Patient": {"pt-1", "pt-2"}}, "Observation"},
+			{"_include", "Observation:subject", map[string][]string{"Patient": {"pt-1"}}, ""},
+		}
+
+		for _, tt := range tests {
+			inc, err := a.parseInclude(definitions, tt.name, tt.value, true)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			queries := a.includeQueries(tr, definitions, inc, tt.ids)
+
+			if (len(queries) > 0) != (tt.target != "") {
+				t.Errorf("%s %s=%s: got %d queries", layout, tt.name, tt.value, len(queries))
+			}
+
+			for _, q := range queries {
+				if q.rt != tt.target {
+					t.Errorf("%s %s=%s: got query for %s, want %s", layout, tt.name, tt.value, q.rt, tt.target)
+				}
+
+				query, args := q.filteredSQL(), q.args
+
+				if n := maxPlaceholder(query); n != len(args) {
+					t.Errorf("%s %s=%s: %d placeholders and %d args: %s", layout, tt.name, tt.value, n, len(args), query)
+				}
+			}
+		}
+	}
+}
+
+func TestSearchIncludes(t *testing.T) {
+	params, _ := url.ParseQuery("_include=Patient:organization&_revinclude:iterate=Observation:subject&name=smith")
+	s, err := includeTestAPI(tablesLayout).parseSearch("Patient", params, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.includes) != 2 {
+		t.Fatalf("got %d includes, want 2", len(s.includes))
+	}
+
+	for _, inc := range s.includes {
+		if inc.rev != inc.iterate {
+			t.Errorf("modifiers are mixed up: %+v", inc)
+		}
+	}
+}
@@ -55,7 +55,16 @@ Creates SQL schema (tables, types and stored procedures) to store
 resources from FHIR version specified with "--fhir" flag. Database
 where schema will be created is specified with "--db" flag. Specified
 database should be empty, otherwise command may fail with an SQL
-error.`,
+error.
+
+By default every resource type gets its own table (i.e. "patient" and
+"patient_history"). With "--layout=partitioned" all resources are
+stored in a single "resource" table partitioned by resource_type (and
+history in "resource_history" partitioned the same way), which makes
+cross-type queries a single scan. Resources of types unknown to the
+schema go to the default partition. A view named after every resource
+type is created as well, so queries like "SELECT * FROM patient" work
+with both layouts. Other commands detect the layout automatically.`,
 
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := cmd.Context()
@@ -78,7 +87,7 @@ func init() {
 }
 
 // PerformInit actually performs init operation
-func PerformInit(db *pgxpool.Pool, fhirVersion string, cb initProgressCb) error {
+func PerformInit(db *pgxpool.Pool, fhirVersion string, layout tableLayout, cb initProgressCb) error {
 
 	var schemaStatements []string
 	var functionStatements []string
@@ -114,6 +123,25 @@ func PerformInit(db *pgxpool.Pool, fhirVersion string, cb initProgressCb) error
 		return wrapsError
 	}
 
+	if layout == partitionedLayout {
+		var partitionedFunctions []string
+
+		functions, err := schemaFS.ReadFile("schema/functions-partitioned.sql.json")
+
+		if err != nil {
+			return fmt.Errorf("Cannot find fhirbase function definitions for partitioned layout")
+		}
+
+		err = jsoniter.Unmarshal(functions, &partitionedFunctions)
+
+		if err != nil {
+			return fmt.Errorf("Cannot parse function definitions for partitioned layout")
+		}
+
+		schemaStatements = partitionedSchemaStatements(schemaStatements)
+		functionStatements = append(functionStatements, partitionedFunctions...)
+	}
+
 	allStmts := append(schemaStatements, functionStatements...)
 	allStmts = append(allStmts, conceptsTables...)
 
@@ -158,6 +186,18 @@ func InitCommand(ctx context.Context) {
 		return
 	}
 
+	layout := tablesLayout
+
+	if name := viper.GetString("layout"); name != "" {
+		var err error
+		layout, err = parseTableLayout(name)
+
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
 	conn, err := db.GetPgxConnectionConfig()
 
 	if err != nil {
@@ -170,7 +210,7 @@ func InitCommand(ctx context.Context) {
 
 	bar := progressbar.NewOptions(100, progressbar.OptionSetWriter(ansi.NewAnsiStdout()), progressbar.OptionShowBytes(true))
 
-	err = PerformInit(database, fhirVersion, func(curIdx int, total int64, duration time.Duration) {
+	err = PerformInit(database, fhirVersion, layout, func(curIdx int, total int64, duration time.Duration) {
 		if curIdx%10 == 0 {
 			bar.Add(10)
 		}
@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+// tableLayout describes how resources are laid out in the database
+type tableLayout string
+
+const (
+	// tablesLayout keeps every resource type in its own table
+	// (patient, patient_history, observation, ...)
+	tablesLayout tableLayout = "tables"
+
+	// partitionedLayout keeps all resources in a single "resource"
+	// table partitioned by resource_type, and all history in a single
+	// "resource_history" table partitioned the same way
+	partitionedLayout tableLayout = "partitioned"
+)
+
+var matchResourceTable = regexp.MustCompile(`(?s)^CREATE TABLE IF NOT EXISTS "([a-z0-9_]+)" \(.*resource_type text default '([A-Za-z0-9]+)'`)
+
+func parseTableLayout(name string) (tableLayout, error) {
+	switch tableLayout(name) {
+	case tablesLayout, partitionedLayout:
+		return tableLayout(name), nil
+	}
+
+	return "", fmt.Errorf("invalid value for --layout flag. Possible values are either '%s' or '%s'", tablesLayout, partitionedLayout)
+}
+
+// detectTableLayout returns layout provided with "--layout" flag, or
+// figures it out from the database schema if the flag isn't set
+func detectTableLayout(ctx context.Context, db *pgxpool.Pool) (tableLayout, error) {
+	if name := viper.GetString("layout"); name != "" {
+		return parseTableLayout(name)
+	}
+
+	var partitioned bool
+
+	err := db.QueryRow(ctx, "SELECT to_regclass('resource') IS NOT NULL").Scan(&partitioned)
+
+	if err != nil {
+		return "", fmt.Errorf("cannot detect table layout: %v", err)
+	}
+
+	if partitioned {
+		return partitionedLayout, nil
+	}
+
+	return tablesLayout, nil
+}
+
+// TableName returns name of the table holding resources of the
+// provided type
+func (l tableLayout) TableName(resourceType string) string {
+	if l == partitionedLayout {
+		return "resource"
+	}
+
+	return strings.ToLower(resourceType)
+}
+
+// HistoryTableName returns name of the table holding previous versions
+// of resources of the provided type
+func (l tableLayout) HistoryTableName(resourceType string) string {
+	if l == partitionedLayout {
+		return "resource_history"
+	}
+
+	return strings.ToLower(resourceType) + "_history"
+}
+
+// Table returns quoted SQL identifier of the table from TableName
+func (l tableLayout) Table(resourceType string) string {
+	return pgx.Identifier{l.TableName(resourceType)}.Sanitize()
+}
+
+// HistoryTable returns quoted SQL identifier of the table from
+// HistoryTableName
+func (l tableLayout) HistoryTable(resourceType string) string {
+	return pgx.Identifier{l.HistoryTableName(resourceType)}.Sanitize()
+}
+
+// ConflictTarget returns columns of the primary key of the resource
+// tables
+func (l tableLayout) ConflictTarget() string {
+	if l == partitionedLayout {
+		return "(resource_type, id)"
+	}
+
+	return "(id)"
+}
+
+// CopyColumns returns column names for COPY FROM into resource table
+func (l tableLayout) CopyColumns() []string {
+	if l == partitionedLayout {
+		return []string{"id", "txid", "status", "resource_type", "resource"}
+	}
+
+	return []string{"id", "txid", "status", "resource"}
+}
+
+// CopyValues returns row values matching columns from CopyColumns
+func (l tableLayout) CopyValues(resourceType string, id string, txid int64, status string, res interface{}) []interface{} {
+	if l == partitionedLayout {
+		return []interface{}{id, txid, status, resourceType, res}
+	}
+
+	return []interface{}{id, txid, status, res}
+}
+
+// InsertQuery returns INSERT statement which ignores already existing
+// resources, see InsertArgs for its parameters. Resources without id
+// get a random one.
+func (l tableLayout) InsertQuery(resourceType string) string {
+	if l == partitionedLayout {
+		return "INSERT INTO resource (id, txid, status, resource_type, resource) VALUES (coalesce($1, gen_random_uuid()::text), 0, 'created', $2, $3) ON CONFLICT (resource_type, id) DO NOTHING"
+	}
+
+	return fmt.Sprintf(
+		"INSERT INTO %s (id, txid, status, resource) VALUES (coalesce($1, gen_random_uuid()::text), 0, 'created', $2) ON CONFLICT (id) DO NOTHING",
+		l.Table(resourceType),
+	)
+}
+
+// InsertArgs returns parameters for the statement from InsertQuery, id
+// should be nil if resource has no id
+func (l tableLayout) InsertArgs(resourceType string, id interface{}, res interface{}) []interface{} {
+	if l == partitionedLayout {
+		return []interface{}{id, resourceType, res}
+	}
+
+	return []interface{}{id, res}
+}
+
+// partitionedSchemaStatements converts table-per-resource schema into
+// the partitioned one. Resource types are taken from CREATE TABLE
+// statements of the original schema, every type gets its own
+// partition and a view named after the type, so queries like "SELECT *
+// FROM patient" keep working. Resources of types not known to the
+// schema end up in default partitions.
+func partitionedSchemaStatements(schemaStatements []string) []string {
+	result := make([]string, 0, len(schemaStatements))
+	partitions := make([]string, 0, len(schemaStatements)*2)
+
+	for _, stmt := range schemaStatements {
+		m := matchResourceTable.FindStringSubmatch(stmt)
+
+		if m == nil {
+			result = append(result, stmt)
+			continue
+		}
+
+		if strings.HasSuffix(m[1], "_history") {
+			continue
+		}
+
+		tbl, rt := m[1], m[2]
+
+		partitions = append(partitions,
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "resource_%s" PARTITION OF resource FOR VALUES IN ('%s');`, tbl, rt),
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "resource_history_%s" PARTITION OF resource_history FOR VALUES IN ('%s');`, tbl, rt),
+			fmt.Sprintf(`CREATE OR REPLACE VIEW "%s" AS SELECT * FROM resource WHERE resource_type = '%s';`, tbl, rt),
+			fmt.Sprintf(`CREATE OR REPLACE VIEW "%s_history" AS SELECT * FROM resource_history WHERE resource_type = '%s';`, tbl, rt))
+	}
+
+	result = append(result, `CREATE TABLE IF NOT EXISTS resource (
+  id text not null,
+  txid bigint not null,
+  ts timestamptz DEFAULT current_timestamp,
+  resource_type text not null,
+  status resource_status not null,
+  resource jsonb not null,
+  PRIMARY KEY (resource_type, id)
+) PARTITION BY LIST (resource_type);`,
+		`CREATE TABLE IF NOT EXISTS resource_history (
+  id text not null,
+  txid bigint not null,
+  ts timestamptz DEFAULT current_timestamp,
+  resource_type text not null,
+  status resource_status not null,
+  resource jsonb not null,
+  PRIMARY KEY (resource_type, id, txid)
+) PARTITION BY LIST (resource_type);`,
+		"CREATE TABLE IF NOT EXISTS resource_default PARTITION OF resource DEFAULT;",
+		"CREATE TABLE IF NOT EXISTS resource_history_default PARTITION OF resource_history DEFAULT;")
+
+	return append(result, partitions...)
+}
+
+// resourceJSONExpr builds complete resource from a resource table row,
+// the same way _fhirbase_to_resource function does
+const resourceJSONExpr = `resource || jsonb_build_object(
+  'resourceType', resource_type,
+  'id', id,
+  'meta', coalesce(resource->'meta', '{}'::jsonb) || jsonb_build_object(
+    'lastUpdated', ts,
+    'versionId', txid::text))`
+
+var matchTypeLiteral = regexp.MustCompile(`'([A-Za-z0-9]+)'`)
+
+// ResourceQuery returns SELECT statement for complete resources of the
+// provided type along with its parameters. More conditions can be
+// appended with AND, their parameters start with $<len(args)+1>.
+func (l tableLayout) ResourceQuery(resourceType string) (string, []interface{}) {
+	if l == partitionedLayout {
+		return fmt.Sprintf("SELECT %s FROM resource WHERE resource_type = $1", resourceJSONExpr), []interface{}{resourceType}
+	}
+
+	return fmt.Sprintf("SELECT %s FROM %s WHERE true", resourceJSONExpr, l.Table(resourceType)), []interface{}{}
+}
+
+// HistoryQuery returns SELECT statement for the provided columns of
+// previous versions of resources of the provided type, it can be
+// extended the same way as the statement from ResourceQuery
+func (l tableLayout) HistoryQuery(resourceType string, columns string) (string, []interface{}) {
+	if l == partitionedLayout {
+		return fmt.Sprintf("SELECT %s FROM resource_history WHERE resource_type = $1", columns), []interface{}{resourceType}
+	}
+
+	return fmt.Sprintf("SELECT %s FROM %s WHERE true", columns, l.HistoryTable(resourceType)), []interface{}{}
+}
+
+// VersionsQuery returns SELECT statement for all versions of resources
+// of the provided types: current ones from resource tables and previous
+// ones from history tables, with id, txid, ts, resource_type, status
+// and resource columns
+func (l tableLayout) VersionsQuery(resourceTypes []string) (string, []interface{}) {
+	columns := "id, txid, ts, resource_type, status::text AS status, resource"
+
+	if l == partitionedLayout {
+		return fmt.Sprintf("SELECT %[1]s FROM resource WHERE resource_type = ANY($1::text[]) UNION ALL SELECT %[1]s FROM resource_history WHERE resource_type = ANY($1::text[])", columns),
+			[]interface{}{resourceTypes}
+	}
+
+	selects := make([]string, 0, len(resourceTypes)*2)
+
+	for _, rt := range resourceTypes {
+		selects = append(selects,
+			fmt.Sprintf("SELECT %s FROM %s", columns, l.Table(rt)),
+			fmt.Sprintf("SELECT %s FROM %s", columns, l.HistoryTable(rt)))
+	}
+
+	return strings.Join(selects, " UNION ALL "), []interface{}{}
+}
+
+// ResourceTypes returns resource types which have tables (or
+// partitions) in the database
+func (l tableLayout) ResourceTypes(ctx context.Context, db *pgxpool.Pool) ([]string, error) {
+	query := `SELECT column_default FROM information_schema.columns
+WHERE table_schema = current_schema() AND column_name = 'resource_type'
+AND table_name NOT LIKE '%\_history' AND column_default IS NOT NULL
+ORDER BY table_name`
+
+	if l == partitionedLayout {
+		query = `SELECT pg_get_expr(c.relpartbound, c.oid) FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'resource'::regclass ORDER BY c.relname`
+	}
+
+	rows, err := db.Query(ctx, query)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot list resource types: %v", err)
+	}
+
+	defer rows.Close()
+
+	types := make([]string, 0)
+
+	for rows.Next() {
+		var expr string
+
+		if err := rows.Scan(&expr); err != nil {
+			return nil, err
+		}
+
+		if m := matchTypeLiteral.FindStringSubmatch(expr); m != nil {
+			types = append(types, m[1])
+		}
+	}
+
+	return types, rows.Err()
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseTableLayout(t *testing.T) {
+	for _, name := range []string{"tables", "partitioned"} {
+		if l, err := parseTableLayout(name); err != nil || string(l) != name {
+			t.Errorf("%s: got %q, %v", name, l, err)
+		}
+	}
+
+	if _, err := parseTableLayout("single"); err == nil {
+		t.Error("expected error for unknown layout")
+	}
+}
+
+func TestDetectTableLayoutFlag(t *testing.T) {
+	viper.Set("layout", "partitioned")
+	defer viper.Set("layout", "")
+
+	// the database isn't queried when the layout is set explicitly
+	if l, err := detectTableLayout(context.Background(), nil); err != nil || l != partitionedLayout {
+		t.Errorf("got %q, %v", l, err)
+	}
+}
+
+func TestTableLayoutQueries(t *testing.T) {
+	tests := []struct {
+		layout  tableLayout
+		table   string
+		history string
+	}{
+		{tablesLayout, `"patient"`, `"patient_history"`},
+		{partitionedLayout, `"resource"`, `"resource_history"`},
+	}
+
+	for _, tt := range tests {
+		if table := tt.layout.Table("Patient"); table != tt.table {
+			t.Errorf("%s: got table %s, want %s", tt.layout, table, tt.table)
+		}
+
+		if history := tt.layout.HistoryTable("Patient"); history != tt.history {
+			t.Errorf("%s: got history table %s, want %s", tt.layout, history, tt.history)
+		}
+
+		if columns, values := tt.layout.CopyColumns(), tt.layout.CopyValues("Patient", "pt-1", 1, "created", "{}"); len(columns) != len(values) {
+			t.Errorf("%s: %d COPY columns and %d values", tt.layout, len(columns), len(values))
+		}
+
+		query, args := tt.layout.InsertQuery("Patient"), tt.layout.InsertArgs("Patient", "pt-1", "{}")
+
+		if n := maxPlaceholder(query); n != len(args) {
+			t.Errorf("%s: INSERT has %d placeholders and %d args: %s", tt.layout, n, len(args), query)
+		}
+
+		if !strings.Contains(query, "ON CONFLICT "+tt.layout.ConflictTarget()) {
+			t.Errorf("%s: INSERT doesn't use conflict target %s: %s", tt.layout, tt.layout.ConflictTarget(), query)
+		}
+
+		query, args = tt.layout.ResourceQuery("Patient")
+
+		if n := maxPlaceholder(query); n != len(args) {
+			t.Errorf("%s: resource query has %d placeholders and %d args: %s", tt.layout, n, len(args), query)
+		}
+
+		query, args = tt.layout.VersionsQuery([]string{"Patient", "Observation"})
+
+		if n := maxPlaceholder(query); n != len(args) {
+			t.Errorf("%s: versions query has %d placeholders and %d args: %s", tt.layout, n, len(args), query)
+		}
+	}
+}
+
+func TestPartitionedSchemaStatements(t *testing.T) {
+	schema := []string{
+		"CREATE EXTENSION IF NOT EXISTS pgcrypto;",
+		`CREATE TABLE IF NOT EXISTS "patient" (
+  id text primary key,
+  resource_type text default 'Patient',
+  resource jsonb not null
+);`,
+		`CREATE TABLE IF NOT EXISTS "patient_history" (
+  id text,
+  resource_type text default 'Patient',
+  resource jsonb not null
+);`,
+	}
+
+	stmts := partitionedSchemaStatements(schema)
+
+	if stmts[0] != schema[0] {
+		t.Errorf("statements other than resource tables should be kept, got %q", stmts[0])
+	}
+
+	expected := []string{
+		`CREATE TABLE IF NOT EXISTS "resource_patient" PARTITION OF resource FOR VALUES IN ('Patient');`,
+		`CREATE TABLE IF NOT EXISTS "resource_history_patient" PARTITION OF resource_history FOR VALUES IN ('Patient');`,
+		`CREATE OR REPLACE VIEW "patient" AS SELECT * FROM resource WHERE resource_type = 'Patient';`,
+		`CREATE OR REPLACE VIEW "patient_history" AS SELECT * FROM resource_history WHERE resource_type = 'Patient';`,
+	}
+
+	// partitions go after the partitioned tables they belong to
+	if partitions := stmts[len(stmts)-len(expected):]; !reflect.DeepEqual(partitions, expected) {
+		t.Errorf("got partitions %q, want %q", partitions, expected)
+	}
+
+	for _, stmt := range stmts {
+		if strings.Contains(stmt, `TABLE IF NOT EXISTS "patient`) {
+			t.Errorf("table per resource statement left in partitioned schema: %s", stmt)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"text/tabwriter"
 
 	"compress/gzip"
@@ -50,10 +51,12 @@ type bundle interface {
 	Count() int
 }
 
-type loaderCb func(curType string, duration time.Duration)
+// loaderCb is called for every loaded resource with transformation
+// warnings collected for it (if any)
+type loaderCb func(curType string, duration time.Duration, warnings transformErrors)
 
 type loader interface {
-	Load(ctx context.Context, db *pgxpool.Pool, bndl bundle, cb loaderCb) error
+	Load(ctx context.Context, db *pgxpool.Pool, layout tableLayout, bndl bundle, cb loaderCb) error
 }
 
 type copyFromBundleSource struct {
@@ -64,6 +67,8 @@ type copyFromBundleSource struct {
 	currentRt   string
 	prevTime    time.Time
 	fhirVersion string
+	strict      bool
+	layout      tableLayout
 }
 
 type singleResourceBundle struct {
@@ -78,6 +83,13 @@ type ndjsonBundle struct {
 	curline int
 }
 
+// streamBundle reads NDJSON from a stream, like a response body of
+// Bulk Data file, number of resources isn't known upfront
+type streamBundle struct {
+	reader  *bufio.Reader
+	curline int
+}
+
 type fhirBundle struct {
 	count   int
 	file    *bundleFile
@@ -86,10 +98,12 @@ type fhirBundle struct {
 }
 type copyLoader struct {
 	fhirVersion string
+	strict      bool
 }
 
 type insertLoader struct {
 	fhirVersion string
+	strict      bool
 }
 
 type multifileBundle struct {
@@ -130,9 +144,21 @@ file name extensions can be ommited, because Fhirbase analyzes file
 content, not the file name.
 
 If Bulk Data URL was provided, Fhirbase will download NDJSON files
-first (see the help for "bulkget" command) and then load them as a
-regular local files. Load command accepts all the command-line flags
-accepted by bulkget command.
+into a temporary directory (see the help for "bulkget" command) and
+load every file as soon as it's downloaded, while other files are
+still being downloaded. Loaded files are removed right away. Load
+command accepts all the command-line flags accepted by bulkget
+command, except "--resume".
+
+With "--stream" flag Bulk Data files aren't saved to disk at all:
+every download worker (see "--numdl") feeds the response body straight
+into the database, so several files are loaded concurrently. Resources
+are read from the network only as fast as PostgreSQL accepts them, so
+memory usage stays low regardless of file sizes. If a download fails,
+the file is loaded again from the start; use it with copy mode (which
+loads every file in a single COPY) or insert mode (which ignores
+already loaded resources). Deleted resources and errors are still
+downloaded into a temporary directory, they are small.
 
 Fhirbase reads input files sequentially, reading single resource at a
 time. And because of PostgreSQL traits it's important if Fhirbase gets
@@ -161,7 +187,23 @@ occurrences.
 Copy mode is intended to be used only with grouped inputs. When
 applied to grouped inputs, it's almost 3 times faster than insert
 mode. But it's same slower if it's being applied to non-grouped
-input.`,
+input.
+
+If some element of a resource cannot be transformed (for instance, a
+Reference given as a plain string), Fhirbase keeps the element
+unchanged and reports a warning with the JSON path of the element.
+Number of warnings per resource type is printed when load finishes.
+Use "--strict" flag to stop loading on the first such resource
+instead.
+
+When loading a directory downloaded with bulkget, files from its
+"errors" subdirectory are skipped. Bundles from the "deleted"
+subdirectory are applied after all other files: every resource listed
+in them is deleted and its last version is kept in the history table
+with "deleted" status.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindCommandFlags(cmd, append(append(authFlags, exportFlags...), "numdl", "accept-header", "retries", "stream", "poll-timeout")...)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := cmd.Context()
 		if len(args) == 0 {
@@ -169,7 +211,11 @@ input.`,
 			return
 		}
 
-		LoadCommand(ctx, args)
+		if err := LoadCommand(ctx, args); err != nil {
+			fmt.Printf("Error loading resources: %v\n", err)
+			return
+		}
+
 		fmt.Println("done")
 
 	},
@@ -201,10 +247,14 @@ func init() {
 	loadCmd.PersistentFlags().BoolVarP(&LoadConnectionConfig.Memusage, "memusage", "", false, "memory usage")
 	loadCmd.PersistentFlags().StringVarP(&LoadConnectionConfig.AcceptHeader, "accept-header", "", "application/fhir+json", "Value for Accept HTTP header (should be application/ndjson for Cerner, application/fhir+json for Smart)")
 
+	loadCmd.PersistentFlags().Int("retries", 5, "Number of retries for every file download")
+	loadCmd.PersistentFlags().Duration("poll-timeout", 24*time.Hour, "How long to wait for the server to prepare the export, 0 to wait forever")
+	loadCmd.PersistentFlags().Bool("stream", false, "Stream Bulk Data files straight into the database without saving them to disk")
+	addAuthFlags(loadCmd)
+	addExportFlags(loadCmd)
+
 	viper.BindPFlag("mode", loadCmd.PersistentFlags().Lookup("mode"))
-	viper.BindPFlag("numdl", loadCmd.PersistentFlags().Lookup("numdl"))
 	viper.BindPFlag("memusage", loadCmd.PersistentFlags().Lookup("memusage"))
-	viper.BindPFlag("accept-header", loadCmd.PersistentFlags().Lookup("accept-header"))
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// loadCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -341,7 +391,7 @@ func guessBundleType(f io.Reader) (bundleType, error) {
 		strings.NewReader(secondLine), rdr))
 }
 
-func newCopyFromBundleSource(bndl bundle, fhirVersion string, cb loaderCb) *copyFromBundleSource {
+func newCopyFromBundleSource(bndl bundle, fhirVersion string, strict bool, layout tableLayout, cb loaderCb) *copyFromBundleSource {
 	s := new(copyFromBundleSource)
 
 	s.bndl = bndl
@@ -355,6 +405,8 @@ func newCopyFromBundleSource(bndl bundle, fhirVersion string, cb loaderCb) *copy
 	s.currentRt = rt
 	s.prevTime = time.Now()
 	s.fhirVersion = fhirVersion
+	s.strict = strict
+	s.layout = layout
 
 	return s
 }
@@ -405,7 +457,7 @@ func (s *copyFromBundleSource) Values() ([]interface{}, error) {
 		res := s.res
 		s.res = nil
 
-		res, err := doTransform(res, s.fhirVersion)
+		res, warnings, err := doTransform(res, s.fhirVersion, s.strict)
 
 		if err != nil {
 			return nil, fmt.Errorf("Error transforming resource: %v", err)
@@ -420,9 +472,9 @@ func (s *copyFromBundleSource) Values() ([]interface{}, error) {
 		d := time.Since(s.prevTime)
 		s.prevTime = time.Now()
 
-		s.cb(s.currentRt, d)
+		s.cb(s.currentRt, d, warnings)
 
-		return []interface{}{id, 0, "created", res}, nil
+		return s.layout.CopyValues(s.currentRt, id, 0, "created", res), nil
 	}
 
 	return nil, fmt.Errorf("No resource in the source")
@@ -602,6 +654,45 @@ func newNdjsonBundle(f *bundleFile) (*ndjsonBundle, error) {
 
 	return &result, nil
 }
+func newStreamBundle(r io.Reader) *streamBundle {
+	return &streamBundle{reader: bufio.NewReader(r)}
+}
+
+func (b *streamBundle) Count() int {
+	return 0
+}
+
+func (b *streamBundle) Close() {
+}
+
+func (b *streamBundle) Next() (map[string]interface{}, error) {
+	for {
+		line, err := b.reader.ReadBytes('\n')
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		b.curline++
+
+		var res map[string]interface{}
+
+		if err := jsoniter.ConfigFastest.Unmarshal(line, &res); err != nil {
+			return nil, fmt.Errorf("cannot parse resource at line %d: %v", b.curline, err)
+		}
+
+		return res, nil
+	}
+}
+
 func newMultifileBundle(fileNames []string) (*multifileBundle, error) {
 	var result multifileBundle
 	result.bundles = make([]bundle, 0, len(fileNames))
@@ -661,7 +752,7 @@ func (b *multifileBundle) Count() int {
 func (b *multifileBundle) Close() {
 	for _, bndl := range b.bundles {
 		if bndl != nil {
-			b.Close()
+			bndl.Close()
 		}
 	}
 
@@ -764,13 +855,13 @@ func countEntriesInBundle(iter *jsoniter.Iterator) (int, error) {
 	return count, nil
 }
 
-func (l *copyLoader) Load(ctx context.Context, db *pgxpool.Pool, bndl bundle, cb loaderCb) error {
-	src := newCopyFromBundleSource(bndl, l.fhirVersion, cb)
+func (l *copyLoader) Load(ctx context.Context, db *pgxpool.Pool, layout tableLayout, bndl bundle, cb loaderCb) error {
+	src := newCopyFromBundleSource(bndl, l.fhirVersion, l.strict, layout, cb)
 
 	for src.ResourceType() != "" {
-		tableName := strings.ToLower(src.ResourceType())
+		tableName := layout.TableName(src.ResourceType())
 
-		_, err := db.CopyFrom(context.Background(), pgx.Identifier{tableName}, []string{"id", "txid", "status", "resource"}, src)
+		_, err := db.CopyFrom(ctx, pgx.Identifier{tableName}, layout.CopyColumns(), src)
 
 		if err != nil {
 			return fmt.Errorf("Error copying data to %s: %v", tableName, err)
@@ -793,7 +884,7 @@ func (l *copyLoader) Load(ctx context.Context, db *pgxpool.Pool, bndl bundle, cb
 //	func (j *JSONValue) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
 //	    return jsoniter.Unmarshal(src, j)
 //	}
-func (l *insertLoader) Load(ctx context.Context, db *pgxpool.Pool, bndl bundle, cb loaderCb) error {
+func (l *insertLoader) Load(ctx context.Context, db *pgxpool.Pool, layout tableLayout, bndl bundle, cb loaderCb) error {
 	file, err := os.OpenFile("output.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatal(err)
@@ -820,8 +911,12 @@ func (l *insertLoader) Load(ctx context.Context, db *pgxpool.Pool, bndl bundle,
 			return fmt.Errorf("Error retrieving next resource: %v", err)
 		}
 
-		transformedResource, err := doTransform(resource, l.fhirVersion)
+		transformedResource, warnings, err := doTransform(resource, l.fhirVersion, l.strict)
 		if err != nil {
+			if l.strict {
+				return fmt.Errorf("Error during FB transform: %v", err)
+			}
+
 			fmt.Printf("Error during FB transform: %v\n", err)
 			continue
 		}
@@ -832,36 +927,15 @@ func (l *insertLoader) Load(ctx context.Context, db *pgxpool.Pool, bndl bundle,
 			return fmt.Errorf("Error marshaling transformed resource: %v", err)
 		}
 		resourceType, _ := resource["resourceType"].(string)
-		tblName := strings.ToLower(resourceType)
-		id, ok := resource["id"].(string)
-
-		var query string
-		var args []interface{} = make([]interface{}, 2)
-		var numberOfArgs int = 0
-		if !ok || id == "" {
-			query = fmt.Sprintf(
-				"INSERT INTO %s (id, txid, status, resource) VALUES (gen_random_uuid()::text, 0, 'created', $1) ON CONFLICT (id) DO NOTHING",
-				tblName,
-			)
-			args[0] = string(resourceJSON)
-			numberOfArgs = len(args)
+		var id interface{}
 
-		} else {
-			query = fmt.Sprintf(
-				"INSERT INTO %s (id, txid, status, resource) VALUES ($1, 0, 'created', $2) ON CONFLICT (id) DO NOTHING",
-				tblName,
-			)
-			args[0] = id
-			args[1] = string(resourceJSON)
-			numberOfArgs = len(args)
-			// Use provided `id` and ensure 2 placeholders are used
-			// batch.Queue(
-			// 	fmt.Sprintf(
-			// 		"INSERT INTO %s (id, txid, status, resource) VALUES ($1, 0, 'created', $2) ON CONFLICT (id) DO NOTHING",
-			// 		tblName),
-			// 	[]interface{}{id, transformedResource},
-			// )
+		if idStr, ok := resource["id"].(string); ok && idStr != "" {
+			id = idStr
 		}
+
+		query := layout.InsertQuery(resourceType)
+		args := layout.InsertArgs(resourceType, id, string(resourceJSON))
+		numberOfArgs := len(args)
 		// Log query and args
 		// fmt.Printf("Queuing Query: %s\n", query)
 		// fmt.Printf("With Arguments: %v\n", args)
@@ -869,7 +943,7 @@ func (l *insertLoader) Load(ctx context.Context, db *pgxpool.Pool, bndl bundle,
 			return fmt.Errorf("No arguments provided for query: %s", query)
 		}
 		// Add to batch
-		batch.Queue(query, args)
+		batch.Queue(query, args...)
 		// check to see if the this entry in the batch has an equal number of arguments to numberOfArgs
 
 		thisQuery := batch.QueuedQueries[len(batch.QueuedQueries)-1]
@@ -883,21 +957,18 @@ func (l *insertLoader) Load(ctx context.Context, db *pgxpool.Pool, bndl bundle,
 		}
 
 		if curResource%batchSize == 0 || curResource == totalCount-1 {
-			conn, err := db.Acquire(ctx)
-			if err != nil {
-				return fmt.Errorf("Error acquiring connection: %v", err)
-			}
-
+			// batch is sent over the connection acquired above, acquiring
+			// another one could exhaust the pool when several loads
+			// run concurrently
 			br := conn.Conn().SendBatch(ctx, batch)
 			if err := br.Close(); err != nil {
 				return fmt.Errorf("Error closing batch: %v", err)
 			}
 			batch = &pgx.Batch{}
-			conn.Release()
 		}
 
 		curResource++
-		cb(resourceType, time.Since(startTime))
+		cb(resourceType, time.Since(startTime), warnings)
 	}
 
 	if batch != nil {
@@ -922,7 +993,13 @@ func prewalkDirs(fileNames []string) ([]string, error) {
 			return nil, err
 		case fi.IsDir():
 			err = filepath.Walk(fn, func(path string, info os.FileInfo, err error) error {
-				if err == nil && !info.IsDir() {
+				// errors reported by Bulk Data server aren't resources
+				// to load
+				if err == nil && info.IsDir() && info.Name() == bulkErrorsDir && path != fn {
+					return filepath.SkipDir
+				}
+
+				if err == nil && !info.IsDir() && !strings.HasPrefix(info.Name(), bulkManifestFileName) {
 					result = append(result, path)
 				}
 
@@ -940,6 +1017,95 @@ func prewalkDirs(fileNames []string) ([]string, error) {
 	return result, nil
 }
 
+// splitDeletionFiles separates files from "deleted" directory of
+// Bulk Data export from the files with resources
+func splitDeletionFiles(files []string) ([]string, []string) {
+	resourceFiles := make([]string, 0, len(files))
+	deletionFiles := make([]string, 0)
+
+	for _, fn := range files {
+		if filepath.Base(filepath.Dir(fn)) == bulkDeletedDir {
+			deletionFiles = append(deletionFiles, fn)
+		} else {
+			resourceFiles = append(resourceFiles, fn)
+		}
+	}
+
+	return resourceFiles, deletionFiles
+}
+
+// applyDeletions deletes resources listed in Bundles from "deleted"
+// output of Bulk Data export. Every Bundle entry has DELETE request
+// with the resource URL. Resources are deleted with fhirbase_delete,
+// so their last versions are kept in history tables with "deleted"
+// status.
+func applyDeletions(ctx context.Context, database *pgxpool.Pool, files []string) (int, error) {
+	batch := &pgx.Batch{}
+
+	for _, fn := range files {
+		// files are read directly, because bundle type detection would
+		// take single-line NDJSON with a Bundle for the Bundle's entries
+		f, err := os.Open(fn)
+
+		if err != nil {
+			return 0, err
+		}
+
+		dec := jsoniter.NewDecoder(f)
+
+		for {
+			var res map[string]interface{}
+			err := dec.Decode(&res)
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return 0, fmt.Errorf("cannot parse %s: %v", fn, err)
+			}
+
+			entries, _ := res["entry"].([]interface{})
+
+			for _, e := range entries {
+				entry, _ := e.(map[string]interface{})
+				request, _ := entry["request"].(map[string]interface{})
+				method, _ := request["method"].(string)
+				url, _ := request["url"].(string)
+
+				if method != "DELETE" || url == "" {
+					continue
+				}
+
+				// url is either relative (Patient/123) or absolute
+				parts := strings.Split(strings.TrimRight(strings.SplitN(url, "?", 2)[0], "/"), "/")
+
+				if len(parts) < 2 {
+					fmt.Printf("Skipping deletion with unexpected URL %s\n", url)
+					continue
+				}
+
+				batch.Queue("SELECT fhirbase_delete($1, $2)", parts[len(parts)-2], parts[len(parts)-1])
+			}
+		}
+
+		f.Close()
+	}
+
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+
+	err := database.SendBatch(ctx, batch).Close()
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot apply deletions: %v", err)
+	}
+
+	return batch.Len(), nil
+}
+
 func loadFiles(ctx context.Context, files []string, ldr loader, memUsage bool) error {
 	database, err := db.GetConnection()
 	if err != nil {
@@ -948,19 +1114,84 @@ func loadFiles(ctx context.Context, files []string, ldr loader, memUsage bool) e
 	}
 
 	defer database.Close()
-	startTime := time.Now()
-	bndl, err := newMultifileBundle(files)
+	files, deletionFiles := splitDeletionFiles(files)
 
-	if err != nil {
-		return err
+	if len(files) > 0 {
+		err = loadResourceFiles(ctx, database, files, ldr, memUsage)
+
+		if err != nil {
+			return err
+		}
 	}
 
-	totalCount := bndl.Count()
+	return loadDeletions(ctx, database, deletionFiles)
+}
 
-	insertedCounts := make(map[string]uint)
-	currentIdx := 0
+// loadStats collects numbers of loaded resources and transformation
+// warnings per resource type, it's safe for concurrent use
+type loadStats struct {
+	mu            sync.Mutex
+	inserted      map[string]uint
+	warnings      map[string]uint
+	firstWarnings map[string]string
+	total         int
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{
+		inserted:      make(map[string]uint),
+		warnings:      make(map[string]uint),
+		firstWarnings: make(map[string]string),
+	}
+}
+
+// Add records loaded resource, it returns number of resources loaded
+// so far
+func (s *loadStats) Add(curType string, warnings transformErrors) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+	s.inserted[curType] = s.inserted[curType] + 1
+
+	if len(warnings) > 0 {
+		if s.warnings[curType] == 0 {
+			s.firstWarnings[curType] = warnings[0].Error()
+		}
+
+		s.warnings[curType] = s.warnings[curType] + uint(len(warnings))
+	}
+
+	return s.total
+}
 
-	bar := progressbar.NewOptions(totalCount,
+// Print prints loaded resources and warnings per resource type
+func (s *loadStats) Print(startTime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loadDuration := int(time.Since(startTime).Seconds())
+
+	// submitLoadEvent(insertedCounts, loadDuration)
+
+	fmt.Printf("Done, inserted %d resources in %d seconds:\n", s.total, loadDuration)
+	fmt.Println("")
+
+	tblw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+
+	for rt, cnt := range s.inserted {
+		if s.warnings[rt] > 0 {
+			fmt.Fprintf(tblw, "%s\t %d\t %d transform warnings, first one: %s\n", rt, cnt, s.warnings[rt], s.firstWarnings[rt])
+		} else {
+			fmt.Fprintf(tblw, "%s\t %d\n", rt, cnt)
+		}
+	}
+
+	tblw.Flush()
+}
+
+func newLoadProgressBar(total int) *progressbar.ProgressBar {
+	return progressbar.NewOptions(total,
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionFullWidth(),
@@ -972,14 +1203,30 @@ func loadFiles(ctx context.Context, files []string, ldr loader, memUsage bool) e
 			BarStart:      "[",
 			BarEnd:        "]",
 		}))
+}
+
+func loadResourceFiles(ctx context.Context, database *pgxpool.Pool, files []string, ldr loader, memUsage bool) error {
+	startTime := time.Now()
+	bndl, err := newMultifileBundle(files)
+
+	if err != nil {
+		return err
+	}
+
+	stats := newLoadStats()
+	bar := newLoadProgressBar(bndl.Count())
+
+	layout, err := detectTableLayout(ctx, database)
 
-	err = ldr.Load(ctx, database, bndl, func(curType string, duration time.Duration) {
-		if memUsage && currentIdx%3000 == 0 {
+	if err != nil {
+		return err
+	}
+
+	err = ldr.Load(ctx, database, layout, bndl, func(curType string, duration time.Duration, warnings transformErrors) {
+		if stats.Add(curType, warnings)%3000 == 0 && memUsage {
 			PrintMemUsage()
 		}
 
-		currentIdx = currentIdx + 1
-		insertedCounts[curType] = insertedCounts[curType] + 1
 		bar.Add(1)
 	})
 
@@ -989,24 +1236,114 @@ func loadFiles(ctx context.Context, files []string, ldr loader, memUsage bool) e
 	}
 
 	bar.Finish()
-	loadDuration := int(time.Since(startTime).Seconds())
+	stats.Print(startTime)
 
-	// submitLoadEvent(insertedCounts, loadDuration)
+	return nil
+}
 
-	fmt.Printf("Done, inserted %d resources in %d seconds:\n", totalCount, loadDuration)
-	fmt.Println("")
+func loadDeletions(ctx context.Context, database *pgxpool.Pool, deletionFiles []string) error {
+	if len(deletionFiles) == 0 {
+		return nil
+	}
 
-	tblw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	deleted, err := applyDeletions(ctx, database, deletionFiles)
 
-	for rt, cnt := range insertedCounts {
-		fmt.Fprintf(tblw, "%s\t %d\n", rt, cnt)
+	if err != nil {
+		return err
 	}
 
-	tblw.Flush()
+	fmt.Printf("Deleted %d resources\n", deleted)
 
 	return nil
 }
 
+// loadBulkData downloads Bulk Data export into a temporary directory
+// and loads every file as soon as it's downloaded. Deletions are
+// applied after all files are loaded.
+func loadBulkData(ctx context.Context, url string, ldr loader, memUsage bool) error {
+	database, err := db.GetConnection()
+	if err != nil {
+		return fmt.Errorf("Failed to get connection config: %v", err)
+	}
+
+	defer database.Close()
+
+	layout, err := detectTableLayout(ctx, database)
+
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "fhirbase-bulk-")
+
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	// number of resources isn't known until all files are downloaded,
+	// so there is a single progress bar without total for the whole load
+	startTime := time.Now()
+	stats := newLoadStats()
+	bar := newLoadProgressBar(-1)
+	onResource := func(curType string, duration time.Duration, warnings transformErrors) {
+		if stats.Add(curType, warnings)%3000 == 0 && memUsage {
+			PrintMemUsage()
+		}
+
+		bar.Add(1)
+	}
+
+	deletionFiles := make([]string, 0)
+	dl := &bulkDownload{
+		numWorkers: uint(viper.GetInt("numdl")),
+		acceptHdr:  viper.GetString("accept-header"),
+		targetDir:  tmpDir,
+		retries:    viper.GetInt("retries"),
+	}
+
+	dl.onFile = func(fileName string) error {
+		if filepath.Base(filepath.Dir(fileName)) == bulkDeletedDir {
+			deletionFiles = append(deletionFiles, fileName)
+			return nil
+		}
+
+		bndl, err := newMultifileBundle([]string{fileName})
+
+		if err != nil {
+			return err
+		}
+
+		err = ldr.Load(ctx, database, layout, bndl, onResource)
+		os.Remove(fileName)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		return err
+	}
+
+	if viper.GetBool("stream") {
+		dl.onStream = func(entry *manifestFileEntry, body io.Reader) error {
+			return ldr.Load(ctx, database, layout, newStreamBundle(body), onResource)
+		}
+	}
+
+	_, err = getBulkData(ctx, url, dl)
+
+	bar.Finish()
+	fmt.Println("")
+	stats.Print(startTime)
+
+	if err != nil {
+		return err
+	}
+
+	return loadDeletions(ctx, database, deletionFiles)
+}
+
 // LoadCommand loads FHIR schema into database
 func LoadCommand(ctx context.Context, args []string) error {
 	// if c.NArg() == 0 {
@@ -1036,42 +1373,29 @@ func LoadCommand(ctx context.Context, args []string) error {
 		return fmt.Errorf("invalid value for --mode flag. Possible values are either 'copy' or 'insert'")
 	}
 
+	strict := viper.GetBool("strict")
+
 	if mode == "copy" {
 		ldr = &copyLoader{
 			fhirVersion: fhirVersion,
+			strict:      strict,
 		}
 	} else {
 		ldr = &insertLoader{
 			fhirVersion: fhirVersion,
+			strict:      strict,
 		}
 	}
 
 	memUsage := viper.GetBool("memusage")
 
-	// if bulkLoad {
-	// 	numWorkers := viper.GetInt("numdl")
-	// 	acceptHdr := viper.GetString("accept-header")
-	// 	fileHndlrs, err := getBulkData(args, numWorkers, acceptHdr)
-
-	// 	if err != nil {
-	// 		return err
-	// 	}
-
-	// 	files := make([]string, 0, len(fileHndlrs))
-
-	// 	defer func() {
-	// 		for _, fn := range files {
-	// 			os.Remove(fn)
-	// 		}
-	// 	}()
-
-	// 	for _, f := range fileHndlrs {
-	// 		files = append(files, f.Name())
-	// 		f.Close()
-	// 	}
+	if bulkLoad {
+		if len(args) > 1 {
+			return fmt.Errorf("expecting single Bulk Data URL, got %d arguments", len(args))
+		}
 
-	// 	return loadFiles(files, ldr, memUsage)
-	// }
+		return loadBulkData(ctx, args[0], ldr, memUsage)
+	}
 
 	files, err := prewalkDirs(args)
 
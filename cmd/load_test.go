@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSplitDeletionFiles(t *testing.T) {
+	files := []string{
+		"/tmp/bulk/Patient.ndjson",
+		"/tmp/bulk/deleted/Bundle.ndjson",
+		"/tmp/bulk/error/OperationOutcome.ndjson",
+		"/tmp/deleted.ndjson",
+	}
+
+	resources, deletions := splitDeletionFiles(files)
+
+	expectedResources := []string{
+		"/tmp/bulk/Patient.ndjson",
+		"/tmp/bulk/error/OperationOutcome.ndjson",
+		"/tmp/deleted.ndjson",
+	}
+
+	if !reflect.DeepEqual(resources, expectedResources) {
+		t.Errorf("got resource files %q, want %q", resources, expectedResources)
+	}
+
+	if !reflect.DeepEqual(deletions, []string{"/tmp/bulk/deleted/Bundle.ndjson"}) {
+		t.Errorf("got deletion files %q", deletions)
+	}
+}
+
+func TestLoadStats(t *testing.T) {
+	stats := newLoadStats()
+
+	// files and streams of a bulk load share the same stats
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				stats.Add("Patient", nil)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	warnings := transformErrors{{Path: "Observation.subject", Message: "first"}, {Message: "second"}}
+	stats.Add("Observation", warnings)
+
+	if n := stats.Add("Observation", transformErrors{{Message: "third"}}); n != 402 {
+		t.Errorf("got total %d, want 402", n)
+	}
+
+	if stats.inserted["Patient"] != 400 || stats.inserted["Observation"] != 2 {
+		t.Errorf("wrong counts per type: %v", stats.inserted)
+	}
+
+	if stats.warnings["Observation"] != 3 || stats.firstWarnings["Observation"] != "Observation.subject: first" {
+		t.Errorf("wrong warnings: %v %v", stats.warnings, stats.firstWarnings)
+	}
+}
+
+func TestStreamBundle(t *testing.T) {
+	bndl := newStreamBundle(strings.NewReader("{\"id\": \"1\"}\n\n  \n{\"id\": \"2\"}\n{\"id\": \"3\"}"))
+	ids := make([]interface{}, 0)
+
+	for {
+		res, err := bndl.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, res["id"])
+	}
+
+	if !reflect.DeepEqual(ids, []interface{}{"1", "2", "3"}) {
+		t.Errorf("got %v", ids)
+	}
+
+	bndl = newStreamBundle(strings.NewReader("{\"id\": \"1\"}\n{\"id\": \n"))
+	bndl.Next()
+
+	if _, err := bndl.Next(); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error pointing to line 2, got %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// bulkExportDefinition is the canonical URL of Bulk Data $export
+// operation
+const bulkExportDefinition = "http://hl7.org/fhir/uv/bulkdata/OperationDefinition/export"
+
+// conformanceVersion tells if FHIR version predates CapabilityStatement,
+// which was called Conformance before 1.8.0
+func conformanceVersion(fhirVersion string) bool {
+	switch fhirVersion {
+	case "1.0.2", "1.1.0", "1.4.0", "1.6.0":
+		return true
+	}
+
+	return false
+}
+
+// legacyCapabilityVersion tells if FHIR version has acceptUnknown
+// element and references instead of canonical URLs in
+// CapabilityStatement, i.e. is older than R4 ballots
+func legacyCapabilityVersion(fhirVersion string) bool {
+	return strings.HasPrefix(fhirVersion, "1.") || fhirVersion == "3.0.1"
+}
+
+// resourceCapabilities returns CapabilityStatement.rest.resource entries
+// for resource types stored in the database
+func (a *restAPI) resourceCapabilities(definitions searchParams) []interface{} {
+	types := make([]string, 0, len(a.types))
+
+	for rt := range a.types {
+		types = append(types, rt)
+	}
+
+	sort.Strings(types)
+
+	interactions := make([]interface{}, 0)
+
+	for _, code := range []string{"read", "vread", "update", "delete", "history-instance", "history-type", "create", "search-type"} {
+		interactions = append(interactions, map[string]interface{}{"code": code})
+	}
+
+	revIncludes := make(map[string][]string)
+
+	for _, rt := range types {
+		for name, param := range definitions[rt] {
+			if param.Type != "reference" {
+				continue
+			}
+
+			for _, target := range param.Target {
+				if a.types[target] {
+					revIncludes[target] = append(revIncludes[target], rt+":"+name)
+				}
+			}
+		}
+	}
+
+	result := make([]interface{}, 0, len(types))
+
+	for _, rt := range types {
+		names := make([]string, 0, len(definitions[rt]))
+
+		for name := range definitions[rt] {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		params := make([]interface{}, 0, len(names))
+		includes := make([]string, 0)
+
+		for _, name := range names {
+			param := definitions[rt][name]
+			params = append(params, map[string]interface{}{"name": name, "type": param.Type})
+
+			if param.Type == "reference" {
+				includes = append(includes, rt+":"+name)
+			}
+		}
+
+		sort.Strings(revIncludes[rt])
+
+		resource := map[string]interface{}{
+			"type":              rt,
+			"interaction":       interactions,
+			"versioning":        "versioned",
+			"readHistory":       true,
+			"updateCreate":      true,
+			"conditionalCreate": true,
+			"conditionalUpdate": true,
+			"conditionalDelete": "single",
+			"searchParam":       params,
+		}
+
+		if len(includes) > 0 {
+			resource["searchInclude"] = append(includes, "*")
+		}
+
+		if len(revIncludes[rt]) > 0 {
+			resource["searchRevInclude"] = revIncludes[rt]
+		}
+
+		result = append(result, resource)
+	}
+
+	return result
+}
+
+// metadataHandler implements capabilities interaction: GET
+// [base]/metadata. The statement describes resource types which have
+// tables in the database, so databases initialized with a subset of
+// resources advertise only that subset.
+func (a *restAPI) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	definitions, err := getSearchParams(a.fhirVersion)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	legacy := legacyCapabilityVersion(a.fhirVersion)
+	definition := func(url string) interface{} {
+		if legacy {
+			return map[string]interface{}{"reference": url}
+		}
+
+		return url
+	}
+
+	commonParams := make([]interface{}, 0)
+
+	for _, name := range []string{"_id", "_lastUpdated", "_tag", "_profile", "_security"} {
+		if param := definitions["Resource"][name]; param != nil {
+			commonParams = append(commonParams, map[string]interface{}{"name": name, "type": param.Type})
+		}
+	}
+
+	for _, name := range []string{"_count", "_offset", "_sort", "_elements", "_total", "_include", "_revinclude"} {
+		commonParams = append(commonParams, map[string]interface{}{"name": name, "type": "special"})
+	}
+
+	systemInteractions := []interface{}{
+		map[string]interface{}{"code": "transaction"},
+		map[string]interface{}{"code": "history-system"},
+	}
+
+	if a.fhirVersion != "1.0.2" {
+		systemInteractions = append(systemInteractions, map[string]interface{}{"code": "batch"})
+	}
+
+	resourceType := "CapabilityStatement"
+
+	if conformanceVersion(a.fhirVersion) {
+		resourceType = "Conformance"
+	}
+
+	statement := map[string]interface{}{
+		"resourceType": resourceType,
+		"status":       "active",
+		"date":         time.Now().UTC().Format(time.RFC3339),
+		"publisher":    "Fhirbase",
+		"kind":         "instance",
+		"software": map[string]interface{}{
+			"name":        "Fhirbase",
+			"version":     Version,
+			"releaseDate": BuildDate,
+		},
+		"implementation": map[string]interface{}{
+			"description": "Fhirbase FHIR server",
+			"url":         requestBaseURL(r) + fhirBasePath,
+		},
+		"fhirVersion": a.fhirVersion,
+		"format":      []string{"json", "application/fhir+json"},
+		"rest": []interface{}{
+			map[string]interface{}{
+				"mode":        "server",
+				"resource":    a.resourceCapabilities(definitions),
+				"interaction": systemInteractions,
+				"searchParam": commonParams,
+				"operation": []interface{}{
+					map[string]interface{}{"name": "export", "definition": definition(bulkExportDefinition)},
+				},
+			},
+		},
+	}
+
+	if legacy {
+		statement["acceptUnknown"] = "no"
+	}
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	jsoniter.NewEncoder(w).Encode(statement)
+}
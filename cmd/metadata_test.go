@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// capabilityStatement requests /fhir/metadata for the FHIR version
+func capabilityStatement(t *testing.T, fhirVersion string) map[string]interface{} {
+	t.Helper()
+
+	a := &restAPI{fhirVersion: fhirVersion, types: map[string]bool{"Patient": true, "Observation": true}}
+	w := httptest.NewRecorder()
+	a.metadataHandler(w, httptest.NewRequest("GET", "http://fhirbase.test/fhir/metadata", nil))
+
+	var statement map[string]interface{}
+
+	if err := jsoniter.Unmarshal(w.Body.Bytes(), &statement); err != nil {
+		t.Fatalf("%s: %v", w.Body, err)
+	}
+
+	return statement
+}
+
+// stringList converts JSON array into strings
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	result := make([]string, 0, len(items))
+
+	for _, i := range items {
+		s, _ := i.(string)
+		result = append(result, s)
+	}
+
+	return result
+}
+
+func TestMetadataHandler(t *testing.T) {
+	statement := capabilityStatement(t, "4.0.0")
+
+	if statement["resourceType"] != "CapabilityStatement" || statement["fhirVersion"] != "4.0.0" || statement["acceptUnknown"] != nil {
+		t.Errorf("wrong statement %v", statement)
+	}
+
+	if impl, _ := statement["implementation"].(map[string]interface{}); impl["url"] != "http://fhirbase.test/fhir" {
+		t.Errorf("got implementation %v", impl)
+	}
+
+	rest := statement["rest"].([]interface{})[0].(map[string]interface{})
+	resources := rest["resource"].([]interface{})
+
+	// only types stored in the database are advertised
+	if len(resources) != 2 {
+		t.Fatalf("got %d resources, want 2", len(resources))
+	}
+
+	observation := resources[0].(map[string]interface{})
+	patient := resources[1].(map[string]interface{})
+
+	if observation["type"] != "Observation" || patient["type"] != "Patient" {
+		t.Errorf("resources should be sorted by type, got %v and %v", observation["type"], patient["type"])
+	}
+
+	if includes := stringList(observation["searchInclude"]); !slices.Contains(includes, "Observation:subject") || !slices.Contains(includes, "*") {
+		t.Errorf("got Observation includes %q", includes)
+	}
+
+	if revIncludes := stringList(patient["searchRevInclude"]); !slices.Contains(revIncludes, "Observation:subject") {
+		t.Errorf("got Patient revincludes %q", revIncludes)
+	}
+
+	operation := rest["operation"].([]interface{})[0].(map[string]interface{})
+
+	if operation["definition"] != bulkExportDefinition {
+		t.Errorf("got $export definition %v", operation["definition"])
+	}
+}
+
+func TestMetadataHandlerLegacy(t *testing.T) {
+	statement := capabilityStatement(t, "1.0.2")
+
+	if statement["resourceType"] != "Conformance" || statement["acceptUnknown"] != "no" {
+		t.Errorf("wrong statement %v", statement)
+	}
+
+	rest := statement["rest"].([]interface{})[0].(map[string]interface{})
+	operation := rest["operation"].([]interface{})[0].(map[string]interface{})
+
+	if definition, _ := operation["definition"].(map[string]interface{}); definition["reference"] != bulkExportDefinition {
+		t.Errorf("got $export definition %v", operation["definition"])
+	}
+
+	for _, i := range rest["interaction"].([]interface{}) {
+		if i.(map[string]interface{})["code"] == "batch" {
+			t.Error("batch interaction doesn't exist in FHIR 1.0.2")
+		}
+	}
+}
@@ -0,0 +1,585 @@
+package cmd
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+)
+
+// queryOptions restrict SQL queries executed by /q endpoint
+type queryOptions struct {
+	readOnly bool
+	timeout  time.Duration
+	rowLimit int
+	role     string
+}
+
+func newQueryOptions() queryOptions {
+	return queryOptions{
+		readOnly: viper.GetBool("read-only"),
+		timeout:  viper.GetDuration("query-timeout"),
+		rowLimit: viper.GetInt("query-rows"),
+		role:     viper.GetString("query-role"),
+	}
+}
+
+// begin starts transaction for a query: read-only one with statement
+// timeout in read-only mode, running as the configured role if any
+func (o queryOptions) begin(ctx context.Context, conn *pgxpool.Conn) (pgx.Tx, error) {
+	accessMode := pgx.ReadWrite
+
+	if o.readOnly {
+		accessMode = pgx.ReadOnly
+	}
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: accessMode})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if o.readOnly && o.timeout > 0 {
+		_, err = tx.Exec(ctx, "SELECT set_config('statement_timeout', $1, true)", strconv.FormatInt(o.timeout.Milliseconds(), 10))
+	}
+
+	if err == nil && o.role != "" {
+		_, err = tx.Exec(ctx, "SET LOCAL ROLE "+pgx.Identifier{o.role}.Sanitize())
+	}
+
+	if err != nil {
+		tx.Rollback(context.Background())
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// queryColumn describes a column of query results
+type queryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	OID  uint32 `json:"oid"`
+}
+
+// queryRunner is the connection or the transaction running the query
+type queryRunner interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// queryColumns returns columns of query results with type names as
+// PostgreSQL prints them (i.e. "timestamp with time zone", "character
+// varying(10)"). Type names are looked up with the connection which is
+// going to run the query, so it has to be done before the query starts.
+func queryColumns(ctx context.Context, runner queryRunner, typeMap *pgtype.Map, fields []pgconn.FieldDescription) []queryColumn {
+	columns := make([]queryColumn, len(fields))
+	oids := make([]uint32, len(fields))
+	mods := make([]int32, len(fields))
+
+	for i, f := range fields {
+		columns[i] = queryColumn{Name: f.Name, OID: f.DataTypeOID, Type: "unknown"}
+		oids[i], mods[i] = f.DataTypeOID, f.TypeModifier
+
+		if t, ok := typeMap.TypeForOID(f.DataTypeOID); ok {
+			columns[i].Type = t.Name
+		}
+	}
+
+	if len(fields) == 0 {
+		return columns
+	}
+
+	var names []string
+	err := runner.QueryRow(ctx, "SELECT array_agg(format_type(t.oid, nullif(t.mod, -1)) ORDER BY t.n) FROM unnest($1::oid[], $2::int[]) WITH ORDINALITY AS t(oid, mod, n)", oids, mods).Scan(&names)
+
+	if err == nil && len(names) == len(columns) {
+		for i, name := range names {
+			columns[i].Type = name
+		}
+	}
+
+	return columns
+}
+
+// queryValue converts value returned by pgx into something which looks
+// reasonable in JSON and CSV: numerics stay numbers, UUIDs become
+// strings, other PostgreSQL specific types are printed by their codecs
+func queryValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case pgtype.Numeric:
+		if b, err := x.MarshalJSON(); err == nil {
+			return json.Number(b)
+		}
+	case [16]uint8:
+		return uuid.UUID(x).String()
+	case time.Time, string, bool, nil, map[string]interface{}, []interface{}:
+		return v
+	case driver.Valuer:
+		if dv, err := x.Value(); err == nil {
+			return dv
+		}
+	}
+
+	return v
+}
+
+// resultWriter writes results of /q query in one of supported formats
+type resultWriter interface {
+	// ContentType returns MIME type and file extension of the format
+	ContentType() (string, string)
+	Begin(columns []queryColumn) error
+	Row(values []interface{}) error
+
+	// RowError reports a row which couldn't be decoded
+	RowError(err error) error
+
+	// End finishes results, err is an error which interrupted reading
+	// rows (i.e. statement timeout)
+	End(truncated bool, err error) error
+
+	// Buffered tells how many bytes are waiting to be flushed
+	Buffered() int
+	Flush() error
+}
+
+func newResultWriter(format string, w io.Writer) (resultWriter, error) {
+	switch format {
+	case "", "json":
+		return &jsonResultWriter{stream: jsoniter.NewStream(jsoniter.ConfigFastest, w, 4096)}, nil
+	case "ndjson":
+		return &ndjsonResultWriter{stream: jsoniter.NewStream(jsoniter.ConfigFastest, w, 4096)}, nil
+	case "csv":
+		return &csvResultWriter{w: csv.NewWriter(w)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format %s, possible values are json, ndjson and csv", format)
+}
+
+// jsonResultWriter writes {"columns": [...], "rows": [[...], ...]},
+// rows which couldn't be decoded are {"error": "..."} objects
+type jsonResultWriter struct {
+	stream *jsoniter.Stream
+	rows   int
+}
+
+func (j *jsonResultWriter) ContentType() (string, string) {
+	return "application/json", "json"
+}
+
+func (j *jsonResultWriter) Begin(columns []queryColumn) error {
+	j.stream.WriteObjectStart()
+	j.stream.WriteObjectField("columns")
+	j.stream.WriteVal(columns)
+	j.stream.WriteMore()
+	j.stream.WriteObjectField("rows")
+	j.stream.WriteArrayStart()
+
+	return j.stream.Error
+}
+
+func (j *jsonResultWriter) next() {
+	if j.rows > 0 {
+		j.stream.WriteMore()
+	}
+
+	j.rows++
+}
+
+func (j *jsonResultWriter) Row(values []interface{}) error {
+	j.next()
+	j.stream.WriteVal(values)
+
+	return j.stream.Error
+}
+
+func (j *jsonResultWriter) RowError(err error) error {
+	j.next()
+	j.stream.WriteVal(map[string]string{"error": err.Error()})
+
+	return j.stream.Error
+}
+
+func (j *jsonResultWriter) End(truncated bool, err error) error {
+	j.stream.WriteArrayEnd()
+
+	if truncated {
+		j.stream.WriteMore()
+		j.stream.WriteObjectField("truncated")
+		j.stream.WriteBool(true)
+	}
+
+	if err != nil {
+		j.stream.WriteMore()
+		j.stream.WriteObjectField("error")
+		j.stream.WriteString(err.Error())
+	}
+
+	j.stream.WriteObjectEnd()
+
+	return j.Flush()
+}
+
+func (j *jsonResultWriter) Buffered() int {
+	return j.stream.Buffered()
+}
+
+func (j *jsonResultWriter) Flush() error {
+	return j.stream.Flush()
+}
+
+// ndjsonResultWriter writes every row as JSON object keyed by column
+// names on its own line, errors and truncation are reported with
+// {"error": "..."} and {"truncated": true} lines
+type ndjsonResultWriter struct {
+	stream  *jsoniter.Stream
+	columns []queryColumn
+}
+
+func (n *ndjsonResultWriter) ContentType() (string, string) {
+	return "application/x-ndjson", "ndjson"
+}
+
+func (n *ndjsonResultWriter) Begin(columns []queryColumn) error {
+	n.columns = columns
+	return nil
+}
+
+func (n *ndjsonResultWriter) line(v interface{}) error {
+	n.stream.WriteVal(v)
+	n.stream.WriteRaw("\n")
+
+	return n.stream.Error
+}
+
+func (n *ndjsonResultWriter) Row(values []interface{}) error {
+	n.stream.WriteObjectStart()
+
+	for i, v := range values {
+		if i > 0 {
+			n.stream.WriteMore()
+		}
+
+		n.stream.WriteObjectField(n.columns[i].Name)
+		n.stream.WriteVal(v)
+	}
+
+	n.stream.WriteObjectEnd()
+	n.stream.WriteRaw("\n")
+
+	return n.stream.Error
+}
+
+func (n *ndjsonResultWriter) RowError(err error) error {
+	return n.line(map[string]string{"error": err.Error()})
+}
+
+func (n *ndjsonResultWriter) End(truncated bool, err error) error {
+	if truncated {
+		n.line(map[string]bool{"truncated": true})
+	}
+
+	if err != nil {
+		n.line(map[string]string{"error": err.Error()})
+	}
+
+	return n.Flush()
+}
+
+func (n *ndjsonResultWriter) Buffered() int {
+	return n.stream.Buffered()
+}
+
+func (n *ndjsonResultWriter) Flush() error {
+	return n.stream.Flush()
+}
+
+// csvResultWriter writes header with column names and a record per row,
+// objects and arrays (i.e. jsonb values) are written as JSON. Errors are
+// reported as records starting with "ERROR:".
+type csvResultWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvResultWriter) ContentType() (string, string) {
+	return "text/csv", "csv"
+}
+
+func (c *csvResultWriter) Begin(columns []queryColumn) error {
+	header := make([]string, len(columns))
+
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+
+	return c.w.Write(header)
+}
+
+func (c *csvResultWriter) Row(values []interface{}) error {
+	record := make([]string, len(values))
+
+	for i, v := range values {
+		switch x := v.(type) {
+		case nil:
+		case string:
+			record[i] = x
+		case time.Time:
+			record[i] = x.Format(time.RFC3339Nano)
+		case json.Number:
+			record[i] = string(x)
+		case map[string]interface{}, []interface{}:
+			b, _ := jsoniter.Marshal(x)
+			record[i] = string(b)
+		default:
+			record[i] = fmt.Sprint(x)
+		}
+	}
+
+	return c.w.Write(record)
+}
+
+func (c *csvResultWriter) RowError(err error) error {
+	return c.w.Write([]string{"ERROR: " + err.Error()})
+}
+
+func (c *csvResultWriter) End(truncated bool, err error) error {
+	if truncated {
+		c.w.Write([]string{"ERROR: results are truncated"})
+	}
+
+	if err != nil {
+		c.RowError(err)
+	}
+
+	return c.Flush()
+}
+
+func (c *csvResultWriter) Buffered() int {
+	// csv.Writer wraps bufio.Writer of 4096 bytes, which writes through
+	// on its own when full
+	return 0
+}
+
+func (c *csvResultWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// queryFlushSize is the amount of buffered results which is sent to
+// the client right away, so large results are streamed
+const queryFlushSize = 64 * 1024
+
+// readQueryRequest returns SQL query and parameters of /q request. The
+// query is taken from "query" parameter of URL or form, from JSON body
+// like {"query": "...", "format": "csv"}, or from the whole body of POST
+// request of any other content type.
+func readQueryRequest(r *http.Request) (string, string, bool, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format := r.URL.Query().Get("format")
+	download := r.URL.Query().Get("download")
+	query := r.URL.Query().Get("query")
+
+	if r.Method == "POST" {
+		switch contentType {
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			query = r.FormValue("query")
+
+			if v := r.FormValue("format"); v != "" {
+				format = v
+			}
+
+			if v := r.FormValue("download"); v != "" {
+				download = v
+			}
+		case "application/json":
+			var body struct {
+				Query    string `json:"query"`
+				Format   string `json:"format"`
+				Download bool   `json:"download"`
+			}
+
+			if err := jsoniter.NewDecoder(r.Body).Decode(&body); err != nil {
+				return "", "", false, fmt.Errorf("Cannot parse request body: %v", err)
+			}
+
+			query = body.Query
+
+			if body.Format != "" {
+				format = body.Format
+			}
+
+			if body.Download {
+				download = "true"
+			}
+		default:
+			body, err := io.ReadAll(r.Body)
+
+			if err != nil {
+				return "", "", false, fmt.Errorf("Cannot read request body: %v", err)
+			}
+
+			query = string(body)
+		}
+	}
+
+	isDownload, _ := strconv.ParseBool(download)
+
+	return strings.TrimSpace(query), format, isDownload, nil
+}
+
+func writeQueryError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	jsoniter.NewEncoder(w).Encode(map[string]string{
+		"message": message,
+	})
+}
+
+// qHandler runs SQL query with the request's context, so the query is
+// cancelled in PostgreSQL when the client disconnects
+func qHandler(db *pgxpool.Pool, opts queryOptions, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sql, format, download, err := readQueryRequest(r)
+
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(sql) == 0 {
+		writeQueryError(w, http.StatusBadRequest, "Please provide 'query' query-string param")
+		return
+	}
+
+	out, err := newResultWriter(format, w)
+
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conn, err := db.Acquire(ctx)
+
+	if err != nil {
+		writeQueryError(w, http.StatusInternalServerError, "Cannot acquire DB connection")
+		return
+	}
+
+	defer conn.Release()
+
+	var tx pgx.Tx
+	var runner queryRunner = conn
+
+	if opts.readOnly || opts.role != "" {
+		tx, err = opts.begin(ctx, conn)
+
+		if err != nil {
+			writeQueryError(w, http.StatusInternalServerError, fmt.Sprintf("Cannot start transaction: %v", err))
+			return
+		}
+
+		defer tx.Rollback(context.Background())
+		runner = tx
+	}
+
+	// result columns are described before the query runs, as the
+	// connection is busy until all rows are read
+	desc, err := conn.Conn().PgConn().Prepare(ctx, "", sql, nil)
+
+	if err != nil {
+		writeQueryError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	columns := queryColumns(ctx, runner, conn.Conn().TypeMap(), desc.Fields)
+	rows, err := runner.Query(ctx, sql)
+
+	if err != nil {
+		writeQueryError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	defer rows.Close()
+
+	// errors of the query itself are reported by the first Next()
+	hasRows := rows.Next()
+
+	if !hasRows && rows.Err() != nil {
+		writeQueryError(w, http.StatusInternalServerError, rows.Err().Error())
+		return
+	}
+
+	contentType, ext := out.ContentType()
+	w.Header().Set("Content-Type", contentType)
+
+	if download {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="query.%s"`, ext))
+	}
+
+	flusher, _ := w.(http.Flusher)
+	out.Begin(columns)
+
+	count := 0
+	truncated := false
+
+	for hasRows {
+		vals, err := rows.Values()
+
+		if err == nil {
+			for i, v := range vals {
+				vals[i] = queryValue(v)
+			}
+
+			err = out.Row(vals)
+		} else {
+			err = out.RowError(err)
+		}
+
+		if err != nil {
+			// client went away
+			return
+		}
+
+		count++
+
+		if opts.readOnly && opts.rowLimit > 0 && count >= opts.rowLimit {
+			truncated = rows.Next()
+			break
+		}
+
+		if out.Buffered() >= queryFlushSize {
+			out.Flush()
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		hasRows = rows.Next()
+	}
+
+	rows.Close()
+	err = rows.Err()
+
+	if err == nil && tx != nil && !opts.readOnly {
+		err = tx.Commit(ctx)
+	}
+
+	out.End(truncated, err)
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestQueryValue(t *testing.T) {
+	var numeric pgtype.Numeric
+
+	if err := numeric.Scan("12.50"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := [16]uint8{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+
+	tests := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{numeric, json.Number("12.50")},
+		{id, "12345678-9abc-def0-1234-56789abcdef0"},
+		{"text", "text"},
+		{nil, nil},
+		{pgtype.Text{String: "valid", Valid: true}, "valid"},
+		{int64(42), int64(42)},
+	}
+
+	for _, tt := range tests {
+		if v := queryValue(tt.value); v != tt.expected {
+			t.Errorf("%#v: got %#v, want %#v", tt.value, v, tt.expected)
+		}
+	}
+}
+
+// writeResults writes two rows, one row error and the final error
+// with the given format
+func writeResults(t *testing.T, format string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	out, err := newResultWriter(format, &buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	out.Begin([]queryColumn{{Name: "id", Type: "text"}, {Name: "resource", Type: "jsonb"}, {Name: "ts", Type: "timestamp with time zone"}, {Name: "n", Type: "numeric"}})
+	out.Row([]interface{}{"pt-1", map[string]interface{}{"resourceType": "Patient"}, created, json.Number("1.5")})
+	out.Row([]interface{}{"pt-2", nil, created, json.Number("2")})
+	out.RowError(errors.New("cannot decode row"))
+
+	if err := out.End(true, errors.New("canceling statement due to statement timeout")); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestJSONResultWriter(t *testing.T) {
+	var result struct {
+		Columns   []queryColumn
+		Rows      []interface{}
+		Truncated bool
+		Error     string
+	}
+
+	if err := jsoniter.UnmarshalFromString(writeResults(t, "json"), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Columns) != 4 || result.Columns[2].Type != "timestamp with time zone" {
+		t.Errorf("wrong columns %v", result.Columns)
+	}
+
+	if len(result.Rows) != 3 || !strings.Contains(jsonString(t, result.Rows[2]), "cannot decode row") {
+		t.Errorf("wrong rows %v", result.Rows)
+	}
+
+	if !result.Truncated || !strings.Contains(result.Error, "statement timeout") {
+		t.Errorf("truncation and error should be reported, got %+v", result)
+	}
+}
+
+func jsonString(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	content, err := jsoniter.MarshalToString(v)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func TestNDJSONResultWriter(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(writeResults(t, "ndjson"), "\n"), "\n")
+
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want 5: %q", len(lines), lines)
+	}
+
+	row := parseResource(t, lines[0])
+
+	if row["id"] != "pt-1" || row["n"] != 1.5 || row["ts"] != "2024-05-01T12:30:00Z" {
+		t.Errorf("wrong row %v", row)
+	}
+
+	if resource, _ := row["resource"].(map[string]interface{}); resource["resourceType"] != "Patient" {
+		t.Errorf("jsonb value should be kept as object, got %v", row["resource"])
+	}
+
+	expected := []string{`{"error":"cannot decode row"}`, `{"truncated":true}`, `{"error":"canceling statement due to statement timeout"}`}
+
+	for i, line := range lines[2:] {
+		if line != expected[i] {
+			t.Errorf("got %s, want %s", line, expected[i])
+		}
+	}
+}
+
+func TestCSVResultWriter(t *testing.T) {
+	expected := `id,resource,ts,n
+pt-1,"{""resourceType"":""Patient""}",2024-05-01T12:30:00Z,1.5
+pt-2,,2024-05-01T12:30:00Z,2
+ERROR: cannot decode row
+ERROR: results are truncated
+ERROR: canceling statement due to statement timeout
+`
+
+	if content := writeResults(t, "csv"); content != expected {
+		t.Errorf("got\n%s\nwant\n%s", content, expected)
+	}
+}
+
+func TestNewResultWriterUnknown(t *testing.T) {
+	if _, err := newResultWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestReadQueryRequest(t *testing.T) {
+	form := url.Values{"query": {"SELECT 2"}, "format": {"csv"}, "download": {"1"}}
+
+	tests := []struct {
+		name        string
+		request     *http.Request
+		contentType string
+		query       string
+		format      string
+		download    bool
+	}{
+		{"GET", httptest.NewRequest("GET", "/q?query=SELECT+1&format=ndjson", nil), "", "SELECT 1", "ndjson", false},
+		{"form", httptest.NewRequest("POST", "/q", strings.NewReader(form.Encode())), "application/x-www-form-urlencoded", "SELECT 2", "csv", true},
+		{"JSON", httptest.NewRequest("POST", "/q?format=csv", strings.NewReader(`{"query": " SELECT 3 ", "download": true}`)), "application/json; charset=utf-8", "SELECT 3", "csv", true},
+		{"plain", httptest.NewRequest("POST", "/q?download=true", strings.NewReader("SELECT 4\n")), "text/plain", "SELECT 4", "", true},
+	}
+
+	for _, tt := range tests {
+		if tt.contentType != "" {
+			tt.request.Header.Set("Content-Type", tt.contentType)
+		}
+
+		query, format, download, err := readQueryRequest(tt.request)
+
+		if err != nil || query != tt.query || format != tt.format || download != tt.download {
+			t.Errorf("%s: got %q %q %v %v, want %q %q %v", tt.name, query, format, download, err, tt.query, tt.format, tt.download)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/q", strings.NewReader("{"))
+	r.Header.Set("Content-Type", "application/json")
+
+	if _, _, _, err := readQueryRequest(r); err == nil {
+		t.Error("expected error for invalid JSON body")
+	}
+}
+
+func TestQHandlerBadRequest(t *testing.T) {
+	// invalid requests are rejected before the database is used
+	for _, target := range []string{"/q", "/q?query=SELECT+1&format=xml"} {
+		w := httptest.NewRecorder()
+		qHandler(nil, queryOptions{}, w, httptest.NewRequest("GET", target, nil))
+
+		if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got status %d, content type %s", target, w.Code, w.Header().Get("Content-Type"))
+		}
+
+		if body := parseResource(t, w.Body.String()); body["message"] == nil {
+			t.Errorf("%s: error message is missing in %v", target, body)
+		}
+	}
+}
+
+// TestQHandlerConcurrent runs more queries than there are connections in
+// the pool, it needs PostgreSQL at FHIRBASE_TEST_DATABASE_URL
+func TestQHandlerConcurrent(t *testing.T) {
+	connString := os.Getenv("FHIRBASE_TEST_DATABASE_URL")
+
+	if connString == "" {
+		t.Skip("FHIRBASE_TEST_DATABASE_URL is not set")
+	}
+
+	config, err := pgxpool.ParseConfig(connString)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.MaxConns = 2
+	db, err := pgxpool.NewWithConfig(context.Background(), config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	opts := queryOptions{readOnly: true, timeout: 10 * time.Second}
+	results := make(chan *httptest.ResponseRecorder)
+
+	for i := 0; i < 3*int(config.MaxConns); i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/q?query=SELECT+now()+AS+ts,+pg_sleep(0.1)", nil)
+			qHandler(db, opts, w, r.WithContext(ctx))
+			results <- w
+		}()
+	}
+
+	for i := 0; i < 3*int(config.MaxConns); i++ {
+		w := <-results
+
+		var result struct {
+			Columns []queryColumn
+			Rows    []interface{}
+			Error   string
+		}
+
+		if err := jsoniter.UnmarshalFromString(w.Body.String(), &result); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+
+		if w.Code != http.StatusOK || result.Error != "" || len(result.Rows) != 1 {
+			t.Errorf("got status %d: %s", w.Code, w.Body.String())
+		}
+
+		if len(result.Columns) != 2 || result.Columns[0].Type != "timestamp with time zone" {
+			t.Errorf("wrong columns %v", result.Columns)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+)
+
+var matchResourceID = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+// restAPI serves FHIR RESTful API on top of fhirbase_create,
+// fhirbase_read, fhirbase_update and fhirbase_delete functions.
+// Resources are transformed before they are stored and transformed
+// back before they are returned, so clients see canonical FHIR.
+type restAPI struct {
+	db          *pgxpool.Pool
+	layout      tableLayout
+	fhirVersion string
+	strict      bool
+	types       map[string]bool
+
+	// router serves GET entries of transaction and batch Bundles
+	router http.Handler
+}
+
+func newRestAPI(ctx context.Context, database *pgxpool.Pool, layout tableLayout) (*restAPI, error) {
+	types, err := layout.ResourceTypes(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	api := &restAPI{
+		db:          database,
+		layout:      layout,
+		fhirVersion: viper.GetString("fhir"),
+		strict:      viper.GetBool("strict"),
+		types:       make(map[string]bool),
+	}
+
+	for _, t := range types {
+		api.types[t] = true
+	}
+
+	return api, nil
+}
+
+// resourceType returns resource type from the request path, responding
+// with an error if the type is unknown
+func (a *restAPI) resourceType(w http.ResponseWriter, r *http.Request) (string, bool) {
+	rt := r.PathValue("type")
+
+	if !a.types[rt] {
+		writeOperationOutcome(w, http.StatusNotFound, "not-supported", "unknown resource type %s", rt)
+		return "", false
+	}
+
+	if id := r.PathValue("id"); id != "" && !matchResourceID.MatchString(id) {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "invalid resource id %s", id)
+		return "", false
+	}
+
+	return rt, true
+}
+
+// versionETag returns weak ETag for the version of a resource
+func versionETag(versionID string) string {
+	return fmt.Sprintf(`W/"%s"`, versionID)
+}
+
+// parseETag returns version id from the ETag, i.e. from If-Match header
+func parseETag(etag string) string {
+	return strings.Trim(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), `"`)
+}
+
+func resourceMeta(res map[string]interface{}) (string, string) {
+	meta, _ := res["meta"].(map[string]interface{})
+	versionID, _ := meta["versionId"].(string)
+	lastUpdated, _ := meta["lastUpdated"].(string)
+
+	return versionID, lastUpdated
+}
+
+// resourceLocation returns versioned URL of the resource
+func resourceLocation(r *http.Request, res map[string]interface{}) string {
+	rt, _ := res["resourceType"].(string)
+	id, _ := res["id"].(string)
+	versionID, _ := resourceMeta(res)
+
+	return fmt.Sprintf("%s%s/%s/%s/_history/%s", requestBaseURL(r), fhirBasePath, rt, id, versionID)
+}
+
+// preferMinimal tells if client asked not to return resource body
+func preferMinimal(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Prefer"), "return=minimal")
+}
+
+// writeResource responds with the resource stored by Fhirbase
+// converted back into canonical FHIR, setting ETag and Last-Modified
+// headers from its meta
+func (a *restAPI) writeResource(w http.ResponseWriter, r *http.Request, status int, res map[string]interface{}) {
+	versionID, lastUpdated := resourceMeta(res)
+
+	if versionID != "" {
+		w.Header().Set("ETag", versionETag(versionID))
+	}
+
+	if ts, err := time.Parse(time.RFC3339Nano, lastUpdated); err == nil {
+		w.Header().Set("Last-Modified", ts.UTC().Format(http.TimeFormat))
+	}
+
+	if status == http.StatusCreated {
+		w.Header().Set("Location", resourceLocation(r, res))
+	}
+
+	if preferMinimal(r) {
+		w.WriteHeader(status)
+		return
+	}
+
+	res, _, err := doReverseTransform(res, a.fhirVersion)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.WriteHeader(status)
+	jsoniter.NewEncoder(w).Encode(res)
+}
+
+// readResourceBody reads resource of the provided type from the request
+// body and transforms it for storing
+func (a *restAPI) readResourceBody(r *http.Request, rt string) (map[string]interface{}, error) {
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %v", err)
+	}
+
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, fmt.Errorf("request body is empty")
+	}
+
+	var res map[string]interface{}
+
+	if err := jsoniter.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("cannot parse resource: %v", err)
+	}
+
+	if resType, _ := res["resourceType"].(string); resType != rt {
+		return nil, fmt.Errorf("expecting %s resource, got %q", rt, resType)
+	}
+
+	res, _, err = doTransform(res, a.fhirVersion, a.strict)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// lockResource locks the resource row till the end of transaction and
+// returns the resource, or nil if it doesn't exist
+func (a *restAPI) lockResource(ctx context.Context, tx pgx.Tx, rt string, id string) (map[string]interface{}, error) {
+	query, args := a.layout.ResourceQuery(rt)
+	query += fmt.Sprintf(" AND id = $%d FOR UPDATE", len(args)+1)
+
+	var res map[string]interface{}
+	err := tx.QueryRow(ctx, query, append(args, id)...).Scan(&res)
+
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+
+	return res, err
+}
+
+// checkIfMatch compares If-Match header of the request with the current
+// version of the resource, it responds with 412 on mismatch
+func checkIfMatch(w http.ResponseWriter, r *http.Request, current map[string]interface{}) bool {
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch == "" {
+		return true
+	}
+
+	if current == nil {
+		writeOperationOutcome(w, http.StatusPreconditionFailed, "conflict", "resource doesn't exist, but If-Match header was provided")
+		return false
+	}
+
+	versionID, _ := resourceMeta(current)
+
+	if parseETag(ifMatch) != versionID {
+		writeOperationOutcome(w, http.StatusPreconditionFailed, "conflict", "version %s doesn't match current version %s", parseETag(ifMatch), versionID)
+		return false
+	}
+
+	return true
+}
+
+// isDeleted tells if the last version of the resource in history table
+// was deleted
+func (a *restAPI) isDeleted(ctx context.Context, rt string, id string) (bool, error) {
+	query, args := a.layout.HistoryQuery(rt, "status")
+	query += fmt.Sprintf(" AND id = $%d ORDER BY txid DESC LIMIT 1", len(args)+1)
+
+	var status string
+	err := a.db.QueryRow(ctx, query, append(args, id)...).Scan(&status)
+
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+
+	return status == "deleted", err
+}
+
+// readHandler implements read interaction: GET [base]/[type]/[id]
+func (a *restAPI) readHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := a.resourceType(w, r)
+
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	var res map[string]interface{}
+
+	err := a.db.QueryRow(r.Context(), "SELECT fhirbase_read($1, $2)", rt, id).Scan(&res)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	if res == nil {
+		deleted, err := a.isDeleted(r.Context(), rt, id)
+
+		if err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		} else if deleted {
+			writeOperationOutcome(w, http.StatusGone, "deleted", "%s/%s was deleted", rt, id)
+		} else {
+			writeOperationOutcome(w, http.StatusNotFound, "not-found", "%s/%s not found", rt, id)
+		}
+
+		return
+	}
+
+	a.writeResource(w, r, http.StatusOK, res)
+}
+
+// createHandler implements create interaction: POST [base]/[type], id
+// of the resource is assigned by the server
+func (a *restAPI) createHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := a.resourceType(w, r)
+
+	if !ok {
+		return
+	}
+
+	res, err := a.readResourceBody(r, rt)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "%v", err)
+		return
+	}
+
+	delete(res, "id")
+
+	var created map[string]interface{}
+
+	err = a.db.QueryRow(r.Context(), "SELECT fhirbase_create($1::jsonb)", res).Scan(&created)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	a.writeResource(w, r, http.StatusCreated, created)
+}
+
+// updateHandler implements update interaction: PUT [base]/[type]/[id],
+// resource is created if it doesn't exist yet
+func (a *restAPI) updateHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := a.resourceType(w, r)
+
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	res, err := a.readResourceBody(r, rt)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "%v", err)
+		return
+	}
+
+	if resID, ok := res["id"].(string); !ok || resID != id {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "resource id should match id in the URL (%s)", id)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := a.db.Begin(ctx)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "cannot start transaction: %v", err)
+		return
+	}
+
+	defer tx.Rollback(context.Background())
+
+	current, err := a.lockResource(ctx, tx, rt, id)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	if !checkIfMatch(w, r, current) {
+		return
+	}
+
+	var updated map[string]interface{}
+
+	if err := tx.QueryRow(ctx, "SELECT fhirbase_update($1::jsonb)", res).Scan(&updated); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "cannot commit transaction: %v", err)
+		return
+	}
+
+	status := http.StatusOK
+
+	if current == nil {
+		status = http.StatusCreated
+	}
+
+	a.writeResource(w, r, status, updated)
+}
+
+// deleteHandler implements delete interaction: DELETE [base]/[type]/[id],
+// the last version is kept in the history with "deleted" status
+func (a *restAPI) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := a.resourceType(w, r)
+
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	ctx := r.Context()
+	tx, err := a.db.Begin(ctx)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "cannot start transaction: %v", err)
+		return
+	}
+
+	defer tx.Rollback(context.Background())
+
+	current, err := a.lockResource(ctx, tx, rt, id)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	if !checkIfMatch(w, r, current) {
+		return
+	}
+
+	if current == nil {
+		// deleting a resource which doesn't exist is not an error
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if _, err := tx.Exec(ctx, "SELECT fhirbase_delete($1, $2)", rt, id); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "cannot commit transaction: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerRestHandlers adds FHIR RESTful API endpoints to the router
+func registerRestHandlers(router *http.ServeMux, a *restAPI) {
+	a.router = router
+	router.HandleFunc("POST "+fhirBasePath, a.bundleHandler)
+	router.HandleFunc("GET "+fhirBasePath+"/metadata", a.metadataHandler)
+	router.HandleFunc("GET "+fhirBasePath+"/{type}", a.searchHandler)
+	router.HandleFunc("POST "+fhirBasePath+"/{type}/_search", a.searchHandler)
+	router.HandleFunc("POST "+fhirBasePath+"/{type}", a.createHandler)
+	router.HandleFunc("GET "+fhirBasePath+"/{type}/{id}", a.readHandler)
+	router.HandleFunc("PUT "+fhirBasePath+"/{type}/{id}", a.updateHandler)
+	router.HandleFunc("DELETE "+fhirBasePath+"/{type}/{id}", a.deleteHandler)
+	router.HandleFunc("GET "+fhirBasePath+"/_history", a.historyHandler)
+	router.HandleFunc("GET "+fhirBasePath+"/{type}/_history", a.historyHandler)
+	router.HandleFunc("GET "+fhirBasePath+"/{type}/{id}/_history", a.historyHandler)
+	router.HandleFunc("GET "+fhirBasePath+"/{type}/{id}/_history/{vid}", a.vreadHandler)
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestRegisterHandlers(t *testing.T) {
+	router := http.NewServeMux()
+
+	// conflicting patterns make ServeMux panic at registration
+	registerExportHandlers(router, &exportManager{})
+	registerRestHandlers(router, &restAPI{})
+
+	tests := []struct {
+		method  string
+		path    string
+		pattern string
+	}{
+		{"POST", "/fhir", "POST /fhir"},
+		{"GET", "/fhir/metadata", "GET /fhir/metadata"},
+		{"GET", "/fhir/Patient", "GET /fhir/{type}"},
+		{"POST", "/fhir/Patient/_search", "POST /fhir/{type}/_search"},
+		{"GET", "/fhir/Patient/pt-1", "GET /fhir/{type}/{id}"},
+		{"GET", "/fhir/_history", "GET /fhir/_history"},
+		{"GET", "/fhir/Patient/_history", "GET /fhir/{type}/_history"},
+		{"GET", "/fhir/Patient/pt-1/_history", "GET /fhir/{type}/{id}/_history"},
+		{"GET", "/fhir/Patient/pt-1/_history/2", "GET /fhir/{type}/{id}/_history/{vid}"},
+		{"GET", "/fhir/$export", "GET /fhir/$export"},
+		{"POST", "/fhir/Patient/$export", "POST /fhir/Patient/$export"},
+		{"GET", "/fhir/Group/g-1/$export", "GET /fhir/Group/{id}/$export"},
+		{"GET", "/_export/job-1", "GET /_export/{job}"},
+		{"DELETE", "/_export/job-1", "DELETE /_export/{job}"},
+		{"GET", "/_export/job-1/Patient.ndjson", "GET /_export/{job}/{file}"},
+	}
+
+	for _, tt := range tests {
+		_, pattern := router.Handler(httptest.NewRequest(tt.method, tt.path, nil))
+
+		if pattern != tt.pattern {
+			t.Errorf("%s %s: got pattern %q, want %q", tt.method, tt.path, pattern, tt.pattern)
+		}
+	}
+}
+
+func TestRestValidation(t *testing.T) {
+	router := http.NewServeMux()
+	registerRestHandlers(router, &restAPI{fhirVersion: "4.0.0", types: map[string]bool{"Patient": true}})
+
+	// requests are rejected before the database is queried
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", "/fhir/Unknown/pt-1", "", http.StatusNotFound},
+		{"GET", "/fhir/Patient/pt_1", "", http.StatusBadRequest},
+		{"DELETE", "/fhir/Unknown/pt-1", "", http.StatusNotFound},
+		{"POST", "/fhir/Patient", "", http.StatusBadRequest},
+		{"POST", "/fhir/Patient", `{"resourceType": "Observation"}`, http.StatusBadRequest},
+		{"POST", "/fhir/Patient", `{"resourceType": "Patient"`, http.StatusBadRequest},
+		{"PUT", "/fhir/Patient/pt-1", `{"resourceType": "Patient", "id": "pt-2"}`, http.StatusBadRequest},
+		{"PUT", "/fhir/Patient/pt-1", `{"resourceType": "Patient"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+
+		var oo map[string]interface{}
+
+		if err := jsoniter.Unmarshal(w.Body.Bytes(), &oo); err != nil || oo["resourceType"] != "OperationOutcome" {
+			t.Errorf("%s %s: expected OperationOutcome, got %s", tt.method, tt.path, w.Body)
+		}
+	}
+}
+
+func TestWriteResource(t *testing.T) {
+	a := &restAPI{fhirVersion: "4.0.0"}
+	stored := map[string]interface{}{
+		"resourceType":         "Patient",
+		"id":                   "pt-1",
+		"meta":                 map[string]interface{}{"versionId": "3", "lastUpdated": "2024-01-02T03:04:05.123456+00:00"},
+		"managingOrganization": map[string]interface{}{"id": "org-1", "resourceType": "Organization"},
+	}
+
+	w := httptest.NewRecorder()
+	a.writeResource(w, httptest.NewRequest("POST", "http://fhirbase.test/fhir/Patient", nil), http.StatusCreated, stored)
+
+	expectedHeaders := map[string]string{
+		"ETag":          `W/"3"`,
+		"Last-Modified": "Tue, 02 Jan 2024 03:04:05 GMT",
+		"Location":      "http://fhirbase.test/fhir/Patient/pt-1/_history/3",
+		"Content-Type":  "application/fhir+json",
+	}
+
+	for k, v := range expectedHeaders {
+		if w.Header().Get(k) != v {
+			t.Errorf("got %s header %q, want %q", k, w.Header().Get(k), v)
+		}
+	}
+
+	var res map[string]interface{}
+	jsoniter.Unmarshal(w.Body.Bytes(), &res)
+
+	if org, _ := res["managingOrganization"].(map[string]interface{}); w.Code != http.StatusCreated || org["reference"] != "Organization/org-1" {
+		t.Errorf("resource should be returned as canonical FHIR, got %d %s", w.Code, w.Body)
+	}
+
+	req := httptest.NewRequest("PUT", "http://fhirbase.test/fhir/Patient/pt-1", nil)
+	req.Header.Set("Prefer", "return=minimal")
+	w = httptest.NewRecorder()
+	a.writeResource(w, req, http.StatusOK, stored)
+
+	if w.Body.Len() != 0 || w.Header().Get("ETag") == "" {
+		t.Errorf("return=minimal should respond with headers only, got %s", w.Body)
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	current := map[string]interface{}{"meta": map[string]interface{}{"versionId": "2"}}
+
+	tests := []struct {
+		ifMatch string
+		current map[string]interface{}
+		ok      bool
+	}{
+		{"", nil, true},
+		{"", current, true},
+		{`W/"2"`, current, true},
+		{`"2"`, current, true},
+		{`W/"1"`, current, false},
+		{`W/"1"`, nil, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("PUT", "/fhir/Patient/pt-1", nil)
+
+		if tt.ifMatch != "" {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		w := httptest.NewRecorder()
+
+		if ok := checkIfMatch(w, req, tt.current); ok != tt.ok {
+			t.Errorf("If-Match %q: got %v, want %v", tt.ifMatch, ok, tt.ok)
+		}
+
+		if !tt.ok && w.Code != http.StatusPreconditionFailed {
+			t.Errorf("If-Match %q: got status %d, want 412", tt.ifMatch, w.Code)
+		}
+	}
+}
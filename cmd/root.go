@@ -41,6 +41,9 @@ var data = struct {
 }
 var cfgFile string
 var fhirVersion string
+var transformRules string
+var strictTransform bool
+var layoutName string
 
 var welcomeMessage = fmt.Sprintf(`
 %s
@@ -110,6 +113,9 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&db.PgConfig.Username, "username", "U", "postgres", "Username to use")
 	rootCmd.PersistentFlags().StringVarP(&db.PgConfig.Password, "password", "W", "", "Password to use")
 	rootCmd.PersistentFlags().StringVarP(&db.PgConfig.SSLMode, "sslmode", "s", "disable", "SSL mode to use")
+	rootCmd.PersistentFlags().StringVar(&transformRules, "transform-rules", "", "JSON file with transformation rules merged on top of the built-in ones")
+	rootCmd.PersistentFlags().BoolVar(&strictTransform, "strict", false, "Fail on resources which cannot be transformed instead of keeping offending elements unchanged")
+	rootCmd.PersistentFlags().StringVar(&layoutName, "layout", "", "Table layout: 'tables' (table per resource type) or 'partitioned' (single partitioned table), detected from the database if not set")
 
 	// Defaults
 	viper.SetDefault("fhir", "4.0.0")
@@ -126,6 +132,9 @@ func init() {
 	viper.BindPFlag("username", rootCmd.PersistentFlags().Lookup("username"))
 	viper.BindPFlag("password", rootCmd.PersistentFlags().Lookup("password"))
 	viper.BindPFlag("sslmode", rootCmd.PersistentFlags().Lookup("sslmode"))
+	viper.BindPFlag("transform-rules", rootCmd.PersistentFlags().Lookup("transform-rules"))
+	viper.BindPFlag("strict", rootCmd.PersistentFlags().Lookup("strict"))
+	viper.BindPFlag("layout", rootCmd.PersistentFlags().Lookup("layout"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
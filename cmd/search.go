@@ -0,0 +1,961 @@
+package cmd
+
+import (
+	"embed"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+)
+
+//go:embed search/*
+var searchFiles embed.FS
+
+// searchParam is a search parameter definition from the embedded
+// search/fhirbase-search-*.json files. Paths are FHIR element paths
+// relative to the resource, choice elements are named with their type
+// (i.e. valueQuantity), they're converted to paths of transformed
+// resources when the search is performed.
+type searchParam struct {
+	Type   string   `json:"type"`
+	Path   []string `json:"path"`
+	Target []string `json:"target"`
+}
+
+// searchParams holds search parameters per resource type, parameters
+// common for all resources are kept under "Resource" key
+type searchParams map[string]map[string]*searchParam
+
+var searchParamsCache = make(map[string]searchParams)
+var searchParamsMu sync.Mutex
+
+func getSearchParams(fhirVersion string) (searchParams, error) {
+	searchParamsMu.Lock()
+	defer searchParamsMu.Unlock()
+
+	if params, ok := searchParamsCache[fhirVersion]; ok {
+		return params, nil
+	}
+
+	data, err := searchFiles.ReadFile(path.Join("search", fmt.Sprintf("fhirbase-search-%s.json", fhirVersion)))
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot find search parameters for FHIR version %s", fhirVersion)
+	}
+
+	var params searchParams
+
+	if err := jsoniter.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("cannot parse search parameters for FHIR version %s: %v", fhirVersion, err)
+	}
+
+	searchParamsCache[fhirVersion] = params
+
+	return params, nil
+}
+
+// Lookup returns definition of the search parameter for the resource
+// type, or nil if there is no such parameter
+func (s searchParams) Lookup(rt string, name string) *searchParam {
+	if p := s[rt][name]; p != nil {
+		return p
+	}
+
+	return s["Resource"][name]
+}
+
+// resourceColumns are element paths which are kept in columns of
+// resource tables instead of resource jsonb
+var resourceColumns = map[string]string{
+	"id":               "id",
+	"meta.lastUpdated": "ts",
+}
+
+// searchJSONPath converts FHIR element path into SQL/JSON path over
+// resource transformed by Fhirbase, following the same transformation
+// rules: choice elements are moved under their type (valueQuantity
+// becomes value.Quantity) and renamed elements get their new key.
+func searchJSONPath(tr map[string]interface{}, rt string, elementPath string) string {
+	node, _ := tr[rt].(map[string]interface{})
+	keys := make([]string, 0)
+
+	for _, seg := range strings.Split(elementPath, ".") {
+		rule, next, _ := nextTransformRule(node, seg, tr, seg)
+
+		if rule == nil {
+			keys = append(keys, seg)
+			node = nil
+			continue
+		}
+
+		key := seg
+		args, _ := rule["tr/arg"].(map[string]interface{})
+
+		if argKey, ok := args["key"].(string); ok && argKey != "" {
+			key = argKey
+		}
+
+		keys = append(keys, key)
+		node = next
+
+		if act, _ := rule["tr/act"].(string); act == "union" {
+			ttype, _ := args["type"].(string)
+			keys = append(keys, ttype)
+
+			// rules of elements nested into the union value are kept
+			// either under key/type or under the type itself
+			parent, _ := node[key].(map[string]interface{})
+
+			if nested, ok := parent[ttype].(map[string]interface{}); ok {
+				node = nested
+			} else {
+				node, _ = tr[ttype].(map[string]interface{})
+			}
+		}
+	}
+
+	quoted := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		quoted = append(quoted, jsonPathString(k))
+	}
+
+	return "$." + strings.Join(quoted, ".")
+}
+
+// jsonPathString quotes s as a string literal of SQL/JSON path language
+func jsonPathString(s string) string {
+	b, _ := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(s)
+
+	return string(b)
+}
+
+// searchError is an error in search parameters, it's reported to the
+// client with 400 status
+type searchError struct {
+	code    string
+	message string
+}
+
+func (e *searchError) Error() string {
+	return e.message
+}
+
+func newSearchError(code string, format string, args ...interface{}) error {
+	return &searchError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+const (
+	defaultSearchCount = 50
+	maxSearchCount     = 1000
+)
+
+// search is a FHIR search translated into SQL
+type search struct {
+	rt       string
+	query    string
+	args     []interface{}
+	where    []string
+	orderBy  []string
+	sortArgs []interface{}
+	count    int
+	offset   int
+	total    bool
+	elements []string
+	includes []*searchInclude
+
+	// used keeps applied parameters for paging links
+	used url.Values
+}
+
+// arg adds query parameter, it returns its placeholder
+func (s *search) arg(v interface{}) string {
+	s.args = append(s.args, v)
+
+	return fmt.Sprintf("$%d", len(s.args))
+}
+
+// sortArg adds parameter of ORDER BY expression. Sort parameters are
+// numbered after the ones of conditions, so the conditions can be used
+// without them, all conditions have to be added before.
+func (s *search) sortArg(v interface{}) string {
+	s.sortArgs = append(s.sortArgs, v)
+
+	return fmt.Sprintf("$%d", len(s.args)+len(s.sortArgs))
+}
+
+// filteredSQL returns the query with all conditions applied
+func (s *search) filteredSQL() string {
+	query := s.query
+
+	for _, w := range s.where {
+		query += " AND " + w
+	}
+
+	return query
+}
+
+// SQL returns the query for a page of results, one more row than
+// requested is selected to find out if there is a next page
+func (s *search) SQL() (string, []interface{}) {
+	query := s.filteredSQL()
+	query += " ORDER BY " + strings.Join(append(s.orderBy, "id"), ", ")
+	query += fmt.Sprintf(" LIMIT %d OFFSET %d", s.count+1, s.offset)
+
+	return query, append(append([]interface{}{}, s.args...), s.sortArgs...)
+}
+
+// CountSQL returns the query for total number of matching resources
+func (s *search) CountSQL() (string, []interface{}) {
+	return "SELECT count(*) FROM (" + s.filteredSQL() + ") q", s.args
+}
+
+// link returns URL of the page starting at offset
+func (s *search) link(r *http.Request, offset int) string {
+	q := url.Values{}
+
+	for k, v := range s.used {
+		q[k] = v
+	}
+
+	q.Set("_count", strconv.Itoa(s.count))
+	q.Set("_offset", strconv.Itoa(offset))
+
+	return requestBaseURL(r) + fhirBasePath + "/" + s.rt + "?" + q.Encode()
+}
+
+// splitSearchValues splits comma-separated values, "\," is a literal
+// comma
+func splitSearchValues(value string) []string {
+	result := make([]string, 0, 1)
+	var cur strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && (value[i+1] == ',' || value[i+1] == '\\' || value[i+1] == '|' || value[i+1] == '$'):
+			cur.WriteByte(value[i+1])
+			i++
+		case value[i] == ',':
+			result = append(result, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(value[i])
+		}
+	}
+
+	return append(result, cur.String())
+}
+
+// parseSearch translates FHIR search parameters into SQL. Unknown
+// parameters are ignored unless strict handling is requested.
+func (a *restAPI) parseSearch(rt string, params url.Values, strict bool) (*search, error) {
+	definitions, err := getSearchParams(a.fhirVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := getTransformData(a.fhirVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &search{rt: rt, count: defaultSearchCount, used: url.Values{}}
+	s.query, s.args = a.layout.ResourceQuery(rt)
+	sortKeys := make([]string, 0)
+
+	for name, values := range params {
+		switch name {
+		case "_count", "_offset":
+			n, err := strconv.Atoi(values[0])
+
+			if err != nil || n < 0 {
+				return nil, newSearchError("invalid", "%s should be a non-negative integer", name)
+			}
+
+			if name == "_count" {
+				s.count = int(math.Min(float64(n), maxSearchCount))
+
+				// _count=0 asks for the number of matches only
+				s.total = s.total || n == 0
+			} else {
+				s.offset = n
+			}
+
+			continue
+		case "_total":
+			s.total = s.total || values[0] == "accurate"
+			s.used[name] = values
+
+			continue
+		case "_elements":
+			for _, v := range values {
+				s.elements = append(s.elements, strings.Split(v, ",")...)
+			}
+
+			s.used[name] = values
+
+			continue
+		case "_sort":
+			for _, v := range values {
+				sortKeys = append(sortKeys, strings.Split(v, ",")...)
+			}
+
+			s.used[name] = values
+
+			continue
+		case "_format", "_pretty":
+			continue
+		}
+
+		if strings.HasPrefix(name, "_include") || strings.HasPrefix(name, "_revinclude") {
+			for _, v := range values {
+				inc, err := a.parseInclude(definitions, name, v, strict)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if inc != nil {
+					s.includes = append(s.includes, inc)
+				}
+			}
+
+			s.used[name] = values
+
+			continue
+		}
+
+		paramName, modifier, _ := strings.Cut(name, ":")
+		param := definitions.Lookup(rt, paramName)
+
+		if param == nil {
+			if strict {
+				return nil, newSearchError("not-supported", "unknown search parameter %s for %s", paramName, rt)
+			}
+
+			continue
+		}
+
+		for _, value := range values {
+			cond, err := s.condition(tr, param, modifier, value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			s.where = append(s.where, cond)
+		}
+
+		s.used[name] = values
+	}
+
+	for _, key := range sortKeys {
+		if err := s.addSort(tr, definitions, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// condition returns SQL condition for a single occurrence of search
+// parameter, comma-separated values are ORed
+func (s *search) condition(tr map[string]interface{}, param *searchParam, modifier string, value string) (string, error) {
+	if modifier == "missing" {
+		if value != "true" && value != "false" {
+			return "", newSearchError("invalid", ":missing modifier expects true or false, got %s", value)
+		}
+
+		exists := make([]string, 0, len(param.Path))
+
+		for _, p := range param.Path {
+			if col, ok := resourceColumns[p]; ok {
+				exists = append(exists, col+" IS NOT NULL")
+			} else {
+				exists = append(exists, "resource @? "+s.arg(searchJSONPath(tr, s.rt, p))+"::jsonpath")
+			}
+		}
+
+		cond := "(" + strings.Join(exists, " OR ") + ")"
+
+		if value == "true" {
+			cond = "NOT " + cond
+		}
+
+		return cond, nil
+	}
+
+	ors := make([]string, 0)
+
+	for _, v := range splitSearchValues(value) {
+		for _, p := range param.Path {
+			cond, err := s.valueCondition(tr, param, p, modifier, v)
+
+			if err != nil {
+				return "", err
+			}
+
+			ors = append(ors, cond)
+		}
+	}
+
+	return "(" + strings.Join(ors, " OR ") + ")", nil
+}
+
+// valueCondition returns SQL condition matching a single value of the
+// search parameter against a single path
+func (s *search) valueCondition(tr map[string]interface{}, param *searchParam, elementPath string, modifier string, value string) (string, error) {
+	col, isColumn := resourceColumns[elementPath]
+	jsonPath := searchJSONPath(tr, s.rt, elementPath)
+
+	switch param.Type {
+	case "date":
+		if modifier != "" {
+			return "", newSearchError("not-supported", "modifier :%s is not supported for date parameters", modifier)
+		}
+
+		prefix, date := searchPrefix(value)
+
+		// "+" of time zone offset is often left unescaped in URLs
+		date = strings.ReplaceAll(date, " ", "+")
+
+		if !matchSearchDate.MatchString(date) {
+			return "", newSearchError("invalid", "invalid date %s", value)
+		}
+
+		param := s.arg(date) + "::text"
+
+		if isColumn {
+			return dateComparison(prefix, col, col+" + interval '1 microsecond'", dateLowerSQL(param), dateUpperSQL(param))
+		}
+
+		cmp, err := dateComparison(prefix, "coalesce("+dateLowerSQL("se.s")+", '-infinity')", "coalesce("+dateUpperSQL("se.e")+", 'infinity')", dateLowerSQL(param), dateUpperSQL(param))
+
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf(`EXISTS (SELECT 1 FROM jsonb_path_query(resource, %s::jsonpath) AS d(v),
+LATERAL (SELECT CASE WHEN jsonb_typeof(d.v) = 'object' THEN d.v->>'start' ELSE d.v #>> '{}' END AS s,
+CASE WHEN jsonb_typeof(d.v) = 'object' THEN d.v->>'end' ELSE d.v #>> '{}' END AS e) AS se
+WHERE %s)`, s.arg(jsonPath), cmp), nil
+
+	case "token":
+		if isColumn {
+			if modifier != "" && modifier != "not" {
+				return "", newSearchError("not-supported", "modifier :%s is not supported for %s", modifier, elementPath)
+			}
+
+			cond := fmt.Sprintf("%s = %s", col, s.arg(value))
+
+			if modifier == "not" {
+				cond = "NOT " + cond
+			}
+
+			return cond, nil
+		}
+
+		if modifier != "" && modifier != "not" {
+			return "", newSearchError("not-supported", "modifier :%s is not supported for token parameters", modifier)
+		}
+
+		cond := fmt.Sprintf("resource @? %s::jsonpath", s.arg(jsonPath+" ? ("+tokenPredicate(value)+")"))
+
+		if modifier == "not" {
+			cond = "NOT " + cond
+		}
+
+		return cond, nil
+
+	case "string":
+		var pred string
+
+		switch modifier {
+		case "":
+			pred = "@ like_regex " + jsonPathString("^"+regexp.QuoteMeta(value)) + ` flag "i"`
+		case "contains":
+			pred = "@ like_regex " + jsonPathString(regexp.QuoteMeta(value)) + ` flag "i"`
+		case "exact":
+			pred = "@ == " + jsonPathString(value)
+		default:
+			return "", newSearchError("not-supported", "modifier :%s is not supported for string parameters", modifier)
+		}
+
+		return fmt.Sprintf("resource @? %s::jsonpath", s.arg(jsonPath+`.** ? (@.type() == "string" && `+pred+")")), nil
+
+	case "uri":
+		var pred string
+
+		switch modifier {
+		case "":
+			pred = "@ == " + jsonPathString(value)
+		case "below":
+			pred = "@ starts with " + jsonPathString(value)
+		default:
+			return "", newSearchError("not-supported", "modifier :%s is not supported for uri parameters", modifier)
+		}
+
+		return fmt.Sprintf("resource @? %s::jsonpath", s.arg(jsonPath+" ? ("+pred+")")), nil
+
+	case "reference":
+		pred, err := referencePredicate(param, modifier, value)
+
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("resource @? %s::jsonpath", s.arg(jsonPath+" ? ("+pred+")")), nil
+
+	case "quantity", "number":
+		if modifier != "" {
+			return "", newSearchError("not-supported", "modifier :%s is not supported for %s parameters", modifier, param.Type)
+		}
+
+		pred, err := quantityPredicate(param.Type, value)
+
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("resource @? %s::jsonpath", s.arg(jsonPath+" ? ("+pred+")")), nil
+	}
+
+	return "", newSearchError("not-supported", "search parameters of type %s are not supported", param.Type)
+}
+
+var searchPrefixes = map[string]bool{
+	"eq": true, "ne": true, "gt": true, "lt": true, "ge": true,
+	"le": true, "sa": true, "eb": true, "ap": true,
+}
+
+// searchPrefix splits comparison prefix from the value, "eq" is the
+// default
+func searchPrefix(value string) (string, string) {
+	if len(value) > 2 && searchPrefixes[value[:2]] {
+		return value[:2], value[2:]
+	}
+
+	return "eq", value
+}
+
+var matchSearchDate = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2}(T\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:\d{2})?)?)?)?$`)
+
+// dateLowerSQL returns SQL expression for the start of the period
+// covered by FHIR date, dateTime or instant held in text expression x,
+// partial dates cover the whole year, month or day
+func dateLowerSQL(x string) string {
+	return fmt.Sprintf(`(CASE length(%[1]s) WHEN 4 THEN (%[1]s || '-01-01')::timestamptz WHEN 7 THEN (%[1]s || '-01')::timestamptz ELSE (%[1]s)::timestamptz END)`, x)
+}
+
+// dateUpperSQL returns SQL expression for the (exclusive) end of the
+// period covered by FHIR date, dateTime or instant
+func dateUpperSQL(x string) string {
+	return fmt.Sprintf(`(CASE length(%[1]s) WHEN 4 THEN (%[1]s || '-01-01')::timestamptz + interval '1 year' WHEN 7 THEN (%[1]s || '-01')::timestamptz + interval '1 month' WHEN 10 THEN (%[1]s)::timestamptz + interval '1 day' ELSE (%[1]s)::timestamptz + interval '1 microsecond' END)`, x)
+}
+
+// dateComparison compares period of the resource [lo, hi) with period
+// of the search value [ps, pe) according to the prefix
+func dateComparison(prefix string, lo string, hi string, ps string, pe string) (string, error) {
+	switch prefix {
+	case "eq":
+		return fmt.Sprintf("(%s >= %s AND %s <= %s)", lo, ps, hi, pe), nil
+	case "ne":
+		return fmt.Sprintf("NOT (%s >= %s AND %s <= %s)", lo, ps, hi, pe), nil
+	case "gt":
+		return fmt.Sprintf("%s > %s", hi, pe), nil
+	case "lt":
+		return fmt.Sprintf("%s < %s", lo, ps), nil
+	case "ge":
+		return fmt.Sprintf("%s > %s", hi, ps), nil
+	case "le":
+		return fmt.Sprintf("%s < %s", lo, pe), nil
+	case "sa":
+		return fmt.Sprintf("%s >= %s", lo, pe), nil
+	case "eb":
+		return fmt.Sprintf("%s <= %s", hi, ps), nil
+	case "ap":
+		return fmt.Sprintf("(%s < %s AND %s > %s)", lo, pe, hi, ps), nil
+	}
+
+	return "", newSearchError("not-supported", "prefix %s is not supported for dates", prefix)
+}
+
+// tokenPredicate returns SQL/JSON path filter matching [system]|[code]
+// token against code, Coding, CodeableConcept, Identifier or
+// ContactPoint
+func tokenPredicate(value string) string {
+	system, code, hasSystem := strings.Cut(value, "|")
+
+	if !hasSystem {
+		code = value
+		pred := fmt.Sprintf("@ == %[1]s || @.code == %[1]s || @.value == %[1]s || @.coding.code == %[1]s", jsonPathString(code))
+
+		if code == "true" || code == "false" {
+			pred += " || @ == " + code
+		}
+
+		return pred
+	}
+
+	if code == "" {
+		return fmt.Sprintf("@.system == %[1]s || @.coding.system == %[1]s", jsonPathString(system))
+	}
+
+	systemPred := "@.system == " + jsonPathString(system)
+
+	if system == "" {
+		systemPred = "!exists(@.system)"
+	}
+
+	return fmt.Sprintf("(%[1]s && (@.code == %[2]s || @.value == %[2]s)) || exists(@.coding ? (%[1]s && @.code == %[2]s))", systemPred, jsonPathString(code))
+}
+
+// referencePredicate returns SQL/JSON path filter matching a reference
+// transformed by Fhirbase ({"id": ..., "resourceType": ...}) or kept
+// as-is because it couldn't be transformed
+func referencePredicate(param *searchParam, modifier string, value string) (string, error) {
+	if modifier != "" && !isTypeName(modifier) {
+		return "", newSearchError("not-supported", "modifier :%s is not supported for reference parameters", modifier)
+	}
+
+	rt, id := modifier, value
+
+	// [type]/[id] or absolute URL of the referenced resource
+	if parts := strings.Split(value, "/"); len(parts) >= 2 {
+		rt, id = parts[len(parts)-2], parts[len(parts)-1]
+
+		if modifier != "" && modifier != rt {
+			return "", newSearchError("invalid", "reference %s doesn't match type modifier :%s", value, modifier)
+		}
+	}
+
+	if rt == "" && len(param.Target) == 1 {
+		// bare ids of single-target parameters, like Observation's
+		// "patient", are references to that type
+		rt = param.Target[0]
+	}
+
+	if rt == "" {
+		return fmt.Sprintf("@.id == %[1]s || @.reference == %[1]s", jsonPathString(id)), nil
+	}
+
+	// references without type are transformed into {"id": ...}, and
+	// absolute ones keep the whole URL in id
+	return fmt.Sprintf("(@.id == %[1]s && (!exists(@.resourceType) || @.resourceType == %[2]s)) || @.reference == %[3]s || @.id == %[4]s",
+		jsonPathString(id), jsonPathString(rt), jsonPathString(rt+"/"+id), jsonPathString(value)), nil
+}
+
+// quantityPredicate returns SQL/JSON path filter for quantity search
+// value [prefix][number]|[system]|[code] or number search value
+func quantityPredicate(paramType string, value string) (string, error) {
+	prefix, value := searchPrefix(value)
+	parts := strings.SplitN(value, "|", 3)
+	num, err := strconv.ParseFloat(parts[0], 64)
+
+	if err != nil {
+		return "", newSearchError("invalid", "invalid number %s", parts[0])
+	}
+
+	target := "@"
+
+	if paramType == "quantity" {
+		target = "@.value"
+	}
+
+	// equality is checked with the precision of the search value, so
+	// 5.4 matches values from 5.35 to 5.45
+	decimals := 0
+
+	if i := strings.Index(parts[0], "."); i >= 0 {
+		decimals = len(parts[0]) - i - 1
+	}
+
+	delta := 0.5 * math.Pow(10, -float64(decimals))
+	lo, hi := num-delta, num+delta
+
+	if prefix == "ap" {
+		lo, hi = num-math.Abs(num)*0.1, num+math.Abs(num)*0.1
+	}
+
+	n := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	var pred string
+
+	switch prefix {
+	case "eq", "ap":
+		pred = fmt.Sprintf("%[1]s >= %[2]s && %[1]s < %[3]s", target, n(lo), n(hi))
+	case "ne":
+		pred = fmt.Sprintf("!(%[1]s >= %[2]s && %[1]s < %[3]s)", target, n(lo), n(hi))
+	case "gt", "sa":
+		pred = fmt.Sprintf("%s > %s", target, n(num))
+	case "lt", "eb":
+		pred = fmt.Sprintf("%s < %s", target, n(num))
+	case "ge":
+		pred = fmt.Sprintf("%s >= %s", target, n(num))
+	case "le":
+		pred = fmt.Sprintf("%s <= %s", target, n(num))
+	}
+
+	if len(parts) > 1 && parts[1] != "" {
+		pred += " && @.system == " + jsonPathString(parts[1])
+	}
+
+	if len(parts) > 2 && parts[2] != "" {
+		pred += fmt.Sprintf(" && (@.code == %[1]s || @.unit == %[1]s)", jsonPathString(parts[2]))
+	}
+
+	return pred, nil
+}
+
+// addSort adds ORDER BY expression for _sort parameter key, "-" prefix
+// sorts in descending order
+func (s *search) addSort(tr map[string]interface{}, definitions searchParams, key string) error {
+	direction := "ASC"
+
+	if strings.HasPrefix(key, "-") {
+		direction = "DESC"
+		key = key[1:]
+	}
+
+	param := definitions.Lookup(s.rt, key)
+
+	if param == nil {
+		return newSearchError("not-supported", "unknown search parameter %s in _sort", key)
+	}
+
+	exprs := make([]string, 0, len(param.Path))
+
+	for _, p := range param.Path {
+		if col, ok := resourceColumns[p]; ok {
+			exprs = append(exprs, col)
+			continue
+		}
+
+		jsonPath := searchJSONPath(tr, s.rt, p)
+
+		switch param.Type {
+		case "date":
+			// ISO 8601 values sort fine as text, periods are sorted by
+			// their start
+			first := fmt.Sprintf("jsonb_path_query_first(resource, %s::jsonpath)", s.sortArg(jsonPath))
+			exprs = append(exprs, fmt.Sprintf("coalesce(%[1]s->>'start', %[1]s #>> '{}')", first))
+		case "quantity", "number":
+			if param.Type == "quantity" {
+				jsonPath += `."value"`
+			}
+
+			exprs = append(exprs, fmt.Sprintf("(jsonb_path_query_first(resource, %s::jsonpath))::numeric", s.sortArg(jsonPath)))
+		case "reference":
+			exprs = append(exprs, fmt.Sprintf("(jsonb_path_query_first(resource, %s::jsonpath) #>> '{}')", s.sortArg(jsonPath+`."id"`)))
+		case "token":
+			for _, suffix := range []string{`."coding"."code"`, `."code"`, `."value"`, ""} {
+				exprs = append(exprs, fmt.Sprintf("(jsonb_path_query_first(resource, %s::jsonpath) #>> '{}')", s.sortArg(jsonPath+suffix)))
+			}
+		default:
+			exprs = append(exprs, fmt.Sprintf("lower(jsonb_path_query_first(resource, %s::jsonpath) #>> '{}')", s.sortArg(jsonPath+`.** ? (@.type() == "string")`)))
+		}
+	}
+
+	s.orderBy = append(s.orderBy, fmt.Sprintf("coalesce(%s) %s NULLS LAST", strings.Join(exprs, ", "), direction))
+
+	return nil
+}
+
+// filterElements keeps only requested top-level elements of the
+// resource, choice elements can be requested without the type suffix
+func filterElements(res map[string]interface{}, elements []string) map[string]interface{} {
+	result := map[string]interface{}{
+		"resourceType": res["resourceType"],
+		"id":           res["id"],
+	}
+
+	for k, v := range res {
+		for _, el := range elements {
+			el = strings.TrimSpace(el)
+
+			if k == el || (strings.HasPrefix(k, el) && len(k) > len(el) && isTypeName(k[len(el):])) {
+				result[k] = v
+			}
+		}
+	}
+
+	meta, _ := res["meta"].(map[string]interface{})
+	newMeta := make(map[string]interface{})
+
+	for k, v := range meta {
+		newMeta[k] = v
+	}
+
+	tags, _ := newMeta["tag"].([]interface{})
+	newMeta["tag"] = append(tags, map[string]interface{}{
+		"system": "http://terminology.hl7.org/CodeSystem/v3-ObservationValue",
+		"code":   "SUBSETTED",
+	})
+	result["meta"] = newMeta
+
+	return result
+}
+
+// searchEntry returns Bundle entry for a resource found by the search,
+// mode is either "match" or "include"
+func (a *restAPI) searchEntry(r *http.Request, s *search, res map[string]interface{}, mode string) (map[string]interface{}, error) {
+	res, _, err := doReverseTransform(res, a.fhirVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.elements) > 0 {
+		res = filterElements(res, s.elements)
+	}
+
+	return map[string]interface{}{
+		"fullUrl":  fmt.Sprintf("%s%s/%s/%s", requestBaseURL(r), fhirBasePath, res["resourceType"], res["id"]),
+		"resource": res,
+		"search":   map[string]interface{}{"mode": mode},
+	}, nil
+}
+
+// searchHandler implements search interaction: GET [base]/[type]?params
+// and POST [base]/[type]/_search
+func (a *restAPI) searchHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := a.resourceType(w, r)
+
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "cannot parse search parameters: %v", err)
+		return
+	}
+
+	strict := strings.Contains(r.Header.Get("Prefer"), "handling=strict")
+	s, err := a.parseSearch(rt, r.Form, strict)
+
+	if err != nil {
+		if serr, ok := err.(*searchError); ok {
+			writeOperationOutcome(w, http.StatusBadRequest, serr.code, "%v", serr)
+		} else {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		}
+
+		return
+	}
+
+	ctx := r.Context()
+	bundle := map[string]interface{}{
+		"resourceType": "Bundle",
+		"id":           uuid.New().String(),
+		"meta":         map[string]interface{}{"lastUpdated": time.Now().UTC().Format(time.RFC3339Nano)},
+		"type":         "searchset",
+	}
+
+	if s.total {
+		var total int64
+		query, args := s.CountSQL()
+
+		if err := a.db.QueryRow(ctx, query, args...).Scan(&total); err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			return
+		}
+
+		bundle["total"] = total
+	}
+
+	query, args := s.SQL()
+	rows, err := a.db.Query(ctx, query, args...)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	defer rows.Close()
+
+	entries := make([]interface{}, 0)
+	matches := make([]string, 0)
+	hasNext := false
+
+	for s.count > 0 && rows.Next() {
+		if len(entries) == s.count {
+			hasNext = true
+			break
+		}
+
+		var res map[string]interface{}
+
+		if err := rows.Scan(&res); err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			return
+		}
+
+		id, _ := res["id"].(string)
+		matches = append(matches, id)
+
+		entry, err := a.searchEntry(r, s, res, "match")
+
+		if err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			return
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	rows.Close()
+	included, err := a.resolveIncludes(ctx, s, matches)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+		return
+	}
+
+	for _, res := range included {
+		entry, err := a.searchEntry(r, s, res, "include")
+
+		if err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "exception", "%v", err)
+			return
+		}
+
+		entries = append(entries, entry)
+	}
+
+	links := []interface{}{
+		map[string]interface{}{"relation": "self", "url": s.link(r, s.offset)},
+		map[string]interface{}{"relation": "first", "url": s.link(r, 0)},
+	}
+
+	if s.offset > 0 && s.count > 0 {
+		links = append(links, map[string]interface{}{"relation": "previous", "url": s.link(r, int(math.Max(0, float64(s.offset-s.count))))})
+	}
+
+	if hasNext {
+		links = append(links, map[string]interface{}{"relation": "next", "url": s.link(r, s.offset+s.count)})
+	}
+
+	bundle["link"] = links
+	bundle["entry"] = entries
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	jsoniter.NewEncoder(w).Encode(bundle)
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var matchPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// maxPlaceholder returns the highest $N placeholder of the query
+func maxPlaceholder(query string) int {
+	n := 0
+
+	for _, m := range matchPlaceholder.FindAllStringSubmatch(query, -1) {
+		if i, _ := strconv.Atoi(m[1]); i > n {
+			n = i
+		}
+	}
+
+	return n
+}
+
+func testSearch(t *testing.T, layout tableLayout, query string) *search {
+	t.Helper()
+
+	params, err := url.ParseQuery(query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &restAPI{layout: layout, fhirVersion: "4.0.0", types: map[string]bool{"Patient": true}}
+	s, err := a.parseSearch("Patient", params, true)
+
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+
+	return s
+}
+
+func TestSearchSQLArgs(t *testing.T) {
+	queries := []string{
+		"name=smith",
+		"_sort=birthdate&_total=accurate",
+		"_sort=-birthdate,name&gender=female&name=smith&_total=accurate",
+		"birthdate=ge2000-01-01&_sort=gender&identifier=http://acme.org|123",
+	}
+
+	for _, layout := range []tableLayout{tablesLayout, partitionedLayout} {
+		for _, q := range queries {
+			// parameters are parsed in random order, so repeat a few times
+			for i := 0; i < 10; i++ {
+				s := testSearch(t, layout, q)
+
+				query, args := s.SQL()
+
+				if n := maxPlaceholder(query); n != len(args) {
+					t.Errorf("%s %s: SQL has %d placeholders and %d args: %s", layout, q, n, len(args), query)
+				}
+
+				query, args = s.CountSQL()
+
+				if n := maxPlaceholder(query); n != len(args) {
+					t.Errorf("%s %s: CountSQL has %d placeholders and %d args: %s", layout, q, n, len(args), query)
+				}
+			}
+		}
+	}
+}
+
+func TestSearchCountZero(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		s := testSearch(t, tablesLayout, "_count=0&_total=none")
+
+		if s.count != 0 || !s.total {
+			t.Fatalf("_count=0 should ask for total only, got count %d and total %v", s.count, s.total)
+		}
+	}
+}
+
+func TestSearchInvalidCount(t *testing.T) {
+	a := &restAPI{layout: tablesLayout, fhirVersion: "4.0.0"}
+
+	for _, q := range []string{"_count=-1", "_count=abc", "_offset=-5"} {
+		params, _ := url.ParseQuery(q)
+
+		if _, err := a.parseSearch("Patient", params, false); err == nil {
+			t.Errorf("%s: expected error", q)
+		}
+	}
+}
+
+func TestSearchJSONPath(t *testing.T) {
+	tr, err := getTransformData("4.0.0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rt       string
+		path     string
+		expected string
+	}{
+		{"Patient", "name.family", `$."name"."family"`},
+		{"Observation", "subject", `$."subject"`},
+		// choice elements are moved under their type
+		{"Observation", "effectiveDateTime", `$."effective"."dateTime"`},
+		{"Observation", "component.valueQuantity", `$."component"."value"."Quantity"`},
+		{"Patient", "multipleBirthInteger", `$."multipleBirth"."integer"`},
+		// elements without rules are kept as is
+		{"Patient", "unknownElement.x", `$."unknownElement"."x"`},
+	}
+
+	for _, tt := range tests {
+		if path := searchJSONPath(tr, tt.rt, tt.path); path != tt.expected {
+			t.Errorf("%s.%s: got %s, want %s", tt.rt, tt.path, path, tt.expected)
+		}
+	}
+}
+
+func TestSearchJSONPathRenamed(t *testing.T) {
+	useTransformRules(t, `{"Patient": {"gender": {"tr/act": "rename", "tr/arg": {"key": "sex"}}}}`)
+
+	tr, err := getTransformData("4.0.0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path := searchJSONPath(tr, "Patient", "gender"); path != `$."sex"` {
+		t.Errorf("got %s, want $.\"sex\"", path)
+	}
+}
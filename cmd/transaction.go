@@ -0,0 +1,715 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// entryError is an error of a single Bundle entry with HTTP status
+// reported for it
+type entryError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *entryError) Error() string {
+	return e.message
+}
+
+func newEntryError(status int, code string, format string, args ...interface{}) error {
+	return &entryError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// asEntryError converts any error into entryError, search errors are
+// caused by the request
+func asEntryError(err error) *entryError {
+	switch e := err.(type) {
+	case *entryError:
+		return e
+	case *searchError:
+		return &entryError{status: http.StatusBadRequest, code: e.code, message: e.message}
+	}
+
+	return &entryError{status: http.StatusInternalServerError, code: "exception", message: err.Error()}
+}
+
+// bundleEntry is an entry of transaction or batch Bundle
+type bundleEntry struct {
+	fullURL     string
+	method      string
+	url         string
+	ifMatch     string
+	ifNoneExist string
+	resource    map[string]interface{}
+
+	// resource type, id and search parameters of conditional
+	// interactions, parsed from url
+	rt    string
+	id    string
+	query url.Values
+
+	// exists tells that conditional create found the resource
+	exists bool
+
+	response map[string]interface{}
+}
+
+// parseBundleEntry reads request of the Bundle entry
+func (a *restAPI) parseBundleEntry(raw interface{}) (*bundleEntry, error) {
+	entry, _ := raw.(map[string]interface{})
+	request, _ := entry["request"].(map[string]interface{})
+
+	if request == nil {
+		return nil, newEntryError(http.StatusBadRequest, "invalid", "entry has no request")
+	}
+
+	e := &bundleEntry{}
+	e.fullURL, _ = entry["fullUrl"].(string)
+	e.resource, _ = entry["resource"].(map[string]interface{})
+	e.method, _ = request["method"].(string)
+	e.url, _ = request["url"].(string)
+	e.ifMatch, _ = request["ifMatch"].(string)
+	e.ifNoneExist, _ = request["ifNoneExist"].(string)
+	e.method = strings.ToUpper(e.method)
+
+	// absolute URLs of this server are accepted as well
+	if i := strings.Index(e.url, fhirBasePath+"/"); i >= 0 && strings.Contains(e.url, "://") {
+		e.url = e.url[i+len(fhirBasePath)+1:]
+	}
+
+	e.url = strings.TrimPrefix(e.url, "/")
+
+	if e.method == "GET" || e.method == "HEAD" {
+		e.method = "GET"
+		return e, nil
+	}
+
+	path, rawQuery, conditional := strings.Cut(e.url, "?")
+	parts := strings.Split(path, "/")
+	e.rt = parts[0]
+
+	if !a.types[e.rt] {
+		return nil, newEntryError(http.StatusNotFound, "not-supported", "unknown resource type %s in %s", e.rt, e.url)
+	}
+
+	if conditional {
+		query, err := url.ParseQuery(rawQuery)
+
+		if err != nil {
+			return nil, newEntryError(http.StatusBadRequest, "invalid", "cannot parse %s: %v", e.url, err)
+		}
+
+		e.query = query
+	}
+
+	switch {
+	case len(parts) == 2 && !conditional:
+		e.id = parts[1]
+
+		if !matchResourceID.MatchString(e.id) {
+			return nil, newEntryError(http.StatusBadRequest, "invalid", "invalid resource id %s", e.id)
+		}
+	case len(parts) != 1:
+		return nil, newEntryError(http.StatusBadRequest, "invalid", "unsupported request url %s", e.url)
+	}
+
+	switch e.method {
+	case "POST":
+		if e.id != "" || conditional {
+			return nil, newEntryError(http.StatusBadRequest, "invalid", "POST url should be a resource type, got %s", e.url)
+		}
+	case "PUT", "DELETE":
+		if e.id == "" && !conditional {
+			return nil, newEntryError(http.StatusBadRequest, "invalid", "%s url should be [type]/[id] or [type]?[search parameters], got %s", e.method, e.url)
+		}
+	default:
+		return nil, newEntryError(http.StatusMethodNotAllowed, "not-supported", "method %s is not supported", e.method)
+	}
+
+	if e.method != "DELETE" {
+		if e.resource == nil {
+			return nil, newEntryError(http.StatusBadRequest, "invalid", "%s %s entry has no resource", e.method, e.url)
+		}
+
+		if resType, _ := e.resource["resourceType"].(string); resType != e.rt {
+			return nil, newEntryError(http.StatusBadRequest, "invalid", "expecting %s resource, got %q", e.rt, resType)
+		}
+
+		if resID, _ := e.resource["id"].(string); e.method == "PUT" && e.id != "" && resID != e.id {
+			return nil, newEntryError(http.StatusBadRequest, "invalid", "resource id should match id in the url %s", e.url)
+		}
+	}
+
+	return e, nil
+}
+
+// conditionalMatch returns ids of resources matching search parameters
+// of conditional interaction, at most two as more than one match is an
+// error anyway
+func (a *restAPI) conditionalMatch(ctx context.Context, tx pgx.Tx, rt string, query url.Values) ([]string, error) {
+	s, err := a.parseSearch(rt, query, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, "SELECT q.resource->>'id' FROM ("+s.filteredSQL()+") AS q(resource) LIMIT 2", s.args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := make([]string, 0, 2)
+
+	for rows.Next() {
+		var id string
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// resolveTarget figures out id of the resource for POST and conditional
+// PUT and DELETE entries. Ids of new resources are assigned here, so
+// other entries can reference them before they are stored.
+func (a *restAPI) resolveTarget(ctx context.Context, tx pgx.Tx, e *bundleEntry) error {
+	query := e.query
+
+	if e.method == "POST" && e.ifNoneExist != "" {
+		q, err := url.ParseQuery(strings.TrimPrefix(e.ifNoneExist, "?"))
+
+		if err != nil {
+			return newEntryError(http.StatusBadRequest, "invalid", "cannot parse ifNoneExist %s: %v", e.ifNoneExist, err)
+		}
+
+		query = q
+	}
+
+	if query == nil {
+		if e.method == "POST" {
+			e.id = uuid.New().String()
+		}
+
+		return nil
+	}
+
+	ids, err := a.conditionalMatch(ctx, tx, e.rt, query)
+
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > 1 {
+		return newEntryError(http.StatusPreconditionFailed, "multiple-matches", "%s %s matches more than one resource", e.method, e.url)
+	}
+
+	switch {
+	case len(ids) == 1:
+		e.id = ids[0]
+		e.exists = e.method == "POST"
+	case e.method == "POST":
+		e.id = uuid.New().String()
+	case e.method == "PUT":
+		// conditional update creates the resource if nothing matches
+		e.id, _ = e.resource["id"].(string)
+
+		if e.id == "" {
+			e.id = uuid.New().String()
+		}
+	}
+
+	if e.method == "PUT" {
+		if resID, ok := e.resource["id"].(string); ok && resID != e.id {
+			return newEntryError(http.StatusBadRequest, "invalid", "resource id %s doesn't match %s/%s found by %s", resID, e.rt, e.id, e.url)
+		}
+	}
+
+	return nil
+}
+
+// resolveReferences replaces references to resources created by the
+// transaction (urn:uuid: full URLs) with their assigned ids, and
+// conditional references ([type]?[parameters]) with ids of the matching
+// resources
+func (a *restAPI) resolveReferences(ctx context.Context, tx pgx.Tx, node interface{}, ids map[string]string) error {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			ref, ok := v.(string)
+
+			if k != "reference" || !ok {
+				if err := a.resolveReferences(ctx, tx, v, ids); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if resolved, ok := ids[ref]; ok {
+				n[k] = resolved
+				continue
+			}
+
+			rt, rawQuery, conditional := strings.Cut(ref, "?")
+
+			if !conditional || !a.types[rt] {
+				continue
+			}
+
+			query, err := url.ParseQuery(rawQuery)
+
+			if err != nil {
+				return newEntryError(http.StatusBadRequest, "invalid", "cannot parse reference %s: %v", ref, err)
+			}
+
+			matches, err := a.conditionalMatch(ctx, tx, rt, query)
+
+			if err != nil {
+				return err
+			}
+
+			if len(matches) != 1 {
+				return newEntryError(http.StatusPreconditionFailed, "not-found", "conditional reference %s matches %d resources, expected one", ref, len(matches))
+			}
+
+			n[k] = rt + "/" + matches[0]
+		}
+	case []interface{}:
+		for _, v := range n {
+			if err := a.resolveReferences(ctx, tx, v, ids); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// entryResponse makes response of the entry for the stored resource
+func (a *restAPI) entryResponse(r *http.Request, status string, res map[string]interface{}) (map[string]interface{}, error) {
+	versionID, lastUpdated := resourceMeta(res)
+	response := map[string]interface{}{
+		"status":   status,
+		"etag":     versionETag(versionID),
+		"location": resourceLocation(r, res),
+	}
+
+	if lastUpdated != "" {
+		response["lastModified"] = lastUpdated
+	}
+
+	entry := map[string]interface{}{"response": response}
+
+	if !preferMinimal(r) {
+		res, _, err := doReverseTransform(res, a.fhirVersion)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry["resource"] = res
+		entry["fullUrl"] = fmt.Sprintf("%s%s/%s/%s", requestBaseURL(r), fhirBasePath, res["resourceType"], res["id"])
+	}
+
+	return entry, nil
+}
+
+// executeEntry stores changes of DELETE, POST or PUT entry with the
+// provided txid, targets of the entry should be already resolved
+func (a *restAPI) executeEntry(ctx context.Context, r *http.Request, tx pgx.Tx, txid int64, e *bundleEntry) error {
+	var current map[string]interface{}
+
+	if e.method != "POST" {
+		res, err := a.lockResource(ctx, tx, e.rt, e.id)
+
+		if err != nil {
+			return err
+		}
+
+		current = res
+	}
+
+	if e.ifMatch != "" {
+		if current == nil {
+			return newEntryError(http.StatusPreconditionFailed, "conflict", "%s/%s doesn't exist, but ifMatch was provided", e.rt, e.id)
+		}
+
+		if versionID, _ := resourceMeta(current); parseETag(e.ifMatch) != versionID {
+			return newEntryError(http.StatusPreconditionFailed, "conflict", "version %s of %s/%s doesn't match current version %s", parseETag(e.ifMatch), e.rt, e.id, versionID)
+		}
+	}
+
+	switch e.method {
+	case "DELETE":
+		if current != nil {
+			if _, err := tx.Exec(ctx, "SELECT fhirbase_delete($1, $2, $3)", e.rt, e.id, txid); err != nil {
+				return err
+			}
+		}
+
+		e.response = map[string]interface{}{"response": map[string]interface{}{"status": "204 No Content"}}
+
+		return nil
+	case "POST":
+		if e.exists {
+			// conditional create found the resource, it's returned as is
+			res, err := a.lockResource(ctx, tx, e.rt, e.id)
+
+			if err != nil {
+				return err
+			}
+
+			e.response, err = a.entryResponse(r, "200 OK", res)
+
+			return err
+		}
+	}
+
+	e.resource["id"] = e.id
+	res, _, err := doTransform(e.resource, a.fhirVersion, a.strict)
+
+	if err != nil {
+		return newEntryError(http.StatusBadRequest, "invalid", "%v", err)
+	}
+
+	status := "201 Created"
+	query := "SELECT fhirbase_create($1::jsonb, $2)"
+
+	if e.method == "PUT" {
+		query = "SELECT fhirbase_update($1::jsonb, $2)"
+
+		if current != nil {
+			status = "200 OK"
+		}
+	}
+
+	var stored map[string]interface{}
+
+	if err := tx.QueryRow(ctx, query, res, txid).Scan(&stored); err != nil {
+		return err
+	}
+
+	e.response, err = a.entryResponse(r, status, stored)
+
+	return err
+}
+
+// entryResponseWriter collects response of GET entry served by the
+// router
+type entryResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *entryResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *entryResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *entryResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// readEntry performs GET entry (read, vread, search or history) with
+// the same handlers which serve these interactions
+func (a *restAPI) readEntry(r *http.Request, e *bundleEntry) {
+	req, err := http.NewRequestWithContext(r.Context(), "GET", fhirBasePath+"/"+e.url, nil)
+
+	if err != nil {
+		e.response = errorEntry(newEntryError(http.StatusBadRequest, "invalid", "invalid request url %s: %v", e.url, err))
+		return
+	}
+
+	req.Host = r.Host
+	req.TLS = r.TLS
+	w := &entryResponseWriter{header: http.Header{}}
+	a.router.ServeHTTP(w, req)
+
+	response := map[string]interface{}{"status": fmt.Sprintf("%d %s", w.status, http.StatusText(w.status))}
+
+	for header, key := range map[string]string{"ETag": "etag", "Last-Modified": "lastModified", "Location": "location"} {
+		if v := w.header.Get(header); v != "" {
+			response[key] = v
+		}
+	}
+
+	e.response = map[string]interface{}{"response": response}
+
+	var res map[string]interface{}
+
+	if err := jsoniter.Unmarshal(w.body.Bytes(), &res); err != nil {
+		return
+	}
+
+	if w.status >= 400 {
+		response["outcome"] = res
+	} else {
+		e.response["resource"] = res
+	}
+}
+
+// errorEntry returns response entry of the failed batch entry
+func errorEntry(err error) map[string]interface{} {
+	e := asEntryError(err)
+
+	return map[string]interface{}{
+		"response": map[string]interface{}{
+			"status": fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+			"outcome": map[string]interface{}{
+				"resourceType": "OperationOutcome",
+				"issue": []interface{}{
+					map[string]interface{}{"severity": "error", "code": e.code, "diagnostics": e.message},
+				},
+			},
+		},
+	}
+}
+
+// transactionOrder lists methods in the order required by FHIR for
+// entries of a transaction: deletes, creates and updates; reads go
+// after all of them
+var transactionOrder = []string{"DELETE", "POST", "PUT"}
+
+// entriesWithMethod returns entries with the method in their Bundle order
+func entriesWithMethod(entries []*bundleEntry, method string) []*bundleEntry {
+	result := make([]*bundleEntry, 0, len(entries))
+
+	for _, e := range entries {
+		if e.method == method {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// runTransaction performs all entries in a single database transaction
+// with the same txid, taken from the transaction row which keeps the
+// Bundle. Any failed entry rolls the whole transaction back.
+func (a *restAPI) runTransaction(r *http.Request, bundle map[string]interface{}, entries []*bundleEntry) error {
+	ctx := r.Context()
+	tx, err := a.db.Begin(ctx)
+
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %v", err)
+	}
+
+	defer tx.Rollback(context.Background())
+
+	var txid int64
+
+	if err := tx.QueryRow(ctx, "INSERT INTO transaction (resource) VALUES ($1) RETURNING id", bundle).Scan(&txid); err != nil {
+		return fmt.Errorf("cannot save transaction: %v", err)
+	}
+
+	touched := make(map[string]bool)
+	ids := make(map[string]string)
+
+	for _, method := range transactionOrder {
+		for _, e := range entriesWithMethod(entries, method) {
+			if err := a.resolveTarget(ctx, tx, e); err != nil {
+				return err
+			}
+
+			if e.id == "" {
+				// conditional delete which matched nothing
+				e.response = map[string]interface{}{"response": map[string]interface{}{"status": "204 No Content"}}
+				continue
+			}
+
+			key := e.rt + "/" + e.id
+
+			if touched[key] {
+				return newEntryError(http.StatusBadRequest, "invalid", "%s is changed by more than one entry", key)
+			}
+
+			touched[key] = true
+
+			if e.fullURL != "" {
+				ids[e.fullURL] = key
+			}
+
+			// deletes go first, so their targets can be found again
+			if method == "DELETE" {
+				if err := a.executeEntry(ctx, r, tx, txid, e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// deletes are executed already
+	for _, method := range transactionOrder[1:] {
+		changes := entriesWithMethod(entries, method)
+
+		for _, e := range changes {
+			if e.exists {
+				continue
+			}
+
+			if err := a.resolveReferences(ctx, tx, e.resource, ids); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range changes {
+			if err := a.executeEntry(ctx, r, tx, txid, e); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// runBatchEntry performs a single entry of batch Bundle in its own
+// database transaction
+func (a *restAPI) runBatchEntry(r *http.Request, e *bundleEntry) error {
+	ctx := r.Context()
+	tx, err := a.db.Begin(ctx)
+
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %v", err)
+	}
+
+	defer tx.Rollback(context.Background())
+
+	if err := a.resolveTarget(ctx, tx, e); err != nil {
+		return err
+	}
+
+	if e.id == "" {
+		e.response = map[string]interface{}{"response": map[string]interface{}{"status": "204 No Content"}}
+		return nil
+	}
+
+	if err := a.resolveReferences(ctx, tx, e.resource, nil); err != nil {
+		return err
+	}
+
+	var txid int64
+
+	if err := tx.QueryRow(ctx, "SELECT nextval('transaction_id_seq')").Scan(&txid); err != nil {
+		return err
+	}
+
+	if err := a.executeEntry(ctx, r, tx, txid, e); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// bundleHandler implements transaction and batch interactions: POST [base]
+// with Bundle of type "transaction" or "batch"
+func (a *restAPI) bundleHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "cannot read request body: %v", err)
+		return
+	}
+
+	var bundle map[string]interface{}
+
+	if err := jsoniter.Unmarshal(body, &bundle); err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "cannot parse Bundle: %v", err)
+		return
+	}
+
+	bundleType, _ := bundle["type"].(string)
+
+	if rt, _ := bundle["resourceType"].(string); rt != "Bundle" || (bundleType != "transaction" && bundleType != "batch") {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", "expecting Bundle of type transaction or batch")
+		return
+	}
+
+	rawEntries, _ := bundle["entry"].([]interface{})
+	entries := make([]*bundleEntry, len(rawEntries))
+
+	for i, raw := range rawEntries {
+		e, err := a.parseBundleEntry(raw)
+
+		if err != nil && bundleType == "transaction" {
+			ee := asEntryError(err)
+			writeOperationOutcome(w, ee.status, ee.code, "entry %d: %s", i, ee.message)
+			return
+		}
+
+		if err != nil {
+			e = &bundleEntry{response: errorEntry(err)}
+		}
+
+		entries[i] = e
+	}
+
+	if bundleType == "transaction" {
+		if err := a.runTransaction(r, bundle, entries); err != nil {
+			ee := asEntryError(err)
+			writeOperationOutcome(w, ee.status, ee.code, "%s", ee.message)
+			return
+		}
+	} else {
+		for _, e := range entries {
+			if e.response != nil || e.method == "GET" {
+				continue
+			}
+
+			if err := a.runBatchEntry(r, e); err != nil {
+				e.response = errorEntry(err)
+			}
+		}
+	}
+
+	// reads see results of all changes made by the Bundle
+	for _, e := range entries {
+		if e.method == "GET" && e.response == nil {
+			a.readEntry(r, e)
+		}
+	}
+
+	responses := make([]interface{}, 0, len(entries))
+
+	for _, e := range entries {
+		responses = append(responses, e.response)
+	}
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	jsoniter.NewEncoder(w).Encode(map[string]interface{}{
+		"resourceType": "Bundle",
+		"id":           uuid.New().String(),
+		"meta":         map[string]interface{}{"lastUpdated": time.Now().UTC().Format(time.RFC3339Nano)},
+		"type":         bundleType + "-response",
+		"entry":        responses,
+	})
+}
@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func transactionTestAPI() *restAPI {
+	a := &restAPI{layout: tablesLayout, fhirVersion: "4.0.0", types: map[string]bool{"Patient": true, "Observation": true}}
+	registerRestHandlers(http.NewServeMux(), a)
+
+	return a
+}
+
+// parseEntries parses entries of the Bundle, failing on any error
+func parseEntries(t *testing.T, a *restAPI, bundle string) []*bundleEntry {
+	t.Helper()
+
+	var raw map[string]interface{}
+	jsoniter.UnmarshalFromString(bundle, &raw)
+	entries := make([]*bundleEntry, 0)
+
+	for i, r := range raw["entry"].([]interface{}) {
+		e, err := a.parseBundleEntry(r)
+
+		if err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+func TestParseBundleEntry(t *testing.T) {
+	entries := parseEntries(t, transactionTestAPI(), `{"entry": [
+		{"request": {"method": "PUT", "url": "Patient/pt-1"}, "resource": {"resourceType": "Patient", "id": "pt-1"}},
+		{"request": {"method": "put", "url": "http://fhirbase.test/fhir/Patient?identifier=123"}, "resource": {"resourceType": "Patient"}},
+		{"request": {"method": "POST", "url": "/Observation", "ifNoneExist": "code=1"}, "fullUrl": "urn:uuid:1", "resource": {"resourceType": "Observation"}},
+		{"request": {"method": "DELETE", "url": "Observation?subject=Patient/pt-1"}},
+		{"request": {"method": "HEAD", "url": "Patient/pt-1/_history"}}
+	]}`)
+
+	expected := []struct {
+		method string
+		rt     string
+		id     string
+		query  string
+	}{
+		{"PUT", "Patient", "pt-1", ""},
+		{"PUT", "Patient", "", "identifier=123"},
+		{"POST", "Observation", "", ""},
+		{"DELETE", "Observation", "", "subject=Patient%2Fpt-1"},
+		{"GET", "", "", ""},
+	}
+
+	for i, e := range entries {
+		if e.method != expected[i].method || e.rt != expected[i].rt || e.id != expected[i].id || e.query.Encode() != expected[i].query {
+			t.Errorf("entry %d: got %s %s %s %s, want %+v", i, e.method, e.rt, e.id, e.query.Encode(), expected[i])
+		}
+	}
+
+	if entries[2].fullURL != "urn:uuid:1" || entries[2].ifNoneExist != "code=1" || entries[4].url != "Patient/pt-1/_history" {
+		t.Errorf("got entries %+v %+v", entries[2], entries[4])
+	}
+}
+
+func TestParseBundleEntryInvalid(t *testing.T) {
+	a := transactionTestAPI()
+
+	tests := []struct {
+		entry  string
+		status int
+	}{
+		{`{"resource": {"resourceType": "Patient"}}`, http.StatusBadRequest},
+		{`{"request": {"method": "POST", "url": "Encounter"}, "resource": {"resourceType": "Encounter"}}`, http.StatusNotFound},
+		{`{"request": {"method": "POST", "url": "Patient/pt-1"}, "resource": {"resourceType": "Patient"}}`, http.StatusBadRequest},
+		{`{"request": {"method": "POST", "url": "Patient"}}`, http.StatusBadRequest},
+		{`{"request": {"method": "POST", "url": "Patient"}, "resource": {"resourceType": "Observation"}}`, http.StatusBadRequest},
+		{`{"request": {"method": "PUT", "url": "Patient"}, "resource": {"resourceType": "Patient"}}`, http.StatusBadRequest},
+		{`{"request": {"method": "PUT", "url": "Patient/pt-1"}, "resource": {"resourceType": "Patient", "id": "pt-2"}}`, http.StatusBadRequest},
+		{`{"request": {"method": "DELETE", "url": "Patient/pt_1"}}`, http.StatusBadRequest},
+		{`{"request": {"method": "PATCH", "url": "Patient/pt-1"}}`, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		var raw interface{}
+		jsoniter.UnmarshalFromString(tt.entry, &raw)
+
+		_, err := a.parseBundleEntry(raw)
+
+		if err == nil || asEntryError(err).status != tt.status {
+			t.Errorf("%s: got %v, want error with status %d", tt.entry, err, tt.status)
+		}
+	}
+}
+
+func TestTransactionOrder(t *testing.T) {
+	entries := parseEntries(t, transactionTestAPI(), `{"entry": [
+		{"request": {"method": "GET", "url": "Patient?name=smith"}},
+		{"request": {"method": "PUT", "url": "Patient/pt-1"}, "resource": {"resourceType": "Patient", "id": "pt-1"}},
+		{"request": {"method": "POST", "url": "Observation"}, "resource": {"resourceType": "Observation"}},
+		{"request": {"method": "DELETE", "url": "Patient/pt-2"}},
+		{"request": {"method": "POST", "url": "Patient"}, "resource": {"resourceType": "Patient"}},
+		{"request": {"method": "DELETE", "url": "Observation/obs-1"}}
+	]}`)
+
+	order := make([]string, 0)
+
+	for _, method := range transactionOrder {
+		for _, e := range entriesWithMethod(entries, method) {
+			order = append(order, e.method+" "+e.url)
+		}
+	}
+
+	expected := "DELETE Patient/pt-2, DELETE Observation/obs-1, POST Observation, POST Patient, PUT Patient/pt-1"
+
+	if strings.Join(order, ", ") != expected {
+		t.Errorf("got %s, want %s", strings.Join(order, ", "), expected)
+	}
+}
+
+func TestBundleHandlerInvalid(t *testing.T) {
+	a := transactionTestAPI()
+
+	for body, status := range map[string]int{
+		`{"resourceType": "Bundle", "type": "collection"}`: http.StatusBadRequest,
+		`{"resourceType": "Patient"}`:                      http.StatusBadRequest,
+		// a transaction fails as a whole before the database is queried
+		`{"resourceType": "Bundle", "type": "transaction", "entry": [{"request": {"method": "POST", "url": "Encounter"}}]}`: http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		a.bundleHandler(w, httptest.NewRequest("POST", "/fhir", strings.NewReader(body)))
+
+		if w.Code != status {
+			t.Errorf("%s: got status %d, want %d", body, w.Code, status)
+		}
+	}
+}
+
+func TestBatchResponses(t *testing.T) {
+	a := transactionTestAPI()
+
+	// entries which fail to parse and reads which don't reach the
+	// database get their responses in the Bundle order
+	body := `{"resourceType": "Bundle", "type": "batch", "entry": [
+		{"request": {"method": "GET", "url": "Encounter/enc-1"}},
+		{"request": {"method": "POST", "url": "Encounter"}, "resource": {"resourceType": "Encounter"}},
+		{"request": {"method": "PATCH", "url": "Patient/pt-1"}}
+	]}`
+
+	w := httptest.NewRecorder()
+	a.bundleHandler(w, httptest.NewRequest("POST", "/fhir", strings.NewReader(body)))
+
+	var response struct {
+		Type  string `json:"type"`
+		Entry []struct {
+			Response struct {
+				Status  string                 `json:"status"`
+				Outcome map[string]interface{} `json:"outcome"`
+			} `json:"response"`
+		} `json:"entry"`
+	}
+
+	if err := jsoniter.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"404 Not Found", "404 Not Found", "405 Method Not Allowed"}
+
+	if response.Type != "batch-response" || len(response.Entry) != len(expected) {
+		t.Fatalf("got %s", w.Body)
+	}
+
+	for i, e := range response.Entry {
+		if e.Response.Status != expected[i] || e.Response.Outcome["resourceType"] != "OperationOutcome" {
+			t.Errorf("entry %d: got %+v, want status %s with outcome", i, e.Response, expected[i])
+		}
+	}
+}
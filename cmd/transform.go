@@ -4,13 +4,17 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"embed"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/spf13/cobra"
@@ -20,24 +24,73 @@ import (
 // transformCmd represents the transform command
 var transformCmd = &cobra.Command{
 	Use:   "transform",
-	Short: "Performs Fhirbase transformation on a single FHIR resource loaded from a JSON file",
+	Short: "Performs Fhirbase transformation on FHIR resources and outputs them as NDJSON",
 	Long: `
-Transform command applies Fhirbase transformation algorithm to a
-single FHIR resource loaded from provided JSON file and outputs result
-to the STDOUT. This command exists mostly for demonstration and
-debugging of Fhirbase transformation logic.
+Transform command applies Fhirbase transformation algorithm to FHIR
+resources and outputs results as NDJSON, without loading them into
+the database. It accepts the same inputs as the "load" command: NDJSON
+files, FHIR Bundles, single resource JSON files (all optionally
+gziped) and directories containing such files.
+
+Transformed resources are written to the STDOUT. If "--output" flag is
+set, resources are written into the specified directory instead, one
+<ResourceType>.ndjson file per resource type, which is handy to
+pre-transform data for tools like Spark or DuckDB.
 
 For detailed explanation of Fhirbase transformation algorithm please
 proceed to the Fhirbase documentation. TODO: direct documentation
-link.`,
-	Example: "fhirbase [--fhir=FHIR version] transform path/to/fhir-resource.json",
-	Args:    cobra.ExactArgs(1),
+link.
+
+Built-in transformation rules can be extended or overridden with the
+"--transform-rules" flag (or "transform-rules" config key) pointing to
+a JSON file. It has the same shape as the built-in rules and is merged
+on top of them; setting a rule to null removes it. Besides the built-in
+"union" and "reference" actions, the following actions are available:
+
+  {"tr/act": "rename", "tr/arg": {"key": "newName"}}
+  {"tr/act": "drop"}
+  {"tr/act": "extension", "tr/arg": {"urls": {"<extension url>": "key"}}}
+
+The "extension" action moves extensions with matching URLs out of the
+extension array into the parent element. Extension value is collapsed
+the same way "union" collapses choice elements, i.e. valueCode "F"
+becomes {"code": "F"}, and complex extensions become an object keyed
+by their sub-extension URLs. If an extension may repeat, map its URL to
+{"key": "race", "tr/isCollection": true} to always get an array.
+
+Rules placed under "tr/profiles" are applied only to resources which
+claim conformance to the profile in meta.profile. For example, to
+flatten US Core race and birth sex extensions and drop the narrative
+from US Core patients:
+
+  {
+    "tr/profiles": {
+      "http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient": {
+        "Patient": {
+          "text": {"tr/act": "drop"},
+          "extension": {
+            "tr/act": "extension",
+            "tr/arg": {"urls": {
+              "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race": "race",
+              "http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex": "birthsex"
+            }}
+          }
+        }
+      }
+    }
+  }
+
+Use "--reverse" flag to convert a transformed resource back into FHIR
+representation, the way it's exported from the database.`,
+	Example: "fhirbase [--fhir=FHIR version] transform [--output=out/dir] path/to/fhir-resource.json path/to/ndjson/dir",
+	Args:    cobra.MinimumNArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindCommandFlags(cmd, "reverse", "output", "pretty")
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		for _, arg := range args {
-			err := TransformCommand(cmd, arg)
-			if err != nil {
-				log.Fatalf("Error transforming resource: %v", err)
-			}
+		err := TransformCommand(cmd.Context(), args)
+		if err != nil {
+			log.Fatalf("Error transforming resources: %v", err)
 		}
 	},
 }
@@ -54,150 +107,324 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// transformCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	transformCmd.Flags().Bool("reverse", false, "Convert resource stored by Fhirbase back into canonical FHIR")
+	transformCmd.Flags().StringP("output", "o", "", "Directory to write <ResourceType>.ndjson files into instead of STDOUT")
+	transformCmd.Flags().Bool("pretty", false, "Indent output JSON (the output is not a valid NDJSON then)")
+}
+
+// transformError describes an element which cannot be transformed.
+// Path is a JSON path to the offending element, i.e.
+// "Observation.subject" or "Patient.contact[0].organization".
+type transformError struct {
+	Path    string
+	Message string
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// transformErrors holds every transformation error found in a resource.
+type transformErrors []*transformError
+
+func (e transformErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+func newTransformError(path string, format string, args ...interface{}) error {
+	return transformErrors{&transformError{Path: path, Message: fmt.Sprintf(format, args...)}}
+}
+
+func appendTransformErrors(errs transformErrors, err error) transformErrors {
+	switch e := err.(type) {
+	case nil:
+	case transformErrors:
+		errs = append(errs, e...)
+	case *transformError:
+		errs = append(errs, e)
+	default:
+		errs = append(errs, &transformError{Message: e.Error()})
+	}
+
+	return errs
+}
+
+// errOrNil avoids returning non-nil error interface holding empty slice
+func errOrNil(errs transformErrors) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// hasErrorAt reports whether transformation of element at path itself
+// failed, as opposed to failures somewhere deeper in its children.
+func hasErrorAt(err error, path string) bool {
+	errs, _ := err.(transformErrors)
+
+	for _, e := range errs {
+		if e.Path == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64, int, int64:
+		return "number"
+	}
+
+	return fmt.Sprintf("%T", v)
 }
-func getByPath(tr map[string]interface{}, path []interface{}) map[string]interface{} {
+
+func getByPath(tr map[string]interface{}, path []interface{}) (map[string]interface{}, error) {
 	res := tr
 
 	for _, k := range path {
-		key := k.(string)
-		res = res[key].(map[string]interface{})
-
-		if res == nil {
+		key, ok := k.(string)
 
-			log.Printf("cannot get trNode by path: %v", path)
+		if !ok {
+			return nil, fmt.Errorf("invalid tr/move path %v", path)
+		}
 
-			return nil
+		res, ok = res[key].(map[string]interface{})
 
+		if !ok {
+			return nil, fmt.Errorf("cannot get trNode by path %v", path)
 		}
+	}
+
+	return res, nil
+}
+
+// nextTransformRule returns the rule for a child element and the node
+// to transform its content with, which differs from the rule itself
+// when the rule has a tr/move pointer.
+func nextTransformRule(trNode map[string]interface{}, k string, tr map[string]interface{}, path string) (map[string]interface{}, map[string]interface{}, error) {
+	rule, ok := trNode[k]
 
+	if !ok || rule == nil {
+		return nil, nil, nil
 	}
 
-	return res
+	nextTrNode, ok := rule.(map[string]interface{})
+
+	if !ok {
+		return nil, nil, newTransformError(path, "invalid transformation rule, expected object, got %s", typeName(rule))
+	}
+
+	if move, ok := nextTrNode["tr/move"]; ok && move != nil {
+		movePath, ok := move.([]interface{})
+
+		if !ok {
+			return nil, nil, newTransformError(path, "invalid tr/move, expected array, got %s", typeName(move))
+		}
+
+		moved, err := getByPath(tr, movePath)
+
+		if err != nil {
+			return nil, nil, newTransformError(path, "%v", err)
+		}
 
+		return nextTrNode, moved, nil
+	}
+
+	return nextTrNode, nextTrNode, nil
 }
 
-func transform(node interface{}, trNode map[string]interface{}, tr map[string]interface{}) (interface{}, error) {
+func transformReference(node interface{}, path string) (interface{}, error) {
+	v, ok := node.(map[string]interface{})
 
-	// log.Printf("=> %v %v", node, trNode)
+	if !ok {
+		return node, newTransformError(path, "expected Reference object, got %s", typeName(node))
+	}
 
-	_, isSlice := node.([]interface{})
+	newref := make(map[string]interface{})
 
-	if trNode["tr/act"] != nil && !isSlice {
+	if v["reference"] != nil {
+		refstr, ok := v["reference"].(string)
 
-		var res interface{}
-		trAct := trNode["tr/act"].(string)
+		if !ok {
+			return node, newTransformError(path, "expected string in Reference.reference, got %s", typeName(v["reference"]))
+		}
 
-		if trAct == "union" {
-			args := trNode["tr/arg"].(map[string]interface{})
-			ttype := args["type"].(string)
-			transformed := make(map[string]interface{})
+		refcomps := strings.Split(refstr, "/")
 
-			if tr[ttype] != nil {
+		if len(refcomps) == 2 {
+			newref["id"] = refcomps[1]
+			newref["resourceType"] = refcomps[0]
+		} else {
+			newref["id"] = refstr
+		}
+	}
 
-				if ttype == "Reference" {
-					r, _ := transform(node, map[string]interface{}{"tr/act": "reference"}, tr)
-					transformed[ttype] = r
-				} else {
-					r, _ := transform(node, tr[ttype].(map[string]interface{}), tr)
-					transformed[ttype] = r
-				}
+	if v["display"] != nil {
+		display, ok := v["display"].(string)
 
-			} else {
-				transformed[ttype] = node
-			}
-			res = transformed
-
-		} else if trAct == "reference" {
-			v := node.(map[string]interface{})
-			newref := make(map[string]interface{})
-			if v["reference"] != nil {
-				refstr, _ := v["reference"].(string)
-				refcomps := strings.Split(refstr, "/")
-
-				if len(refcomps) == 2 {
-					newref["id"] = refcomps[1]
-					newref["resourceType"] = refcomps[0]
-				} else {
-					newref["id"] = refstr
-				}
+		if !ok {
+			return node, newTransformError(path, "expected string in Reference.display, got %s", typeName(v["display"]))
+		}
 
-			}
+		newref["display"] = display
+	}
 
-			if v["display"] != nil {
-				newref["display"] = v["display"].(string)
-			}
+	return newref, nil
+}
+
+// transform applies transformation rules from trNode to node. When an
+// element cannot be transformed, it's returned unchanged along with an
+// error pointing to its path, so callers may decide whether to fail or
+// to keep the original element.
+func transform(node interface{}, trNode map[string]interface{}, tr map[string]interface{}, path string) (interface{}, error) {
 
-			res = newref
+	_, isSlice := node.([]interface{})
+
+	trAct, _ := trNode["tr/act"].(string)
+
+	if trAct == "union" && !isSlice {
+
+		args, _ := trNode["tr/arg"].(map[string]interface{})
+		ttype, _ := args["type"].(string)
+
+		if ttype == "" {
+
+			return node, newTransformError(path, "invalid union rule, tr/arg.type is missing")
 
 		}
 
-		return res, nil
+		return unionValue(node, ttype, tr, path)
+
+	}
+
+	if trAct == "reference" && !isSlice {
+
+		return transformReference(node, path)
 
 	}
 
-	switch node.(type) {
+	switch n := node.(type) {
 
 	case map[string]interface{}:
 
 		res := make(map[string]interface{})
+		var errs transformErrors
 
-		for k, v := range node.(map[string]interface{}) {
+		for k, v := range n {
 
-			if (trNode != nil) && (trNode[k] != nil) {
+			childPath := path + "." + k
 
-				nextTrNode := trNode[k].(map[string]interface{})
+			rule, nextTrNode, err := nextTransformRule(trNode, k, tr, childPath)
 
-				args := nextTrNode["tr/arg"]
+			if err != nil {
 
-				key := k
+				errs = appendTransformErrors(errs, err)
+				res[k] = v
 
-				if args != nil {
+				continue
 
-					argsMap := args.(map[string]interface{})
+			}
 
-					if argsMap != nil {
+			if rule == nil {
 
-						key = argsMap["key"].(string)
+				r, err := transform(v, nil, tr, childPath)
+				errs = appendTransformErrors(errs, err)
+				res[k] = r
 
-					}
+				continue
+
+			}
+
+			nextTrAct, _ := rule["tr/act"].(string)
+
+			if nextTrAct == "drop" {
+
+				continue
+
+			}
+
+			if nextTrAct == "extension" {
+
+				remaining, flattened, err := flattenExtensions(v, rule, tr, childPath)
+				errs = appendTransformErrors(errs, err)
+
+				for fk, fv := range flattened {
+
+					res[fk] = fv
 
 				}
 
-				if nextTrNode["tr/move"] != nil {
+				if len(remaining) > 0 {
 
-					nextTrNode = getByPath(tr, nextTrNode["tr/move"].([]interface{}))
+					res[k] = remaining
 
 				}
 
-				r, _ := transform(v, nextTrNode, tr)
+				continue
 
-				res[key] = r
+			}
 
-			} else {
+			key := k
 
-				r, _ := transform(v, nil, tr)
+			if argsMap, ok := rule["tr/arg"].(map[string]interface{}); ok {
 
-				res[k] = r
+				if argKey, ok := argsMap["key"].(string); ok && argKey != "" {
+
+					key = argKey
+
+				}
 
 			}
 
+			r, err := transform(v, nextTrNode, tr, childPath)
+			errs = appendTransformErrors(errs, err)
+
+			if hasErrorAt(err, childPath) {
+
+				key = k
+
+			}
+
+			res[key] = r
+
 		}
 
-		return res, nil
+		return res, errOrNil(errs)
 
 	case []interface{}:
 
-		res := make([]interface{}, 0, 8)
+		res := make([]interface{}, 0, len(n))
+		var errs transformErrors
 
-		for _, v := range node.([]interface{}) {
+		for i, v := range n {
 
-			r, _ := transform(v, trNode, tr)
+			r, err := transform(v, trNode, tr, fmt.Sprintf("%s[%d]", path, i))
+			errs = appendTransformErrors(errs, err)
 
 			res = append(res, r)
 
 		}
 
-		return res, nil
+		return res, errOrNil(errs)
 
 	default:
 
@@ -209,11 +436,17 @@ func transform(node interface{}, trNode map[string]interface{}, tr map[string]in
 
 var transformDatas = make(map[string]interface{})
 
+// transformDatasMu guards transformDatas, resources are transformed
+// concurrently when streaming Bulk Data
+var transformDatasMu sync.Mutex
+
 //go:embed transform/*
 
 var transformFiles embed.FS
 
 func getTransformData(fhirVersion string) (map[string]interface{}, error) {
+	transformDatasMu.Lock()
+	defer transformDatasMu.Unlock()
 
 	if transformDatas[fhirVersion] != nil {
 
@@ -237,7 +470,7 @@ func getTransformData(fhirVersion string) (map[string]interface{}, error) {
 
 	defer jsoniter.ConfigFastest.ReturnIterator(iter)
 
-	tr := iter.Read().(map[string]interface{})
+	tr, _ := iter.Read().(map[string]interface{})
 
 	if tr == nil {
 
@@ -245,19 +478,640 @@ func getTransformData(fhirVersion string) (map[string]interface{}, error) {
 
 	}
 
+	if rulesFile := viper.GetString("transform-rules"); rulesFile != "" {
+
+		overrides, err := loadTransformRules(rulesFile)
+
+		if err != nil {
+
+			return nil, err
+
+		}
+
+		mergeTransformRules(tr, overrides)
+
+	}
+
 	transformDatas[fhirVersion] = tr
 
 	return tr, nil
 
 }
 
-func doTransform(res map[string]interface{}, fhirVersion string) (map[string]interface{}, error) {
+// loadTransformRules reads user-supplied transformation rules. The file
+// has the same shape as the embedded transform/fhirbase-import-*.json
+// files: top-level keys are resource or datatype names and nested keys
+// are element names holding tr/act, tr/arg, tr/move and tr/isCollection
+// directives.
+func loadTransformRules(fileName string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(fileName)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read transformation rules from %s: %v", fileName, err)
+	}
+
+	iter := jsoniter.ConfigFastest.BorrowIterator(content)
+	defer jsoniter.ConfigFastest.ReturnIterator(iter)
+
+	rules, ok := iter.Read().(map[string]interface{})
+
+	if !ok || (iter.Error != nil && iter.Error != io.EOF) {
+		return nil, fmt.Errorf("cannot parse transformation rules from %s: expecting JSON object at the top level", fileName)
+	}
+
+	return rules, nil
+}
+
+// mergeTransformRules deep-merges overrides on top of base in place.
+// Objects are merged key by key, any other value replaces the base one
+// and null removes the rule from base altogether.
+func mergeTransformRules(base map[string]interface{}, overrides map[string]interface{}) {
+	for k, v := range overrides {
+		if v == nil {
+			delete(base, k)
+			continue
+		}
+
+		overrideMap, isMap := v.(map[string]interface{})
+		baseMap, baseIsMap := base[k].(map[string]interface{})
+
+		if isMap && baseIsMap {
+			mergeTransformRules(baseMap, overrideMap)
+		} else {
+			base[k] = v
+		}
+	}
+}
+
+// unionValue wraps a choice element value into {"<type>": value},
+// transforming the value with the rules of its datatype.
+// When the value itself cannot be transformed it's returned unchanged.
+func unionValue(node interface{}, ttype string, tr map[string]interface{}, path string) (interface{}, error) {
+	transformed := make(map[string]interface{})
+
+	if tr[ttype] == nil {
+		transformed[ttype] = node
+
+		return transformed, nil
+	}
+
+	var r interface{}
+	var err error
+
+	if ttype == "Reference" {
+		r, err = transformReference(node, path)
+	} else if typeNode, ok := tr[ttype].(map[string]interface{}); ok {
+		r, err = transform(node, typeNode, tr, path)
+	} else {
+		return node, newTransformError(path, "invalid transformation rule for type %s", ttype)
+	}
+
+	if hasErrorAt(err, path) {
+		return node, err
+	}
+
+	transformed[ttype] = r
+
+	return transformed, err
+}
+
+var primitiveTypes = map[string]bool{
+	"base64Binary": true, "boolean": true, "canonical": true, "code": true,
+	"date": true, "dateTime": true, "decimal": true, "id": true,
+	"instant": true, "integer": true, "integer64": true, "markdown": true,
+	"oid": true, "positiveInt": true, "string": true, "time": true,
+	"unsignedInt": true, "uri": true, "url": true, "uuid": true,
+}
+
+// choiceTypeName returns FHIR type name for the suffix of a choice
+// element, i.e. "Quantity" for valueQuantity and "dateTime" for
+// valueDateTime.
+func choiceTypeName(suffix string) string {
+	if suffix == "" {
+		return suffix
+	}
+
+	lower := strings.ToLower(suffix[:1]) + suffix[1:]
+
+	if primitiveTypes[lower] {
+		return lower
+	}
+
+	return suffix
+}
+
+func isTypeName(name string) bool {
+	return primitiveTypes[name] || (name != "" && strings.ToUpper(name[:1]) == name[:1])
+}
+
+// extensionKey reads the target key of an extension URL mapping. A
+// mapping is either a plain key or an object with "key" and
+// "tr/isCollection" attributes.
+func extensionKey(spec interface{}) (string, bool) {
+	switch s := spec.(type) {
+	case string:
+		return s, false
+	case map[string]interface{}:
+		key, _ := s["key"].(string)
+		isCollection, _ := s["tr/isCollection"].(bool)
+
+		return key, isCollection
+	}
+
+	return "", false
+}
+
+// isRelativeExtensionURL reports whether url is a sub-extension URL of a
+// complex extension, like "ombCategory" in US Core race extension.
+func isRelativeExtensionURL(url string) bool {
+	return url != "" && !strings.Contains(url, ":")
+}
+
+// flattenExtensions lifts extensions listed in the rule's tr/arg.urls
+// map out of the extension array and into the parent element under the
+// configured key. Values are collapsed the same way union collapses
+// choice elements ({"<type>": value}), complex extensions become an
+// object keyed by their sub-extension URLs. Extensions without a
+// matching URL are returned as-is so they stay in the extension array.
+func flattenExtensions(node interface{}, trNode map[string]interface{}, tr map[string]interface{}, path string) ([]interface{}, map[string]interface{}, error) {
+	exts, ok := node.([]interface{})
+
+	if !ok {
+		return []interface{}{node}, map[string]interface{}{}, newTransformError(path, "expected extension array, got %s", typeName(node))
+	}
+
+	args, _ := trNode["tr/arg"].(map[string]interface{})
+	urls, _ := args["urls"].(map[string]interface{})
+
+	return flattenExtensionList(exts, urls, false, tr, path)
+}
+
+func flattenExtensionList(exts []interface{}, urls map[string]interface{}, nested bool, tr map[string]interface{}, path string) ([]interface{}, map[string]interface{}, error) {
+	flattened := make(map[string]interface{})
+	collections := make(map[string]bool)
+	remaining := make([]interface{}, 0, len(exts))
+	var errs transformErrors
+
+	for i, e := range exts {
+		extPath := fmt.Sprintf("%s[%d]", path, i)
+		ext, ok := e.(map[string]interface{})
+
+		if !ok {
+			errs = appendTransformErrors(errs, newTransformError(extPath, "expected Extension object, got %s", typeName(e)))
+			remaining = append(remaining, e)
+			continue
+		}
+
+		url, _ := ext["url"].(string)
+		key, isCollection := extensionKey(urls[url])
+
+		if key == "" && nested && isRelativeExtensionURL(url) {
+			key = url
+		}
+
+		if key == "" {
+			r, err := transform(e, nil, tr, extPath)
+			errs = appendTransformErrors(errs, err)
+			remaining = append(remaining, r)
+			continue
+		}
+
+		value, err := collapseExtensionValue(ext, urls, tr, extPath)
+		errs = appendTransformErrors(errs, err)
+
+		if hasErrorAt(err, extPath) {
+			remaining = append(remaining, e)
+			continue
+		}
+
+		prev, exists := flattened[key]
+
+		switch {
+		case isCollection && !exists:
+			flattened[key] = []interface{}{value}
+			collections[key] = true
+		case !exists:
+			flattened[key] = value
+		case collections[key]:
+			flattened[key] = append(prev.([]interface{}), value)
+		default:
+			flattened[key] = []interface{}{prev, value}
+			collections[key] = true
+		}
+	}
+
+	return remaining, flattened, errOrNil(errs)
+}
+
+func collapseExtensionValue(ext map[string]interface{}, urls map[string]interface{}, tr map[string]interface{}, path string) (interface{}, error) {
+	for k, v := range ext {
+		if strings.HasPrefix(k, "value") && len(k) > len("value") {
+			valuePath := path + "." + k
+			r, err := unionValue(v, choiceTypeName(k[len("value"):]), tr, valuePath)
+
+			if hasErrorAt(err, valuePath) {
+				return ext, append(err.(transformErrors), &transformError{Path: path, Message: "cannot collapse extension value"})
+			}
+
+			return r, err
+		}
+	}
+
+	nested, ok := ext["extension"].([]interface{})
+
+	if !ok {
+		return ext, newTransformError(path, "extension has neither value[x] nor nested extensions")
+	}
+
+	remaining, flattened, err := flattenExtensionList(nested, urls, true, tr, path+".extension")
+
+	if len(remaining) > 0 {
+		flattened["extension"] = remaining
+	}
+
+	return flattened, err
+}
+
+// restoreExtensions is the reverse of flattenExtensions: it removes
+// flattened keys from node and returns them as extension entries.
+func restoreExtensions(node map[string]interface{}, urls map[string]interface{}, nested bool, tr map[string]interface{}, path string) ([]interface{}, error) {
+	result := make([]interface{}, 0)
+	urlKeys := make([]string, 0, len(urls))
+	var errs transformErrors
+
+	for url := range urls {
+		urlKeys = append(urlKeys, url)
+	}
+
+	sort.Strings(urlKeys)
+
+	for _, url := range urlKeys {
+		key, _ := extensionKey(urls[url])
+
+		if v, ok := node[key]; key != "" && ok {
+			exts, err := expandExtensionValues(url, v, urls, tr, path+"."+key)
+			errs = appendTransformErrors(errs, err)
+			result = append(result, exts...)
+			delete(node, key)
+		}
+	}
+
+	if nested {
+		keys := make([]string, 0, len(node))
+
+		for k := range node {
+			if k != "extension" {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			exts, err := expandExtensionValues(k, node[k], urls, tr, path+"."+k)
+			errs = appendTransformErrors(errs, err)
+			result = append(result, exts...)
+			delete(node, k)
+		}
+	}
+
+	return result, errOrNil(errs)
+}
+
+func expandExtensionValues(url string, v interface{}, urls map[string]interface{}, tr map[string]interface{}, path string) ([]interface{}, error) {
+	values, isArr := v.([]interface{})
+
+	if !isArr {
+		values = []interface{}{v}
+	}
+
+	result := make([]interface{}, 0, len(values))
+	var errs transformErrors
+
+	for _, value := range values {
+		ext := map[string]interface{}{"url": url}
+		valueMap, _ := value.(map[string]interface{})
+
+		if len(valueMap) == 1 {
+			for ttype, tv := range valueMap {
+				if isTypeName(ttype) {
+					r, err := reverseUnionValue(tv, ttype, tr, path+"."+ttype)
+					errs = appendTransformErrors(errs, err)
+					ext["value"+strings.ToUpper(ttype[:1])+ttype[1:]] = r
+				}
+			}
+		}
+
+		if len(ext) == 1 && valueMap != nil {
+			complexValue := make(map[string]interface{}, len(valueMap))
+
+			for ck, cv := range valueMap {
+				complexValue[ck] = cv
+			}
+
+			nestedExts, err := restoreExtensions(complexValue, urls, true, tr, path)
+			errs = appendTransformErrors(errs, err)
+
+			if rest, ok := complexValue["extension"].([]interface{}); ok {
+				nestedExts = append(nestedExts, rest...)
+			}
+
+			ext["extension"] = nestedExts
+		}
+
+		if len(ext) == 1 {
+			errs = appendTransformErrors(errs, newTransformError(path, "cannot restore extension %s from %s", url, typeName(value)))
+			continue
+		}
+
+		result = append(result, ext)
+	}
+
+	return result, errOrNil(errs)
+}
+
+// reverseReference turns Fhirbase reference ({id, resourceType}) back
+// into a FHIR Reference with a literal "reference" attribute.
+func reverseReference(node interface{}, path string) (interface{}, error) {
+	v, ok := node.(map[string]interface{})
+
+	if !ok {
+		return node, newTransformError(path, "expected Reference object, got %s", typeName(node))
+	}
+
+	ref := make(map[string]interface{})
+
+	for k, val := range v {
+		if k != "id" && k != "resourceType" {
+			ref[k] = val
+		}
+	}
+
+	id, _ := v["id"].(string)
+	rt, _ := v["resourceType"].(string)
+
+	if id != "" && rt != "" {
+		ref["reference"] = rt + "/" + id
+	} else if id != "" {
+		ref["reference"] = id
+	}
+
+	return ref, nil
+}
+
+func reverseUnionValue(node interface{}, ttype string, tr map[string]interface{}, path string) (interface{}, error) {
+	if ttype == "Reference" {
+		return reverseReference(node, path)
+	}
+
+	if trNode, ok := tr[ttype].(map[string]interface{}); ok {
+		return untransform(node, trNode, tr, path)
+	}
+
+	return node, nil
+}
+
+// reverseUnion restores a choice element value produced by union action,
+// returning original element name and value.
+func reverseUnion(node interface{}, types map[string]string, tr map[string]interface{}, path string) (string, interface{}, bool, error) {
+	var errs transformErrors
+
+	unwrap := func(item interface{}) (string, interface{}, bool) {
+		m, ok := item.(map[string]interface{})
+
+		if !ok || len(m) != 1 {
+			return "", nil, false
+		}
+
+		for ttype, v := range m {
+			if _, ok := types[ttype]; ok {
+				r, err := reverseUnionValue(v, ttype, tr, path+"."+ttype)
+				errs = appendTransformErrors(errs, err)
+
+				return ttype, r, true
+			}
+		}
+
+		return "", nil, false
+	}
+
+	if items, ok := node.([]interface{}); ok {
+		result := make([]interface{}, 0, len(items))
+		resultType := ""
+
+		for _, item := range items {
+			ttype, v, ok := unwrap(item)
+
+			if !ok || (resultType != "" && ttype != resultType) {
+				return "", nil, false, nil
+			}
+
+			resultType = ttype
+			result = append(result, v)
+		}
+
+		if resultType == "" {
+			return "", nil, false, nil
+		}
+
+		return types[resultType], result, true, errOrNil(errs)
+	}
+
+	ttype, v, ok := unwrap(node)
+
+	if !ok {
+		return "", nil, false, nil
+	}
+
+	return types[ttype], v, true, errOrNil(errs)
+}
+
+// untransform reverts Fhirbase transformation of node, so resources
+// stored in the database can be exported as canonical FHIR. Dropped
+// elements and reference attributes other than reference and display
+// cannot be restored. Like transform, it keeps elements which cannot be
+// reverted unchanged and reports them as errors.
+func untransform(node interface{}, trNode map[string]interface{}, tr map[string]interface{}, path string) (interface{}, error) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if trAct, _ := trNode["tr/act"].(string); trAct == "reference" {
+			return reverseReference(n, path)
+		}
+
+		res := make(map[string]interface{}, len(n))
+		pending := make(map[string]interface{}, len(n))
+		unions := make(map[string]map[string]string)
+		renames := make(map[string]string)
+		extensionRules := make(map[string]map[string]interface{})
+		var errs transformErrors
+
+		for k, v := range n {
+			pending[k] = v
+		}
+
+		for origKey, rule := range trNode {
+			ruleMap, ok := rule.(map[string]interface{})
+
+			if !ok {
+				continue
+			}
+
+			act, _ := ruleMap["tr/act"].(string)
+			args, _ := ruleMap["tr/arg"].(map[string]interface{})
+			key, _ := args["key"].(string)
+
+			switch act {
+			case "union":
+				ttype, _ := args["type"].(string)
+
+				if unions[key] == nil {
+					unions[key] = make(map[string]string)
+				}
+
+				unions[key][ttype] = origKey
+			case "rename":
+				renames[key] = origKey
+			case "extension":
+				urls, _ := args["urls"].(map[string]interface{})
+				extensionRules[origKey] = urls
+			}
+		}
+
+		for origKey, urls := range extensionRules {
+			exts, err := restoreExtensions(pending, urls, false, tr, path)
+			errs = appendTransformErrors(errs, err)
+
+			if rest, ok := pending[origKey].([]interface{}); ok {
+				for i, e := range rest {
+					r, err := untransform(e, nil, tr, fmt.Sprintf("%s.%s[%d]", path, origKey, i))
+					errs = appendTransformErrors(errs, err)
+					exts = append(exts, r)
+				}
+			}
+
+			delete(pending, origKey)
+
+			if len(exts) > 0 {
+				res[origKey] = exts
+			}
+		}
+
+		for k, v := range pending {
+			childPath := path + "." + k
+
+			if types, ok := unions[k]; ok {
+				origKey, r, ok, err := reverseUnion(v, types, tr, childPath)
+				errs = appendTransformErrors(errs, err)
+
+				if ok {
+					res[origKey] = r
+					continue
+				}
+			}
+
+			key := k
+
+			if origKey, ok := renames[k]; ok {
+				key = origKey
+			}
+
+			_, nextTrNode, err := nextTransformRule(trNode, key, tr, childPath)
+
+			if err != nil {
+				errs = appendTransformErrors(errs, err)
+				res[k] = v
+				continue
+			}
+
+			r, err := untransform(v, nextTrNode, tr, childPath)
+			errs = appendTransformErrors(errs, err)
+			res[key] = r
+		}
+
+		return res, errOrNil(errs)
+
+	case []interface{}:
+		res := make([]interface{}, 0, len(n))
+		var errs transformErrors
+
+		for i, v := range n {
+			r, err := untransform(v, trNode, tr, fmt.Sprintf("%s[%d]", path, i))
+			errs = appendTransformErrors(errs, err)
+			res = append(res, r)
+		}
+
+		return res, errOrNil(errs)
+
+	default:
+		return node, nil
+	}
+}
+
+// profileTransformRules returns transformation rules for the resource,
+// taking into account profile-specific rules. Those live under the
+// "tr/profiles" key of the rules file, keyed by profile URL and then by
+// resource type, and are merged on top of resource type rules when the
+// resource claims conformance to the profile in meta.profile.
+func profileTransformRules(tr map[string]interface{}, rt string, res map[string]interface{}) map[string]interface{} {
+	trNode, _ := tr[rt].(map[string]interface{})
+	profiles, _ := tr["tr/profiles"].(map[string]interface{})
+
+	if len(profiles) == 0 {
+		return trNode
+	}
+
+	meta, _ := res["meta"].(map[string]interface{})
+	claimed, _ := meta["profile"].([]interface{})
+	var merged map[string]interface{}
+
+	for _, p := range claimed {
+		url, _ := p.(string)
+		profileRules, _ := profiles[url].(map[string]interface{})
+		rtRules, _ := profileRules[rt].(map[string]interface{})
+
+		if rtRules == nil {
+			continue
+		}
+
+		if merged == nil {
+			merged = copyTransformRules(trNode)
+		}
+
+		mergeTransformRules(merged, copyTransformRules(rtRules))
+	}
+
+	if merged == nil {
+		return trNode
+	}
+
+	return merged
+}
+
+func copyTransformRules(rules map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(rules))
+
+	for k, v := range rules {
+		if m, ok := v.(map[string]interface{}); ok {
+			result[k] = copyTransformRules(m)
+		} else {
+			result[k] = v
+		}
+	}
+
+	return result
+}
+
+// doTransform applies Fhirbase transformation to the resource. In strict
+// mode any element which cannot be transformed fails the whole
+// resource, otherwise such elements are kept unchanged and reported as
+// warnings.
+func doTransform(res map[string]interface{}, fhirVersion string, strict bool) (map[string]interface{}, transformErrors, error) {
 
 	tr, err := getTransformData(fhirVersion)
 
 	if err != nil {
 
-		return nil, fmt.Errorf("cannot get transformations data for FHIR version %s: %v", fhirVersion, err)
+		return nil, nil, fmt.Errorf("cannot get transformations data for FHIR version %s: %v", fhirVersion, err)
 
 	}
 
@@ -265,85 +1119,264 @@ func doTransform(res map[string]interface{}, fhirVersion string) (map[string]int
 
 	if !ok {
 
-		return nil, fmt.Errorf("cannot determine resourceType for resource %v", res)
+		return nil, nil, fmt.Errorf("cannot determine resourceType for resource %v", res)
 
 	}
 
-	trNode := tr[rt]
+	trNodeMap := profileTransformRules(tr, rt, res)
 
-	if trNode == nil {
+	if trNodeMap == nil {
 
 		// TODO: some warning output here?
 
-		return res, nil
+		return res, nil, nil
 
 	}
 
-	trNodeMap := trNode.(map[string]interface{})
+	out, err := transform(res, trNodeMap, tr, rt)
+
+	warnings, _ := err.(transformErrors)
 
-	out, err := transform(res, trNodeMap, tr)
+	if err != nil && (strict || warnings == nil) {
+
+		return nil, nil, fmt.Errorf("error transforming resource: %v", err)
+
+	}
+
+	outMap, ok := out.(map[string]interface{})
+
+	if !ok {
+
+		return nil, nil, fmt.Errorf("incorrect format after transformation: %v", out)
+
+	}
+
+	return outMap, warnings, nil
+
+}
+
+// doReverseTransform converts resource stored by Fhirbase back into
+// canonical FHIR representation.
+// Elements which cannot be reverted are kept as-is and reported as
+// warnings.
+func doReverseTransform(res map[string]interface{}, fhirVersion string) (map[string]interface{}, transformErrors, error) {
+	tr, err := getTransformData(fhirVersion)
 
 	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get transformations data for FHIR version %s: %v", fhirVersion, err)
+	}
+
+	rt, ok := res["resourceType"].(string)
+
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot determine resourceType for resource %v", res)
+	}
 
-		return nil, fmt.Errorf("error transforming resource: %v", err)
+	trNodeMap := profileTransformRules(tr, rt, res)
 
+	if trNodeMap == nil {
+		return res, nil, nil
+	}
+
+	out, err := untransform(res, trNodeMap, tr, rt)
+	warnings, _ := err.(transformErrors)
+
+	if err != nil && warnings == nil {
+		return nil, nil, fmt.Errorf("error reverting transformation of resource: %v", err)
 	}
 
 	outMap, ok := out.(map[string]interface{})
 
 	if !ok {
+		return nil, nil, fmt.Errorf("incorrect format after reverse transformation: %v", out)
+	}
+
+	return outMap, warnings, nil
+}
 
-		return nil, fmt.Errorf("incorrect format after transformation: %v", out)
+// transformOutput writes transformed resources either into a single
+// writer or into per-resource type NDJSON files in a directory
+type transformOutput struct {
+	dir     string
+	pretty  bool
+	stdout  *bufio.Writer
+	files   map[string]*os.File
+	writers map[string]*bufio.Writer
+}
+
+func newTransformOutput(dir string, pretty bool) (*transformOutput, error) {
+	out := &transformOutput{
+		dir:     dir,
+		pretty:  pretty,
+		files:   make(map[string]*os.File),
+		writers: make(map[string]*bufio.Writer),
+	}
 
+	if dir == "" {
+		out.stdout = bufio.NewWriter(os.Stdout)
+		return out, nil
 	}
 
-	return outMap, nil
+	err := ensureDirectoryExists(dir)
 
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
 }
 
-// TransformCommand transforms FHIR resource to internal JSON representation
+func (o *transformOutput) writer(rt string) (*bufio.Writer, error) {
+	if o.stdout != nil {
+		return o.stdout, nil
+	}
 
-func TransformCommand(c *cobra.Command, arg string) error {
+	if w, ok := o.writers[rt]; ok {
+		return w, nil
+	}
 
-	fhirVersion := viper.GetString("fhirVersion")
+	f, err := os.Create(path.Join(o.dir, rt+".ndjson"))
 
-	file, err := os.Open(arg)
 	if err != nil {
-		return fmt.Errorf("Cannot open file %s: %v", arg, err)
+		return nil, fmt.Errorf("cannot create output file: %v", err)
 	}
-	defer file.Close()
 
-	fileContent, err := io.ReadAll(file)
+	o.files[rt] = f
+	o.writers[rt] = bufio.NewWriter(f)
+
+	return o.writers[rt], nil
+}
+
+func (o *transformOutput) Write(res map[string]interface{}) error {
+	rt, _ := res["resourceType"].(string)
+	w, err := o.writer(rt)
+
 	if err != nil {
-		return fmt.Errorf("Cannot read file %s: %v", arg, err)
+		return err
 	}
 
-	iter := jsoniter.ConfigFastest.BorrowIterator(fileContent)
+	var line []byte
 
-	defer jsoniter.ConfigFastest.ReturnIterator(iter)
+	if o.pretty {
+		line, err = jsoniter.ConfigFastest.MarshalIndent(res, "", " ")
+	} else {
+		line, err = jsoniter.ConfigFastest.Marshal(res)
+	}
 
-	res := iter.Read()
+	if err != nil {
+		return fmt.Errorf("cannot marshal resource: %v", err)
+	}
 
-	if res == nil {
+	w.Write(line)
+
+	return w.WriteByte('\n')
+}
+
+func (o *transformOutput) Close() error {
+	var result error
+
+	if o.stdout != nil {
+		result = o.stdout.Flush()
+	}
 
-		return fmt.Errorf("Cannot parse JSON from file %s", arg)
+	for rt, w := range o.writers {
+		if err := w.Flush(); err != nil && result == nil {
+			result = err
+		}
 
+		if err := o.files[rt].Close(); err != nil && result == nil {
+			result = err
+		}
 	}
 
-	out, err := doTransform(res.(map[string]interface{}), fhirVersion)
+	return result
+}
+
+// TransformCommand transforms FHIR resources from provided files to
+// internal JSON representation and outputs them as NDJSON
+func TransformCommand(ctx context.Context, args []string) error {
+	fhirVersion := viper.GetString("fhir")
+	strict := viper.GetBool("strict")
+	reverse := viper.GetBool("reverse")
+
+	files, err := prewalkDirs(args)
 
 	if err != nil {
+		return fmt.Errorf("Error walking directories: %v", err)
+	}
 
-		return fmt.Errorf("Error transforming resource: %v", err)
+	bndl, err := newMultifileBundle(files)
 
+	if err != nil {
+		return err
 	}
 
-	outJson, err := jsoniter.ConfigFastest.MarshalIndent(out, "", " ")
+	defer bndl.Close()
 
-	os.Stdout.Write(outJson)
+	out, err := newTransformOutput(viper.GetString("output"), viper.GetBool("pretty"))
 
-	os.Stdout.Write([]byte("\n"))
+	if err != nil {
+		return err
+	}
 
-	return nil
+	warningsCount := 0
+	count := 0
+
+	for {
+		if ctx.Err() != nil {
+			out.Close()
+			return ctx.Err()
+		}
+
+		res, err := bndl.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			out.Close()
+			return err
+		}
+
+		var transformed map[string]interface{}
+		var warnings transformErrors
+
+		if reverse {
+			transformed, warnings, err = doReverseTransform(res, fhirVersion)
+		} else {
+			transformed, warnings, err = doTransform(res, fhirVersion, strict)
+		}
 
+		if err != nil {
+			if strict {
+				out.Close()
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "Skipping resource: %v\n", err)
+			continue
+		}
+
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", w)
+		}
+
+		warningsCount += len(warnings)
+
+		if err := out.Write(transformed); err != nil {
+			out.Close()
+			return err
+		}
+
+		count++
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Error writing output: %v", err)
+	}
+
+	if out.dir != "" {
+		fmt.Fprintf(os.Stderr, "Transformed %d resources into %s, %d warnings\n", count, out.dir, warningsCount)
+	}
+
+	return nil
 }
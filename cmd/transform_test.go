@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/viper"
+)
+
+// readNDJSON reads resources from NDJSON file
+func readNDJSON(t *testing.T, fileName string) []map[string]interface{} {
+	t.Helper()
+
+	content, err := os.ReadFile(fileName)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make([]map[string]interface{}, 0)
+
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var res map[string]interface{}
+
+		if err := jsoniter.UnmarshalFromString(line, &res); err != nil {
+			t.Fatalf("%s: %v", fileName, err)
+		}
+
+		result = append(result, res)
+	}
+
+	return result
+}
+
+// runTransformCommand runs transform command with flags set the way
+// cobra sets them from the command line
+func runTransformCommand(t *testing.T, flags map[string]string, args ...string) {
+	t.Helper()
+
+	viper.Set("fhir", "4.0.0")
+
+	for name, value := range flags {
+		if err := transformCmd.Flags().Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func() {
+		for name := range flags {
+			f := transformCmd.Flags().Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}()
+
+	transformCmd.PreRun(transformCmd, args)
+
+	if err := TransformCommand(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransformCommand(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.ndjson")
+	os.WriteFile(input, []byte(`{"resourceType": "Patient", "id": "pt-1", "managingOrganization": {"reference": "Organization/org-1"}}
+{"resourceType": "Observation", "id": "obs-1", "status": "final", "subject": {"reference": "Patient/pt-1"}, "valueString": "ok"}
+{"resourceType": "Patient", "id": "pt-2"}
+`), 0644)
+
+	out := t.TempDir()
+	runTransformCommand(t, map[string]string{"output": out}, input)
+
+	patients := readNDJSON(t, filepath.Join(out, "Patient.ndjson"))
+	observations := readNDJSON(t, filepath.Join(out, "Observation.ndjson"))
+
+	if len(patients) != 2 || len(observations) != 1 {
+		t.Fatalf("got %d patients and %d observations, want 2 and 1", len(patients), len(observations))
+	}
+
+	subject, _ := observations[0]["subject"].(map[string]interface{})
+
+	if subject["id"] != "pt-1" || subject["resourceType"] != "Patient" {
+		t.Errorf("reference isn't transformed: %v", observations[0])
+	}
+
+	// transformed output converted back should give the original resources
+	reverted := t.TempDir()
+	runTransformCommand(t, map[string]string{"output": reverted, "reverse": "true"}, filepath.Join(out, "Observation.ndjson"))
+
+	observations = readNDJSON(t, filepath.Join(reverted, "Observation.ndjson"))
+	subject, _ = observations[0]["subject"].(map[string]interface{})
+
+	if subject["reference"] != "Patient/pt-1" || observations[0]["valueString"] != "ok" {
+		t.Errorf("reverse transformation doesn't restore resource: %v", observations[0])
+	}
+}
+
+func TestTransformCommandLine(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.ndjson")
+	os.WriteFile(input, []byte(`{"resourceType": "Patient", "id": "pt-1"}`), 0644)
+	out := t.TempDir()
+
+	t.Cleanup(func() {
+		rootCmd.SetArgs(nil)
+
+		for _, name := range []string{"output", "pretty"} {
+			f := transformCmd.Flags().Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	})
+
+	// flags are bound to config keys only when transform command runs
+	rootCmd.SetArgs([]string{"transform", "--fhir", "4.0.0", "-o", out, "--pretty", input})
+
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if viper.GetString("output") != out || !viper.GetBool("pretty") {
+		t.Errorf("flags aren't bound, got output %q and pretty %v", viper.GetString("output"), viper.GetBool("pretty"))
+	}
+
+	content, err := os.ReadFile(filepath.Join(out, "Patient.ndjson"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 4 {
+		t.Errorf("output isn't indented: %s", content)
+	}
+}
+
+// useTransformRules makes transformations use rules overrides for the
+// duration of the test
+func useTransformRules(t *testing.T, rules string) {
+	t.Helper()
+
+	fileName := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(fileName, []byte(rules), 0644)
+
+	resetTransformData := func() {
+		transformDatasMu.Lock()
+		delete(transformDatas, "4.0.0")
+		transformDatasMu.Unlock()
+	}
+
+	viper.Set("transform-rules", fileName)
+	resetTransformData()
+
+	t.Cleanup(func() {
+		viper.Set("transform-rules", "")
+		resetTransformData()
+	})
+}
+
+// parseResource parses resource JSON, failing the test on error
+func parseResource(t *testing.T, content string) map[string]interface{} {
+	t.Helper()
+
+	var res map[string]interface{}
+
+	if err := jsoniter.UnmarshalFromString(content, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func TestMergeTransformRules(t *testing.T) {
+	base := parseResource(t, `{
+		"Patient": {"gender": {"tr/act": "drop"}, "link": {"tr/isCollection": true}},
+		"Observation": {"subject": {"tr/act": "reference"}}
+	}`)
+	overrides := parseResource(t, `{
+		"Patient": {"gender": null, "link": {"other": {"tr/act": "reference"}}},
+		"Observation": {"subject": {"tr/act": "rename", "tr/arg": {"key": "patient"}}},
+		"Encounter": {"text": {"tr/act": "drop"}}
+	}`)
+	expected := parseResource(t, `{
+		"Patient": {"link": {"tr/isCollection": true, "other": {"tr/act": "reference"}}},
+		"Observation": {"subject": {"tr/act": "rename", "tr/arg": {"key": "patient"}}},
+		"Encounter": {"text": {"tr/act": "drop"}}
+	}`)
+
+	mergeTransformRules(base, overrides)
+
+	if !reflect.DeepEqual(base, expected) {
+		t.Errorf("got %v, want %v", base, expected)
+	}
+}
+
+func TestLoadTransformRulesInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, content := range map[string]string{"array.json": `[{"Patient": {}}]`, "broken.json": `{"Patient": `} {
+		fileName := filepath.Join(dir, name)
+		os.WriteFile(fileName, []byte(content), 0644)
+
+		if _, err := loadTransformRules(fileName); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if _, err := loadTransformRules(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file: expected error")
+	}
+}
+
+func TestTransformRulesOverride(t *testing.T) {
+	useTransformRules(t, `{
+		"Patient": {
+			"gender": {"tr/act": "rename", "tr/arg": {"key": "sex"}},
+			"text": {"tr/act": "drop"},
+			"managingOrganization": null
+		}
+	}`)
+
+	res := parseResource(t, `{
+		"resourceType": "Patient",
+		"id": "pt-1",
+		"gender": "female",
+		"text": {"status": "generated", "div": "<div>Jane</div>"},
+		"managingOrganization": {"reference": "Organization/org-1"},
+		"deceasedBoolean": false
+	}`)
+	expected := parseResource(t, `{
+		"resourceType": "Patient",
+		"id": "pt-1",
+		"sex": "female",
+		"managingOrganization": {"reference": "Organization/org-1"},
+		"deceased": {"boolean": false}
+	}`)
+
+	out, warnings, err := doTransform(res, "4.0.0", true)
+
+	if err != nil || warnings != nil {
+		t.Fatalf("unexpected error %v, warnings %v", err, warnings)
+	}
+
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %v, want %v", out, expected)
+	}
+}
+
+const usCoreRules = `{
+	"tr/profiles": {
+		"http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient": {
+			"Patient": {
+				"extension": {
+					"tr/act": "extension",
+					"tr/arg": {"urls": {
+						"http://hl7.org/fhir/us/core/StructureDefinition/us-core-race": "race",
+						"http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex": "birthsex",
+						"http://example.org/nickname": {"key": "nickname", "tr/isCollection": true}
+					}}
+				}
+			}
+		}
+	}
+}`
+
+// usCorePatient is in the order reverse transformation restores
+// extensions: flattened ones sorted by URL, then the remaining ones
+const usCorePatient = `{
+	"resourceType": "Patient",
+	"id": "pt-1",
+	"meta": {"profile": ["http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient"]},
+	"extension": [
+		{"url": "http://example.org/nickname", "valueString": "Jo"},
+		{"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex", "valueCode": "F"},
+		{"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race", "extension": [
+			{"url": "ombCategory", "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2106-3"}},
+			{"url": "text", "valueString": "White"}
+		]},
+		{"url": "http://example.org/unknown", "valueBoolean": true}
+	],
+	"gender": "female"
+}`
+
+func TestTransformExtensions(t *testing.T) {
+	useTransformRules(t, usCoreRules)
+
+	expected := parseResource(t, `{
+		"resourceType": "Patient",
+		"id": "pt-1",
+		"meta": {"profile": ["http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient"]},
+		"nickname": [{"string": "Jo"}],
+		"birthsex": {"code": "F"},
+		"race": {
+			"ombCategory": {"Coding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2106-3"}},
+			"text": {"string": "White"}
+		},
+		"extension": [{"url": "http://example.org/unknown", "valueBoolean": true}],
+		"gender": "female"
+	}`)
+
+	out, warnings, err := doTransform(parseResource(t, usCorePatient), "4.0.0", true)
+
+	if err != nil || warnings != nil {
+		t.Fatalf("unexpected error %v, warnings %v", err, warnings)
+	}
+
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("got %v, want %v", out, expected)
+	}
+
+	reverted, warnings, err := doReverseTransform(out, "4.0.0")
+
+	if err != nil || warnings != nil {
+		t.Fatalf("unexpected reverse error %v, warnings %v", err, warnings)
+	}
+
+	if original := parseResource(t, usCorePatient); !reflect.DeepEqual(reverted, original) {
+		t.Errorf("reverse transformation got %v, want %v", reverted, original)
+	}
+}
+
+func TestTransformExtensionsWithoutProfile(t *testing.T) {
+	useTransformRules(t, usCoreRules)
+
+	res := parseResource(t, usCorePatient)
+	delete(res, "meta")
+
+	out, _, err := doTransform(res, "4.0.0", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := out["race"]; ok {
+		t.Error("profile rules applied to resource which doesn't claim the profile")
+	}
+
+	if exts, _ := out["extension"].([]interface{}); len(exts) != 4 {
+		t.Errorf("extensions should be kept as-is, got %v", out["extension"])
+	}
+}
+
+const observation = `{
+	"resourceType": "Observation",
+	"id": "obs-1",
+	"status": "final",
+	"subject": {"reference": "Patient/pt-1", "display": "Jane"},
+	"hasMember": [{"reference": "Observation/obs-2"}],
+	"valueQuantity": {"value": 42, "unit": "kg"},
+	"component": [{"code": {"text": "a"}, "valueString": "x"}]
+}`
+
+func TestReverseTransform(t *testing.T) {
+	res := parseResource(t, observation)
+
+	out, _, err := doTransform(res, "4.0.0", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := out["value"].(map[string]interface{})["Quantity"]; !ok {
+		t.Errorf("choice element isn't transformed: %v", out["value"])
+	}
+
+	reverted, warnings, err := doReverseTransform(out, "4.0.0")
+
+	if err != nil || warnings != nil {
+		t.Fatalf("unexpected error %v, warnings %v", err, warnings)
+	}
+
+	if original := parseResource(t, observation); !reflect.DeepEqual(reverted, original) {
+		t.Errorf("got %v, want %v", reverted, original)
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	res := parseResource(t, `{
+		"resourceType": "Patient",
+		"id": "pt-1",
+		"managingOrganization": "Organization/org-1",
+		"generalPractitioner": [{"reference": "Practitioner/pr-1"}, {"reference": 42}],
+		"deceasedBoolean": true
+	}`)
+
+	out, warnings, err := doTransform(res, "4.0.0", false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, 0)
+
+	for _, w := range warnings {
+		paths = append(paths, w.Path)
+	}
+
+	sort.Strings(paths)
+
+	if expected := []string{"Patient.generalPractitioner[1]", "Patient.managingOrganization"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("got warnings at %q, want %q", paths, expected)
+	}
+
+	// elements which cannot be transformed are kept unchanged, the rest
+	// of the resource is transformed
+	if out["managingOrganization"] != "Organization/org-1" {
+		t.Errorf("invalid element should be kept as-is, got %v", out["managingOrganization"])
+	}
+
+	practitioners, _ := out["generalPractitioner"].([]interface{})
+
+	if len(practitioners) != 2 || practitioners[0].(map[string]interface{})["id"] != "pr-1" {
+		t.Errorf("valid references should be transformed, got %v", out["generalPractitioner"])
+	}
+
+	if _, ok := out["deceased"]; !ok {
+		t.Errorf("choice element isn't transformed: %v", out)
+	}
+
+	if _, _, err := doTransform(res, "4.0.0", true); err == nil || !strings.Contains(err.Error(), "Patient.managingOrganization") {
+		t.Errorf("strict mode should fail with element path, got %v", err)
+	}
+}
+
+func TestTransformInvalidResource(t *testing.T) {
+	if _, _, err := doTransform(map[string]interface{}{"id": "pt-1"}, "4.0.0", false); err == nil {
+		t.Error("expected error for resource without resourceType")
+	}
+
+	if _, _, err := doTransform(map[string]interface{}{"resourceType": "Patient"}, "0.0.1", false); err == nil {
+		t.Error("expected error for unknown FHIR version")
+	}
+
+	if _, _, err := doReverseTransform(map[string]interface{}{"resourceType": 42}, "4.0.0"); err == nil {
+		t.Error("expected error for invalid resourceType")
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"runtime"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgconn/ctxwatch"
 	"github.com/jackc/pgx/v5/pgxpool"
-	jsoniter "github.com/json-iterator/go"
 	db "github.com/labordude/fhirbase/db"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -27,9 +29,112 @@ Starts a simple web server to invoke SQL queries from the browser UI.
 
 You can specify web server's host and port with "--webhost" and
 "--webport" flags. If "--webhost" flag is empty (set to blank string)
-then web server will listen on all available network interfaces.`,
+then web server will listen on all available network interfaces.
+
+SQL queries from the UI (/q endpoint) run with privileges of the
+database user. With "--read-only" flag they run in read-only
+transactions, are cancelled after "--query-timeout" and return at most
+"--query-rows" rows. "--query-role" makes them run as another
+PostgreSQL role (SET ROLE), i.e. one with SELECT privileges only.
+
+/q takes the query from "query" parameter, from POST form or JSON body
+({"query": "...", "format": "csv"}) or as the whole POST body. Results
+are streamed as JSON (default), NDJSON or CSV depending on "format"
+parameter, "download=true" returns them as an attachment:
+
+  curl -H 'Content-Type: text/plain' -d 'SELECT * FROM patient' \
+    'localhost:3000/q?format=csv&download=true'
+
+Every endpoint except /health can require credentials: static bearer
+tokens given with "--auth-token" and user:password pairs for HTTP Basic
+authentication given with "--auth-basic". Both flags can be repeated,
+or set as lists under "auth-token" and "auth-basic" keys of the config
+file to keep secrets off the command line.
+
+HTTPS is served with "--tls-cert" and "--tls-key" PEM files, or with a
+certificate generated at start by "--tls-self-signed" for development
+(its SHA-256 fingerprint is printed in the log). "--read-timeout",
+"--write-timeout" and "--idle-timeout" limit connections; write timeout
+is off by default so long query results can be downloaded. Queries are
+cancelled in PostgreSQL when the client disconnects, and the server
+shuts down gracefully on SIGINT or SIGTERM, waiting up to
+"--shutdown-timeout" for active requests.
+
+Web server also implements Bulk Data Access API, so other systems can
+download resources from Fhirbase with "bulkget" command or any other
+Bulk Data client. Export is started with one of
+
+  /fhir/$export               all resources
+  /fhir/Patient/$export       resources of all patients
+  /fhir/Group/[id]/$export    resources of patients from Group.member
+
+supporting "_type" and "_since" parameters. Patient and group level
+exports include Patient resources and resources from the patients'
+compartments: ones referencing patients by any reference search
+parameter which can point to Patient (i.e. Observation.subject or
+Observation.performer) in search definitions of the FHIR version.
+Export runs in the background
+and writes NDJSON files into "--export-dir" directory (a temporary
+directory by default); its status URL is returned in Content-Location
+header of the kick-off response. Files of finished exports are removed
+after 24 hours.
+
+FHIR RESTful API is served under /fhir as well:
+
+  GET    /fhir/[type]/[id]    read
+  GET    /fhir/[type]?...     search (or POST /fhir/[type]/_search)
+  POST   /fhir/[type]         create
+  PUT    /fhir/[type]/[id]    update (or create with given id)
+  DELETE /fhir/[type]/[id]    delete
+
+  GET    /fhir/[type]/[id]/_history/[vid]    vread
+  GET    /fhir/[type]/[id]/_history          history of the resource
+  GET    /fhir/[type]/_history               history of the type
+  GET    /fhir/_history                      history of all resources
+
+  POST   /fhir                transaction or batch Bundle
+  GET    /fhir/metadata       CapabilityStatement
+
+Resources are stored with the same transformation as "load" command
+uses and are returned in canonical FHIR form. Responses have ETag and
+Last-Modified headers made from the version (txid) and timestamp of
+the resource; send ETag back in If-Match header of update and delete
+requests to make sure nobody changed the resource in between. Errors
+are reported with OperationOutcome resources.
+
+History is read from the history tables filled by updates and deletes,
+newest versions first. "_since" keeps versions created after the given
+instant, "_at" keeps versions which were current at the given date, and
+"_count" and "_offset" page through them.
+
+Transaction Bundle is performed in a single database transaction: it's
+saved into "transaction" table and all its changes share the same
+version (txid). References to "urn:uuid:" full URLs of other entries
+and conditional references ("Patient?identifier=...") are replaced with
+ids of the resources, conditional create (ifNoneExist), update and
+delete ("PUT Patient?identifier=...") are supported. Any failed entry
+rolls the whole transaction back. Entries of batch Bundle are performed
+one by one, failed ones get OperationOutcome in the response.
+
+CapabilityStatement (Conformance for FHIR versions before 1.8.0) lists
+resource types which have tables in the database along with their
+search parameters, so clients see exactly what the database holds.
+
+Search supports standard parameters of the FHIR version the database
+was created for (string, token, date, reference, uri, number and
+quantity ones) with their common modifiers and prefixes, as well as
+"_id", "_lastUpdated", "_count", "_offset", "_sort", "_elements" and
+"_total=accurate". "_include" and "_revinclude" (with ":iterate"
+modifier as well) add referenced and referencing resources to the
+results with search mode "include". Results are returned as searchset
+Bundle with self, first, previous and next links. Unknown parameters
+are ignored unless request has "Prefer: handling=strict" header.`,
 	Example: "fhirbase [--fhir=FHIR version] web",
 	Args:    cobra.NoArgs,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindCommandFlags(cmd, "read-only", "query-timeout", "query-rows", "query-role", "auth-token", "auth-basic",
+			"tls-cert", "tls-key", "tls-self-signed", "read-timeout", "write-timeout", "idle-timeout", "shutdown-timeout", "dev-dir")
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		if viper.GetString("webhost") == "" {
 			viper.Set("webhost", "localhost")
@@ -39,8 +144,11 @@ then web server will listen on all available network interfaces.`,
 		//
 		// Do Stuff Here
 		ctx := cmd.Context()
-		WebCommand(ctx)
+		err := WebCommand(ctx)
 
+		if err != nil {
+			fmt.Printf("Error running web server: %v\n", err)
+		}
 	},
 }
 var webhost string
@@ -58,21 +166,30 @@ func init() {
 	webCmd.PersistentFlags().UintVarP(&webport, "webport", "", 3000, "Web server port")
 	viper.BindPFlag("webhost", webCmd.PersistentFlags().Lookup("webhost"))
 	viper.BindPFlag("webport", webCmd.PersistentFlags().Lookup("webport"))
+	webCmd.PersistentFlags().String("export-dir", "", "Directory for files of Bulk Data exports")
+	viper.BindPFlag("export-dir", webCmd.PersistentFlags().Lookup("export-dir"))
+	webCmd.PersistentFlags().Bool("read-only", false, "Run SQL queries from the UI in read-only transactions with --query-timeout and --query-rows limits")
+	webCmd.PersistentFlags().Duration("query-timeout", 30*time.Second, "Statement timeout for SQL queries in --read-only mode")
+	webCmd.PersistentFlags().Int("query-rows", 10000, "Maximum number of rows returned by SQL query in --read-only mode")
+	webCmd.PersistentFlags().String("query-role", "", "PostgreSQL role to run SQL queries from the UI as")
+	webCmd.PersistentFlags().StringArray("auth-token", []string{}, "Bearer token accepted by the web server, can be repeated")
+	webCmd.PersistentFlags().StringArray("auth-basic", []string{}, "user:password accepted by the web server with HTTP Basic authentication, can be repeated")
+	webCmd.PersistentFlags().String("tls-cert", "", "PEM file with TLS certificate (chain) to serve HTTPS")
+	webCmd.PersistentFlags().String("tls-key", "", "PEM file with private key of --tls-cert")
+	webCmd.PersistentFlags().Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate generated at start (for development)")
+	webCmd.PersistentFlags().Duration("read-timeout", 30*time.Second, "Maximum duration for reading a request, 0 means no limit")
+	webCmd.PersistentFlags().Duration("write-timeout", 0, "Maximum duration for writing a response, 0 means no limit so long query results can be streamed")
+	webCmd.PersistentFlags().Duration("idle-timeout", 60*time.Second, "How long keep-alive connections wait for the next request")
+	webCmd.PersistentFlags().Duration("shutdown-timeout", 10*time.Second, "How long to wait for active requests on shutdown")
+	webCmd.PersistentFlags().String("dev-dir", "", "Directory static files are read from with DEV environment variable set (cmd/web of the source tree by default)")
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// webCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
-func qHandler(ctx context.Context, db *pgxpool.Pool, w http.ResponseWriter, r *http.Request) {
-	sql := r.URL.Query().Get("query")
+func healthHandler(ctx context.Context, db *pgxpool.Pool, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 
-	if len(sql) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"message\": \"Please provide 'query' query-string param\"}"))
-		return
-	}
-
 	conn, err := db.Acquire(ctx)
 
 	if err != nil {
@@ -83,95 +200,84 @@ func qHandler(ctx context.Context, db *pgxpool.Pool, w http.ResponseWriter, r *h
 
 	defer conn.Release()
 
-	stream := jsoniter.ConfigFastest.BorrowStream(w)
-	defer jsoniter.ConfigFastest.ReturnStream(stream)
-
-	rows, err := conn.Query(context.Background(), sql)
+	rows, err := conn.Query(context.Background(), "SELECT 1+1")
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-
-		stream.WriteVal(map[string]string{
-			"message": err.Error(),
-		})
-		stream.Flush()
-
+		w.Write([]byte("{ \"message\": \"cannot perform query\" }"))
 		return
 	}
 
 	defer rows.Close()
 
-	stream.WriteObjectStart()
-	stream.WriteObjectField("columns")
-	stream.WriteVal(rows.FieldDescriptions())
-	stream.WriteMore()
-	stream.WriteObjectField("rows")
-	stream.WriteArrayStart()
+	w.Write([]byte("{ \"message\": \"ich bin gesund\" }"))
+}
 
-	hasRows := rows.Next()
+func logging(logger *log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				logger.Println(r.Method, r.URL, r.RemoteAddr, r.UserAgent())
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-	for hasRows {
-		vals, err := rows.Values()
+//go:embed web/*
+var webFiles embed.FS
 
-		if err == nil {
-			stream.WriteVal(vals)
-		} else {
-			stream.WriteNil()
-		}
+// webDevDir returns the directory static files are served from in DEV
+// mode: "--dev-dir" flag, or "web" directory next to this file in the
+// source tree the binary was built from
+func webDevDir() string {
+	if dir := viper.GetString("dev-dir"); dir != "" {
+		return dir
+	}
 
-		hasRows = rows.Next()
+	_, file, _, ok := runtime.Caller(0)
 
-		if hasRows {
-			stream.WriteMore()
-		}
+	if !ok {
+		return ""
 	}
 
-	stream.WriteArrayEnd()
-	stream.WriteObjectEnd()
-
-	stream.Flush()
+	return filepath.Join(filepath.Dir(file), "web")
 }
 
-func healthHandler(ctx context.Context, db *pgxpool.Pool, w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "application/json")
+// staticHandler serves static files of the UI embedded into the binary.
+// With DEV environment variable set they are read from the source tree
+// on every request instead, so changes are visible without rebuilding.
+func staticHandler(logger *log.Logger) (http.Handler, error) {
+	if os.Getenv("DEV") == "" {
+		webFS, err := fs.Sub(webFiles, "web")
 
-	conn, err := db.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("{\"message\": \"Cannot acquire DB connection\"}"))
-		return
+		return http.FileServer(http.FS(webFS)), nil
 	}
 
-	defer conn.Release()
+	dir, err := filepath.Abs(webDevDir())
 
-	rows, err := conn.Query(context.Background(), "SELECT 1+1")
+	if err == nil {
+		_, err = os.Stat(filepath.Join(dir, "index.html"))
+	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("{ \"message\": \"cannot perform query\" }"))
-		return
+		return nil, fmt.Errorf("DEV mode cannot find static files, point --dev-dir to cmd/web directory of the source tree: %v", err)
 	}
 
-	defer rows.Close()
+	logger.Printf("DEV mode: serving static files from %s\n", dir)
 
-	w.Write([]byte("{ \"message\": \"ich bin gesund\" }"))
-}
+	files := http.FileServer(http.Dir(dir))
 
-func logging(logger *log.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				logger.Println(r.Method, r.URL, r.RemoteAddr, r.UserAgent())
-			}()
-			next.ServeHTTP(w, r)
-		})
-	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		files.ServeHTTP(w, r)
+	}), nil
 }
 
-//go:embed web/*
-var webFiles embed.FS
-
 // WebAction starts HTTP server and serves basic FB API
 func WebCommand(ctx context.Context) error {
 
@@ -179,22 +285,36 @@ func WebCommand(ctx context.Context) error {
 	webPort := viper.GetUint("webport")
 	addr := fmt.Sprintf("%s:%d", webHost, webPort)
 
-	database, err := db.GetConnection()
+	tlsConfig, fingerprint, err := webTLSConfig(webHost)
+
+	if err != nil {
+		return err
+	}
+
+	database, err := webConnection(ctx)
 
 	if err != nil {
 		return fmt.Errorf("Error acquiring connection: %v", err)
 	}
 
+	defer database.Close()
+
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
 	logger.Printf("Connected to database %s\n", database.Config().ConnString())
 
 	router := http.NewServeMux()
-	webFS, err := fs.Sub(webFiles, "web")
-	router.Handle("/", http.StripPrefix("/", http.FileServer(http.FS(webFS))))
+	static, err := staticHandler(logger)
+
+	if err != nil {
+		return err
+	}
+
+	router.Handle("/", static)
+	queryOpts := newQueryOptions()
 	router.HandleFunc("/q", func(w http.ResponseWriter, r *http.Request) {
 
-		qHandler(ctx, database, w, r)
+		qHandler(database, queryOpts, w, r)
 
 	})
 
@@ -204,33 +324,100 @@ func WebCommand(ctx context.Context) error {
 
 	})
 
+	layout, err := detectTableLayout(ctx, database)
+
+	if err != nil {
+		return err
+	}
+
+	exports, err := newExportManager(ctx, database, layout)
+
+	if err != nil {
+		return err
+	}
+
+	registerExportHandlers(router, exports)
+
+	api, err := newRestAPI(ctx, database, layout)
+
+	if err != nil {
+		return err
+	}
+
+	registerRestHandlers(router, api)
+
+	auth := newWebAuth()
+
+	if webHost != "localhost" && webHost != "127.0.0.1" && !auth.Enabled() && !queryOpts.readOnly {
+		logger.Println("Warning: SQL queries from /q run with full privileges of the database user and no authentication, consider --read-only and --auth-token or --auth-basic")
+	}
+
+	if webHost != "localhost" && webHost != "127.0.0.1" && auth.Enabled() && tlsConfig == nil {
+		logger.Println("Warning: credentials are sent over plain HTTP, consider --tls-cert and --tls-key")
+	}
+
 	server := &http.Server{
-		Addr:         addr,
-		Handler:      logging(logger)(router),
-		ErrorLog:     logger,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		Addr:              addr,
+		Handler:           logging(logger)(auth.Middleware("/health")(router)),
+		ErrorLog:          logger,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       viper.GetDuration("read-timeout"),
+		WriteTimeout:      viper.GetDuration("write-timeout"),
+		IdleTimeout:       viper.GetDuration("idle-timeout"),
 	}
 
-	idleConnsClosed := make(chan struct{})
+	// requests are cancelled when the client goes away, the server is
+	// stopped when the command's context is cancelled (i.e. on SIGINT)
+	stopped := make(chan struct{})
 	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
+		defer close(stopped)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown-timeout"))
+		defer cancel()
 
-		if err := server.Shutdown(context.Background()); err != nil {
+		if err := server.Shutdown(shutdownCtx); err != nil {
 			logger.Printf("HTTP server Shutdown: %v\n", err)
+			server.Close()
 		}
-		close(idleConnsClosed)
 	}()
 
-	logger.Printf("Starting web server on %s\n", addr)
+	if tlsConfig != nil {
+		logger.Printf("Starting web server on https://%s\n", addr)
+		logger.Printf("TLS certificate SHA-256 fingerprint: %s\n", fingerprint)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Printf("Starting web server on http://%s\n", addr)
+		err = server.ListenAndServe()
+	}
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Fatalf("Could not listen on %s: %v\n", addr, err)
+	if err != http.ErrServerClosed {
+		return fmt.Errorf("Could not listen on %s: %v", addr, err)
 	}
 
+	<-stopped
 	logger.Println("Server stopped")
 	return nil
 }
+
+// webConnection connects to the database with a pool which sends cancel
+// requests to PostgreSQL when context of a query is cancelled, so
+// queries of clients which went away don't keep running on the server
+func webConnection(ctx context.Context) (*pgxpool.Pool, error) {
+	config, err := db.GetPgxConnectionConfig()
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnConfig.BuildContextWatcherHandler = func(conn *pgconn.PgConn) ctxwatch.Handler {
+		return &pgconn.CancelRequestContextWatcherHandler{
+			Conn:               conn,
+			CancelRequestDelay: 100 * time.Millisecond,
+			DeadlineDelay:      5 * time.Second,
+		}
+	}
+
+	return pgxpool.NewWithConfig(ctx, config)
+}
@@ -1,6 +1,4 @@
 window.onload = function () {
-	var mime = 'text/x-pgsql';
-
 	const escapeHtml = (unsafe) => {
 		return unsafe
 			.replace(/&/g, '&amp;')
@@ -30,23 +28,47 @@ window.onload = function () {
 		}
 	};
 
+	const alertHtml = (cls, message) => {
+		return "<div class='alert alert-" + cls + "'>" + escapeHtml(message) + '</div>';
+	};
+
+	// downloadQuery submits a form, so the browser streams results of
+	// the query into a file
+	function downloadQuery(format) {
+		let form = document.createElement('form');
+		form.method = 'POST';
+		form.action = '/q';
+
+		[
+			['query', window.editor.getValue()],
+			['format', format],
+			['download', 'true'],
+		].forEach((kv) => {
+			let input = document.createElement('input');
+			input.type = 'hidden';
+			input.name = kv[0];
+			input.value = kv[1];
+			form.appendChild(input);
+		});
+
+		document.body.appendChild(form);
+		form.submit();
+		document.body.removeChild(form);
+	}
+
+	window.downloadQuery = downloadQuery;
+
 	function runQuery(cm) {
 		let q = cm.getValue();
-		let url = new URL('/q', window.location);
-		url.searchParams.append('query', q);
 
-		try {
-			gtag('event', 'sql', {
-				event_category: 'fhirbase-demo',
-				event_label: q,
-			});
-		} catch (e) {
-			console.error(e);
-		}
 		document.getElementById('results').innerHTML =
 			'<center>Loading...</center>';
 
-		fetch(url)
+		fetch('/q', {
+			method: 'POST',
+			headers: { 'Content-Type': 'application/json' },
+			body: JSON.stringify({ query: q }),
+		})
 			.then((response) => {
 				return response
 					.json()
@@ -60,15 +82,43 @@ window.onload = function () {
 					console.log('Got results', json);
 
 					let tbl =
-						'<h3>Results</h3><table class="table table-striped table-bordered table-sm"><thead><tr>';
+						'<h3>Results</h3>' +
+						'<div class="downloads">Download ' +
+						'<button type="button" class="btn btn-sm btn-outline-secondary" onclick="downloadQuery(\'csv\')">CSV</button> ' +
+						'<button type="button" class="btn btn-sm btn-outline-secondary" onclick="downloadQuery(\'ndjson\')">NDJSON</button>' +
+						'</div>';
+
+					if (json.error) {
+						tbl += alertHtml('danger', json.error);
+					}
+
+					if (json.truncated) {
+						tbl += alertHtml(
+							'warning',
+							'Results are truncated to ' + json.rows.length + ' rows'
+						);
+					}
+
+					tbl += '<table class="table table-striped table-bordered table-sm"><thead><tr>';
 
 					json.columns.forEach((clmn) => {
-						tbl += '<th>' + clmn.Name + '</th>';
+						tbl +=
+							'<th title="' + escapeHtml(clmn.type) + '">' + escapeHtml(clmn.name) + '</th>';
 					});
 
 					tbl += '</tr></thead><tbody>';
 
 					json.rows.forEach((row) => {
+						if (!Array.isArray(row)) {
+							tbl +=
+								'<tr class="table-danger"><td colspan="' +
+								json.columns.length +
+								'">' +
+								escapeHtml(row.error) +
+								'</td></tr>';
+							return;
+						}
+
 						tbl +=
 							'<tr>' +
 							row.map((f) => '<td>' + formatResultField(f) + '</td>').join('') +
@@ -98,27 +148,33 @@ window.onload = function () {
 		runQuery(window.editor);
 	};
 
-	window.editor = CodeMirror(document.getElementById('editor'), {
-		mode: mime,
-		theme: 'duotone-light',
-		indentWithTabs: true,
-		smartIndent: true,
-		lineNumbers: true,
-		matchBrackets: true,
-		value: 'SELECT * FROM patient LIMIT 100;',
-		autofocus: true,
-		extraKeys: {
-			'Ctrl-Space': 'autocomplete',
-			'Ctrl-Enter': runQuery,
-		},
-		hintOptions: {
-			tables: {
-				users: ['name', 'score', 'birthDate'],
-				countries: ['name', 'population', 'size'],
-			},
+	// the editor is a plain textarea, so the UI has no dependencies which
+	// have to be loaded from the internet
+	const textarea = document.createElement('textarea');
+	textarea.id = 'query';
+	textarea.spellcheck = false;
+	textarea.value = 'SELECT * FROM patient LIMIT 100;';
+	document.getElementById('editor').appendChild(textarea);
+
+	window.editor = {
+		getValue: () => textarea.value,
+		setValue: (v) => {
+			textarea.value = v;
 		},
+	};
+
+	textarea.addEventListener('keydown', (e) => {
+		if (e.key === 'Enter' && (e.ctrlKey || e.metaKey)) {
+			e.preventDefault();
+			runQuery(window.editor);
+		} else if (e.key === 'Tab') {
+			e.preventDefault();
+			textarea.setRangeText('\t', textarea.selectionStart, textarea.selectionEnd, 'end');
+		}
 	});
 
+	textarea.focus();
+
 	var data = {};
 	window.doSelect = (idx) => {
 		var item = data.queries[idx];
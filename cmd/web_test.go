@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestStaticHandler(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// DEV mode shouldn't depend on the working directory
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(os.TempDir())
+
+	for _, dev := range []string{"", "1"} {
+		t.Setenv("DEV", dev)
+		handler, err := staticHandler(logger)
+
+		if err != nil {
+			t.Fatalf("DEV=%s: %v", dev, err)
+		}
+
+		for path, status := range map[string]int{"/": 200, "/app.js": 200, "/app.css": 200, "/missing.js": 404} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+			if w.Code != status {
+				t.Errorf("DEV=%s %s: got status %d, want %d", dev, path, w.Code, status)
+			}
+
+			if dev != "" && status == 200 && w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("DEV=%s %s: files shouldn't be cached in DEV mode", dev, path)
+			}
+		}
+	}
+}
+
+func TestStaticHandlerDevDir(t *testing.T) {
+	t.Setenv("DEV", "1")
+	viper.Set("dev-dir", t.TempDir())
+	defer viper.Set("dev-dir", "")
+
+	if _, err := staticHandler(log.New(io.Discard, "", 0)); err == nil {
+		t.Error("expected error for --dev-dir without index.html")
+	}
+}
+
+func TestStaticAssetsEmbedded(t *testing.T) {
+	index, err := fs.ReadFile(webFiles, "web/index.html")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stylesheets, scripts and images are served by fhirbase itself, so
+	// the UI works without internet access
+	assets := regexp.MustCompile(`<(?:link|script|img)\b[^>]*?\b(?:href|src)="([^"]+)"`).FindAllStringSubmatch(string(index), -1)
+
+	if len(assets) == 0 {
+		t.Fatal("no assets found in index.html")
+	}
+
+	for _, m := range assets {
+		if strings.Contains(m[1], "//") {
+			t.Errorf("%s is loaded from another host", m[1])
+		} else if _, err := fs.Stat(webFiles, "web/"+m[1]); err != nil {
+			t.Errorf("%s isn't embedded: %v", m[1], err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// webAuth checks credentials of requests to the web server: static
+// bearer tokens and user:password pairs for HTTP Basic authentication,
+// taken from "--auth-token" and "--auth-basic" flags or the same keys
+// of the config file
+type webAuth struct {
+	tokens []string
+	basic  []string
+}
+
+func newWebAuth() *webAuth {
+	return &webAuth{
+		tokens: viper.GetStringSlice("auth-token"),
+		basic:  viper.GetStringSlice("auth-basic"),
+	}
+}
+
+// Enabled tells if any credentials are configured
+func (a *webAuth) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.basic) > 0
+}
+
+// secretMatches compares secret with the allowed ones in constant time
+func secretMatches(secret string, allowed []string) bool {
+	found := false
+
+	for _, s := range allowed {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(s)) == 1 {
+			found = true
+		}
+	}
+
+	return found
+}
+
+// Authorized tells if the request has valid credentials
+func (a *webAuth) Authorized(r *http.Request) bool {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return secretMatches(strings.TrimSpace(credentials), a.tokens)
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+
+		return err == nil && secretMatches(string(decoded), a.basic)
+	}
+
+	return false
+}
+
+// Middleware rejects requests without valid credentials, except paths
+// which are always open (i.e. health checks). Browsers are asked for
+// Basic credentials if they are configured, so the web UI keeps
+// working.
+func (a *webAuth) Middleware(open ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !a.Enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range open {
+				if r.URL.Path == p {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if a.Authorized(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if len(a.basic) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="fhirbase"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="fhirbase"`)
+			}
+
+			writeOperationOutcome(w, http.StatusUnauthorized, "login", "authentication required")
+		})
+	}
+}
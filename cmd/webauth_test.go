@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebAuthAuthorized(t *testing.T) {
+	setConfig(t, map[string]interface{}{
+		"auth-token": []string{"token-1", "token-2"},
+		"auth-basic": []string{"user:pass"},
+	})
+
+	a := newWebAuth()
+
+	if !a.Enabled() {
+		t.Fatal("auth should be enabled")
+	}
+
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	tests := map[string]bool{
+		"Bearer token-2":      true,
+		"bearer token-1":      true,
+		"Bearer token-3":      false,
+		"Bearer ":             false,
+		basic("user:pass"):    true,
+		basic("user:wrong"):   false,
+		"Basic user:pass":     false,
+		"token-1":             false,
+		"":                    false,
+		"Digest username=foo": false,
+	}
+
+	for header, expected := range tests {
+		r := httptest.NewRequest("GET", "/Patient", nil)
+		r.Header.Set("Authorization", header)
+
+		if a.Authorized(r) != expected {
+			t.Errorf("%q: got %v, want %v", header, !expected, expected)
+		}
+	}
+
+	if (&webAuth{}).Enabled() {
+		t.Error("auth without credentials should be disabled")
+	}
+}
+
+func TestWebAuthMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		auth          *webAuth
+		path          string
+		authorization string
+		status        int
+		challenge     string
+	}{
+		{&webAuth{}, "/Patient", "", http.StatusNoContent, ""},
+		{&webAuth{tokens: []string{"secret"}}, "/health", "", http.StatusNoContent, ""},
+		{&webAuth{tokens: []string{"secret"}}, "/Patient", "Bearer secret", http.StatusNoContent, ""},
+		{&webAuth{tokens: []string{"secret"}}, "/Patient", "", http.StatusUnauthorized, `Bearer realm="fhirbase"`},
+		// browsers are asked for Basic credentials when they are accepted
+		{&webAuth{tokens: []string{"secret"}, basic: []string{"user:pass"}}, "/", "Bearer wrong", http.StatusUnauthorized, `Basic realm="fhirbase"`},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+
+		tt.auth.Middleware("/health")(next).ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %q: got status %d, want %d", tt.path, tt.authorization, w.Code, tt.status)
+		}
+
+		if challenge := w.Header().Get("WWW-Authenticate"); challenge != tt.challenge {
+			t.Errorf("%s %q: got WWW-Authenticate %q, want %q", tt.path, tt.authorization, challenge, tt.challenge)
+		}
+
+		if tt.status == http.StatusUnauthorized {
+			if outcome := parseResource(t, w.Body.String()); outcome["resourceType"] != "OperationOutcome" {
+				t.Errorf("%s: expected OperationOutcome, got %v", tt.path, outcome)
+			}
+		}
+	}
+}
+
+func TestNewQueryOptions(t *testing.T) {
+	setConfig(t, map[string]interface{}{
+		"read-only":     true,
+		"query-timeout": "5s",
+		"query-rows":    100,
+		"query-role":    "reader",
+	})
+
+	expected := queryOptions{readOnly: true, timeout: 5 * time.Second, rowLimit: 100, role: "reader"}
+
+	if opts := newQueryOptions(); opts != expected {
+		t.Errorf("got %+v, want %+v", opts, expected)
+	}
+}
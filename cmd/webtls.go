@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// webTLSConfig returns TLS configuration of the web server: certificate
+// and key from "--tls-cert" and "--tls-key" files, or a self-signed
+// certificate generated at start with "--tls-self-signed". Nil means
+// plain HTTP.
+func webTLSConfig(host string) (*tls.Config, string, error) {
+	certFile := viper.GetString("tls-cert")
+	keyFile := viper.GetString("tls-key")
+	selfSigned := viper.GetBool("tls-self-signed")
+
+	var cert tls.Certificate
+	var err error
+
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, "", fmt.Errorf("both --tls-cert and --tls-key are required")
+		}
+
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot load TLS certificate: %v", err)
+		}
+	case selfSigned:
+		cert, err = selfSignedCertificate(host)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot generate TLS certificate: %v", err)
+		}
+	default:
+		return nil, "", nil
+	}
+
+	fingerprint := fmt.Sprintf("%X", sha256.Sum256(cert.Certificate[0]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, fingerprint, nil
+}
+
+// selfSignedCertificate generates a certificate for development valid
+// for a year for the host, localhost and loopback addresses
+func selfSignedCertificate(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Fhirbase"}, CommonName: "Fhirbase development certificate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if host != "" && host != "localhost" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	tests := map[string][]string{
+		"fhirbase.test": {"fhirbase.test", "localhost", "127.0.0.1", "::1"},
+		"10.0.0.5":      {"10.0.0.5", "localhost"},
+		"":              {"localhost"},
+	}
+
+	for host, names := range tests {
+		cert, err := selfSignedCertificate(host)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range names {
+			if err := parsed.VerifyHostname(name); err != nil {
+				t.Errorf("certificate for %q: %v", host, err)
+			}
+		}
+
+		if err := parsed.VerifyHostname("other.test"); err == nil {
+			t.Errorf("certificate for %q shouldn't be valid for other hosts", host)
+		}
+	}
+}
+
+// writeCertificate writes certificate and its key into PEM files and
+// returns their names
+func writeCertificate(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestWebTLSConfig(t *testing.T) {
+	if config, _, err := webTLSConfig("localhost"); config != nil || err != nil {
+		t.Errorf("plain HTTP is expected without TLS flags, got %v, %v", config, err)
+	}
+
+	cert, _ := selfSignedCertificate("localhost")
+	certFile, keyFile := writeCertificate(t, cert)
+	setConfig(t, map[string]interface{}{"tls-cert": certFile, "tls-key": keyFile})
+
+	config, fingerprint, err := webTLSConfig("localhost")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := fmt.Sprintf("%X", sha256.Sum256(cert.Certificate[0])); fingerprint != expected {
+		t.Errorf("got fingerprint %s, want %s", fingerprint, expected)
+	}
+
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("got minimal TLS version %x", config.MinVersion)
+	}
+
+	setConfig(t, map[string]interface{}{"tls-key": filepath.Join(t.TempDir(), "missing.pem")})
+
+	if _, _, err := webTLSConfig("localhost"); err == nil {
+		t.Error("expected error for missing key file")
+	}
+
+	setConfig(t, map[string]interface{}{"tls-key": ""})
+
+	if _, _, err := webTLSConfig("localhost"); err == nil || !strings.Contains(err.Error(), "both") {
+		t.Errorf("expected error for certificate without key, got %v", err)
+	}
+}
+
+func TestWebTLSSelfSigned(t *testing.T) {
+	setConfig(t, map[string]interface{}{"tls-self-signed": true})
+	config, fingerprint, err := webTLSConfig("localhost")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	// clients trust the server when they pin the printed fingerprint
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if got := fmt.Sprintf("%X", sha256.Sum256(cs.PeerCertificates[0].Raw)); got != fingerprint {
+				return fmt.Errorf("got fingerprint %s, want %s", got, fingerprint)
+			}
+
+			return nil
+		},
+	}}}
+
+	resp, err := client.Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+}
+
+func TestWebCommandInvalidTLS(t *testing.T) {
+	setConfig(t, map[string]interface{}{"tls-cert": "cert.pem"})
+
+	// TLS configuration is checked before connecting to the database
+	if err := WebCommand(context.Background()); err == nil || !strings.Contains(err.Error(), "--tls-key") {
+		t.Errorf("expected error for certificate without key, got %v", err)
+	}
+}